@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jwtly10/litlua"
 	"github.com/jwtly10/litlua/internal/lsp/server"
@@ -35,6 +39,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  $ litlua-ls\n\n")
 		fmt.Fprintf(os.Stderr, "  # Start with custom lua-language-server path\n")
 		fmt.Fprintf(os.Stderr, "  $ litlua-ls -luals=/usr/local/bin/lua-language-server\n\n")
+		fmt.Fprintf(os.Stderr, "  # Give up on completions sooner than other requests\n")
+		fmt.Fprintf(os.Stderr, "  $ litlua-ls -method-timeout=textDocument/completion=1s\n\n")
+		fmt.Fprintf(os.Stderr, "  # Run as a daemon, sharing lua-language-server between the editors of a workspace\n")
+		fmt.Fprintf(os.Stderr, "  $ litlua-ls -listen=unix:///tmp/litlua-ls.sock\n\n")
 		fmt.Fprintf(os.Stderr, "  # Enable debug logging\n")
 		fmt.Fprintf(os.Stderr, "  $ litlua-ls -debug\n")
 	}
@@ -42,10 +50,28 @@ func main() {
 	var (
 		debug      = flag.Bool("debug", false, "Enable debug logging")
 		lualsPath  = flag.String("luals", "", "Custom path to lua-language-server")
-		shadowRoot = flag.String("shadow-root", "", "Custom path to shadow root directory (for LSP intermediate files)")
+		shadowRoot = flag.String("shadow-root", "", "Custom path to shadow root directory (the workspace of lua-language-server for shadow documents)")
 		version    = flag.Bool("version", false, "Print version information")
+		varsFile   = flag.String("vars", "", "Path to a YAML file of variables to substitute when compiling")
+		styluaPath = flag.String("stylua", "", "Path to a StyLua binary, used to format code blocks instead of lua-language-server")
+		timeout    = flag.Duration("timeout", server.DefaultRequestTimeout, "How long to wait on requests to lua-language-server")
+		listen     = flag.String("listen", "", "Listen for clients on tcp://host:port or unix:///path instead of stdio, sharing lua-language-server between the clients of a workspace. Clients are not authenticated, TCP is only served on loopback hosts")
 	)
 
+	methodTimeouts := make(map[string]time.Duration)
+	flag.Func("method-timeout", "Timeout for requests of a method to lua-language-server, as method=duration (repeatable)", func(value string) error {
+		method, duration, ok := strings.Cut(value, "=")
+		if !ok || method == "" {
+			return fmt.Errorf("expected method=duration, got %q", value)
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		methodTimeouts[method] = d
+		return nil
+	})
+
 	flag.Parse()
 
 	if *version {
@@ -64,13 +90,26 @@ func main() {
 		})))
 	}
 
-	slog.Info("starting litlua-ls with opts", "version", litlua.VERSION, "debug", *debug, "custom-luals", *lualsPath, "custom-shadow-root", *shadowRoot)
+	slog.Info("starting litlua-ls with opts", "version", litlua.VERSION, "debug", *debug, "custom-luals", *lualsPath, "custom-shadow-root", *shadowRoot, "vars", *varsFile, "stylua", *styluaPath, "timeout", *timeout, "method-timeouts", methodTimeouts, "listen", *listen)
 
 	ctx := context.Background()
 
 	opts := server.Options{
 		LuaLsPath:  *lualsPath,  // Will use default if empty
 		ShadowRoot: *shadowRoot, // Will use default if empty
+		VarsFile:   *varsFile,
+		StyluaPath: *styluaPath,
+
+		RequestTimeout: *timeout,
+		MethodTimeouts: methodTimeouts,
+	}
+
+	if *listen != "" {
+		if err := serveDaemon(ctx, *listen, opts); err != nil {
+			slog.Error("failed to run daemon", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	s, err := server.NewServer(opts)
@@ -87,6 +126,30 @@ func main() {
 	<-jsonrpc2.NewConn(
 		ctx,
 		jsonrpc2.NewBufferedStream(server.NewStdRWC(), jsonrpc2.VSCodeObjectCodec{}),
-		jsonrpc2.HandlerWithError(s.Handle),
+		s.Handler(),
 	).DisconnectNotify()
 }
+
+// serveDaemon serves the clients connecting on the listen address until interrupted
+func serveDaemon(ctx context.Context, address string, opts server.Options) error {
+	d, err := server.NewDaemon(opts)
+	if err != nil {
+		return err
+	}
+
+	l, err := server.Listen(address)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	// Workspaces are shut down however serving ends, so no lua-language-server is left running
+	defer d.Close()
+	return d.Serve(ctx, l)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/jwtly10/litlua"
 	"github.com/jwtly10/litlua/internal/cli"
@@ -18,6 +19,10 @@ The LitLua CLI provides manual transformation of LitLua markdown files into Lua
 
 Usage:
   litlua [flags] <input-file>
+  litlua [flags] test <input-file>
+  litlua [flags] untangle <output-file>
+  litlua [flags] init -from <lua-file> [-o <output-file>]
+  litlua [flags] doc [-o <output-dir>] <input-file>
 
 Examples:
   # Transform a single file with default settings
@@ -29,6 +34,25 @@ Examples:
   # Enable debug logging while transforming
   $ litlua -debug example.litlua.md
 
+  # Fail on pragma warnings such as unknown keys
+  $ litlua -strict example.litlua.md
+
+  # Substitute variables from a per-machine variables file
+  $ litlua -vars ~/.config/litlua/vars.yaml example.litlua.md
+
+  # Run the lua test blocks of a file or directory
+  $ litlua test example.litlua.md
+
+  # Generate output that can be untangled, then write edits to it back into the markdown
+  $ litlua -markers example.litlua.md
+  $ litlua untangle example.litlua.lua
+
+  # Import an existing Lua file into a new init.litlua.md
+  $ litlua init -from init.lua
+
+  # Render all documents in cwd to a static HTML site in ./litlua-site
+  $ litlua doc .
+
   # Print version information
   $ litlua -version
 
@@ -43,6 +67,10 @@ func main() {
 	var (
 		debug   = flag.Bool("debug", false, "Enable debug logging")
 		version = flag.Bool("version", false, "Print version information")
+		strict  = flag.Bool("strict", false, "Fail on pragma warnings (unknown keys, malformed or misplaced pragmas)")
+		vars    = flag.String("vars", "", "Path to a YAML file of variables to substitute into code blocks")
+		noCheck = flag.Bool("no-syntax-check", false, "Skip Lua syntax validation of the generated output")
+		markers = flag.Bool("markers", false, "Wrap each block in marker comments, so the output can be untangled")
 	)
 
 	flag.Parse()
@@ -64,17 +92,41 @@ func main() {
 	}
 
 	args := flag.Args()
-	if len(args) != 1 {
-		flag.Usage()
-		os.Exit(1)
+	if len(args) > 0 && args[0] == "init" {
+		runInit(cli.NewProcessor(transformer.TransformOptions{}), args[1:])
+		return
 	}
 
 	opts := transformer.TransformOptions{
-		WriterMode: litlua.ModePretty,
+		WriterMode:    litlua.ModePretty,
+		StrictPragmas: *strict,
+		VarsFile:      *vars,
+		NoSyntaxCheck: *noCheck,
+		BlockMarkers:  *markers,
 	}
 
 	processor := cli.NewProcessor(opts)
 
+	if len(args) > 0 && args[0] == "doc" {
+		runDoc(processor, args[1:])
+		return
+	}
+
+	if len(args) != 1 && !(len(args) == 2 && (args[0] == "test" || args[0] == "untangle")) {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(args) == 2 {
+		switch args[0] {
+		case "test":
+			runTests(processor, args[1])
+		case "untangle":
+			runUntangle(processor, args[1])
+		}
+		return
+	}
+
 	absPath, err := filepath.Abs(args[0])
 	if err != nil {
 		fmt.Printf("❌ Failed to resolve absolute path: %v\n", err)
@@ -106,3 +158,161 @@ func main() {
 
 	fmt.Printf("\n✨ Compilation complete! Processed %d files\n", len(results))
 }
+
+func runTests(processor *cli.Processor, path string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Printf("❌ Failed to resolve absolute path: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\n🧪 Tests are running:\n"+
+		"  📄 Path     : %s\n",
+		absPath)
+
+	results, err := processor.TestPath(path)
+	if err != nil {
+		fmt.Printf("❌ Tests failed to run: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nTest Results:")
+	fmt.Printf("%-70s %-30s\n", "Test", "Result")
+	fmt.Println(strings.Repeat("-", 110))
+
+	var passed, failed int
+	for _, file := range results {
+		for _, result := range file.Results {
+			location := fmt.Sprintf("%s:%d", file.Path, result.Block.Position.StartLine)
+			if result.Passed() {
+				passed++
+				fmt.Printf("%-70s ✅ PASS (%s)\n", location, result.Duration.Round(time.Millisecond))
+				continue
+			}
+
+			failed++
+			fmt.Printf("%-70s ❌ FAIL\n", location)
+			fmt.Printf("    %s\n", result.Failure)
+		}
+	}
+
+	fmt.Println(strings.Repeat("-", 110))
+
+	if failed > 0 {
+		fmt.Printf("\n❌ %d passed, %d failed\n", passed, failed)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\n✨ All tests passed! Ran %d tests\n", passed)
+}
+
+func runUntangle(processor *cli.Processor, path string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Printf("❌ Failed to resolve absolute path: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\n🧶 Untangle is running:\n"+
+		"  📄 Path     : %s\n",
+		absPath)
+
+	result, err := processor.UntanglePath(path)
+	if err != nil {
+		fmt.Printf("❌ Untangle failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(result.Updated) == 0 {
+		fmt.Printf("\n✨ Nothing to untangle, %s is up to date\n", result.Source)
+		return
+	}
+
+	fmt.Println("\nUpdated Blocks:")
+	fmt.Printf("%-70s %-30s\n", "Source", "Lines")
+	fmt.Println(strings.Repeat("-", 110))
+
+	for _, update := range result.Updated {
+		fmt.Printf("%-70s %d-%d\n",
+			result.Source,
+			update.Block.Position.StartLine,
+			update.Block.Position.EndLine-1,
+		)
+	}
+
+	fmt.Println(strings.Repeat("-", 110))
+
+	if result.BackupPath != "" {
+		fmt.Printf("\n💾 Backup created: %s\n", result.BackupPath)
+	}
+
+	fmt.Printf("\n✨ Untangle complete! Updated %d blocks\n", len(result.Updated))
+	fmt.Println("   Recompile with -markers to bring the output back in line with the markdown")
+}
+
+func runInit(processor *cli.Processor, args []string) {
+	initFlags := flag.NewFlagSet("init", flag.ExitOnError)
+	var (
+		from   = initFlags.String("from", "", "Path to the Lua file to import")
+		output = initFlags.String("o", "", "Path of the markdown file to create (default: next to the Lua file)")
+	)
+	initFlags.Parse(args)
+
+	if *from == "" || initFlags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: litlua init -from <lua-file> [-o <output-file>]")
+		initFlags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	mdPath, err := processor.ImportFile(*from, *output)
+	if err != nil {
+		fmt.Printf("❌ Import failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\n✨ Import complete! Created %s\n", mdPath)
+}
+
+func runDoc(processor *cli.Processor, args []string) {
+	docFlags := flag.NewFlagSet("doc", flag.ExitOnError)
+	output := docFlags.String("o", "litlua-site", "Directory to write the HTML site to")
+	docFlags.Parse(args)
+
+	if docFlags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: litlua doc [-o <output-dir>] <input-file>")
+		docFlags.PrintDefaults()
+		os.Exit(1)
+	}
+
+	path := docFlags.Arg(0)
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Printf("❌ Failed to resolve absolute path: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\n📚 Docs are rendering:\n"+
+		"  📄 Path     : %s\n",
+		absPath)
+
+	results, err := processor.DocPath(path, *output)
+	if err != nil {
+		fmt.Printf("❌ Rendering failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("\nRendered Pages:")
+	fmt.Printf("%-70s %-30s\n", "Source", "Page")
+	fmt.Println(strings.Repeat("-", 110))
+
+	for _, result := range results {
+		fmt.Printf("%-70s %-30s \n",
+			result.Path,
+			result.OutPath,
+		)
+	}
+
+	fmt.Println(strings.Repeat("-", 110))
+
+	fmt.Printf("\n✨ Docs complete! Rendered %d pages to %s\n", len(results), *output)
+}
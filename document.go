@@ -1,5 +1,10 @@
 package litlua
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Document represents a parsed markdown document containing
 // pragmas and code blocks, and any other required metadata about the source file
 type Document struct {
@@ -9,6 +14,12 @@ type Document struct {
 	Pragmas Pragma
 	// The extracted code blocks
 	Blocks []CodeBlock
+	// The extracted test code blocks (```lua test), which are never written to the output
+	TestBlocks []CodeBlock
+	// Any problems found while parsing the pragmas of the document
+	//
+	// Errors will fail parsing, warnings only fail parsing in strict mode
+	PragmaDiagnostics []PragmaDiagnostic
 }
 
 type MetaData struct {
@@ -22,8 +33,13 @@ const (
 	PragmaOutput PragmaKey = "output"
 	PragmaForce  PragmaKey = "force"
 	PragmaDebug  PragmaKey = "debug"
+	PragmaVar    PragmaKey = "var"
+	PragmaExpand PragmaKey = "expand"
 )
 
+// KnownPragmaKeys are all pragma keys supported by the parser
+var KnownPragmaKeys = []PragmaKey{PragmaOutput, PragmaForce, PragmaDebug, PragmaVar, PragmaExpand}
+
 type Pragma struct {
 	// The lua file output directory, relative to the source markdown file
 	Output string
@@ -31,6 +47,66 @@ type Pragma struct {
 	Force bool
 	// Internal flag for additional debugging output
 	Debug bool
+	// Document-level variables, substituted into code blocks during transformation
+	Vars map[string]string
+	// Substitute ${name} and ${env:NAME} placeholders, which are kept as they are otherwise
+	Expand bool
+}
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", s)
+	}
+}
+
+// PragmaDiagnostic describes a problem with a single pragma in the source file
+type PragmaDiagnostic struct {
+	Severity Severity
+	// The pragma key, if one could be parsed
+	Key string
+	// The pragma value, if one could be parsed
+	Value string
+	// The 1-indexed line of the pragma in the source file
+	Line int
+	// A human readable description of the problem
+	Message string
+	// A suggested replacement for the key (for typos), if any
+	Suggestion string
+}
+
+func (d PragmaDiagnostic) Error() string {
+	msg := fmt.Sprintf("line %d: %s", d.Line, d.Message)
+	if d.Suggestion != "" {
+		msg += fmt.Sprintf(" (did you mean '%s'?)", d.Suggestion)
+	}
+	return msg
+}
+
+// PragmaError is returned when a document's pragmas fail validation
+//
+// It contains every pragma diagnostic of the document, not only the ones that caused the failure
+type PragmaError struct {
+	Diagnostics []PragmaDiagnostic
+}
+
+func (e *PragmaError) Error() string {
+	msgs := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		msgs = append(msgs, d.Error())
+	}
+	return fmt.Sprintf("invalid pragmas: %s", strings.Join(msgs, "; "))
 }
 
 type CodeBlock struct {
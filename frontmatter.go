@@ -0,0 +1,185 @@
+package litlua
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// frontMatterKey is the top level front matter key that contains litlua pragmas.
+// Other top level keys are ignored, as they are likely used by other markdown tooling
+const frontMatterKey = "litlua"
+
+// frontMatterVarsKey is the front matter key for a mapping of document variables,
+// the equivalent of multiple `var` comment pragmas
+const frontMatterVarsKey = "vars"
+
+// splitFrontMatter finds YAML front matter at the very start of the content
+//
+// Front matter must start on the first line with `---` and end with a line of `---` or `...`.
+// Returns the raw YAML and a copy of the content with the front matter replaced with empty lines,
+// so line numbers of the rest of the document are preserved.
+// If there is no front matter, fm is nil and content is returned unchanged.
+func splitFrontMatter(content []byte) (fm []byte, rest []byte) {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	end := frontMatterEnd(lines)
+	if end < 0 {
+		return nil, content
+	}
+
+	fm = bytes.Join(lines[1:end], nil)
+
+	rest = make([]byte, 0, len(content))
+	rest = append(rest, bytes.Repeat([]byte("\n"), end+1)...)
+	rest = append(rest, bytes.Join(lines[end+1:], nil)...)
+	return fm, rest
+}
+
+// FrontMatterLines returns the number of lines of the front matter at the top of the content, including
+// its delimiters, or 0 if there is no front matter
+func FrontMatterLines(content []byte) int {
+	return frontMatterEnd(bytes.SplitAfter(content, []byte("\n"))) + 1
+}
+
+// frontMatterEnd returns the index of the closing delimiter line of the front matter, or -1 if there is no front matter
+func frontMatterEnd(lines [][]byte) int {
+	if len(lines) == 0 || !isFrontMatterDelimiter(lines[0], false) {
+		return -1
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if isFrontMatterDelimiter(lines[i], true) {
+			return i
+		}
+	}
+
+	// Unterminated front matter is just markdown
+	return -1
+}
+
+func isFrontMatterDelimiter(line []byte, closing bool) bool {
+	l := string(bytes.TrimRight(line, " \t\r\n"))
+	return l == "---" || (closing && l == "...")
+}
+
+// parseFrontMatter parses litlua pragmas from YAML front matter into the [Pragma] struct
+//
+// For example:
+//
+//	---
+//	title: My config
+//	litlua:
+//	  output: init.lua
+//	  force: true
+//	  vars:
+//	    font_size: 14
+//	---
+//
+// will set the [Pragma] struct to have Output = "init.lua", Force = true and Vars = {"font_size": "14"}.
+//
+// Each key is validated the same way as comment pragmas. Returns the keys that were set,
+// mapped to their 1-indexed line in the source file, and any diagnostics found.
+func (p *Parser) parseFrontMatter(pragma *Pragma, fm []byte) (map[string]int, []PragmaDiagnostic) {
+	// The YAML starts on the line after the opening delimiter
+	const lineOffset = 1
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(fm, &root); err != nil {
+		return nil, []PragmaDiagnostic{{
+			Severity: SeverityError,
+			Line:     1,
+			Message:  fmt.Sprintf("invalid front matter: %v", err),
+		}}
+	}
+
+	// Empty front matter
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, []PragmaDiagnostic{{
+			Severity: SeverityError,
+			Line:     doc.Line + lineOffset,
+			Message:  "invalid front matter, expected a mapping of keys",
+		}}
+	}
+
+	var litluaNode *yaml.Node
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == frontMatterKey {
+			litluaNode = doc.Content[i+1]
+		}
+	}
+
+	if litluaNode == nil {
+		return nil, nil
+	}
+
+	if litluaNode.Kind != yaml.MappingNode {
+		return nil, []PragmaDiagnostic{{
+			Severity: SeverityError,
+			Key:      frontMatterKey,
+			Line:     litluaNode.Line + lineOffset,
+			Message:  fmt.Sprintf("invalid front matter, '%s' must be a mapping of pragma keys", frontMatterKey),
+		}}
+	}
+
+	keys := make(map[string]int)
+	var diags []PragmaDiagnostic
+	for i := 0; i+1 < len(litluaNode.Content); i += 2 {
+		keyNode, valueNode := litluaNode.Content[i], litluaNode.Content[i+1]
+		line := keyNode.Line + lineOffset
+
+		if keyNode.Value == frontMatterVarsKey && valueNode.Kind == yaml.MappingNode {
+			diags = append(diags, p.parseFrontMatterVars(pragma, valueNode, lineOffset)...)
+			keys[keyNode.Value] = line
+			continue
+		}
+
+		if valueNode.Kind != yaml.ScalarNode {
+			diags = append(diags, PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      keyNode.Value,
+				Line:     line,
+				Message:  fmt.Sprintf("invalid value for pragma '%s', expected a single value", keyNode.Value),
+			})
+			continue
+		}
+
+		if d := p.setPragma(pragma, keyNode.Value, valueNode.Value, line); d != nil {
+			diags = append(diags, *d)
+			continue
+		}
+
+		keys[keyNode.Value] = line
+	}
+
+	return keys, diags
+}
+
+// parseFrontMatterVars parses a front matter mapping of variables into the [Pragma] struct
+func (p *Parser) parseFrontMatterVars(pragma *Pragma, varsNode *yaml.Node, lineOffset int) []PragmaDiagnostic {
+	var diags []PragmaDiagnostic
+	for i := 0; i+1 < len(varsNode.Content); i += 2 {
+		keyNode, valueNode := varsNode.Content[i], varsNode.Content[i+1]
+		if valueNode.Kind != yaml.ScalarNode || !variableNameRegex.MatchString(keyNode.Value) {
+			diags = append(diags, PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      frontMatterVarsKey,
+				Value:    keyNode.Value,
+				Line:     keyNode.Line + lineOffset,
+				Message:  fmt.Sprintf("invalid variable '%s', expected a name with a single value", keyNode.Value),
+			})
+			continue
+		}
+
+		if pragma.Vars == nil {
+			pragma.Vars = make(map[string]string)
+		}
+		pragma.Vars[keyNode.Value] = valueNode.Value
+	}
+	return diags
+}
@@ -0,0 +1,346 @@
+package litlua
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+type ImportOptions struct {
+	// The output pragma of the document, relative to the markdown file
+	Output string
+	// The title of the document, written as the first heading. No heading is written if empty
+	Title string
+}
+
+// importItem is a single section of an imported document, either prose or a code block
+type importItem struct {
+	prose []string
+	code  []string
+	// The 1-indexed line of the first line of code in the Lua file
+	line int
+}
+
+// statementRange is the range of lines of one or more top level statements starting on the same line
+type statementRange struct {
+	start int
+	end   int
+	// If the statement defines a function
+	function bool
+}
+
+// ImportLua converts an existing Lua file into a LitLua markdown document
+//
+// Top level comments become prose, and code is split into a fenced block at every blank line between
+// top level statements, and before and after every top level function. Annotation comments (---@) and
+// long comments (--[[ ]]) are kept with the code.
+//
+// The generated document is parsed before it is returned, to check it reproduces the same Lua. Comments
+// that became prose are the only lines missing from the Lua, blank lines between blocks may be normalised.
+func ImportLua(r io.Reader, opts ImportOptions) (string, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("reading lua: %w", err)
+	}
+
+	src := strings.ReplaceAll(string(content), "\r\n", "\n")
+	chunk, err := parse.Parse(strings.NewReader(src), "import")
+	if err != nil {
+		return "", fmt.Errorf("parsing lua: %w", err)
+	}
+	if len(chunk) == 0 {
+		return "", fmt.Errorf("no lua statements found")
+	}
+
+	ranges, err := statementRanges(chunk, src)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	items := splitImport(lines, ranges)
+
+	var md strings.Builder
+	if opts.Output != "" {
+		fmt.Fprintf(&md, "<!-- @pragma %s: %s -->\n\n", PragmaOutput, opts.Output)
+	}
+	if opts.Title != "" {
+		fmt.Fprintf(&md, "# %s\n\n", opts.Title)
+	}
+
+	var want []string
+	for i, item := range items {
+		if i > 0 {
+			md.WriteString("\n")
+		}
+
+		if item.prose != nil {
+			md.WriteString(strings.Join(item.prose, "\n") + "\n")
+			continue
+		}
+
+		for j, line := range item.code {
+			if err := checkVariables(line); err != nil {
+				return "", fmt.Errorf("line %d: %w", item.line+j, err)
+			}
+		}
+		code := item.code
+
+		fence := codeFence(code)
+		md.WriteString(fence + "lua\n")
+		md.WriteString(strings.Join(code, "\n") + "\n")
+		md.WriteString(fence + "\n")
+		want = append(want, item.code...)
+	}
+
+	if err := checkImport(md.String(), want); err != nil {
+		return "", err
+	}
+
+	return md.String(), nil
+}
+
+// statementRanges returns the line range of each top level statement
+//
+// The parser only tracks the last line of block statements, so the Lua is scanned again to find the
+// last line of the last token before the next statement starts.
+func statementRanges(chunk []ast.Stmt, src string) ([]statementRange, error) {
+	var ranges []statementRange
+	for _, stmt := range chunk {
+		if n := len(ranges); n > 0 && ranges[n-1].start == stmt.Line() {
+			ranges[n-1].function = ranges[n-1].function || isFunctionStmt(stmt)
+			continue
+		}
+		ranges = append(ranges, statementRange{start: stmt.Line(), end: stmt.Line(), function: isFunctionStmt(stmt)})
+	}
+
+	sc := parse.NewScanner(strings.NewReader(src), "import")
+	lx := &parse.Lexer{}
+	i := 0
+	for {
+		tok, err := sc.Scan(lx)
+		if err != nil {
+			return nil, fmt.Errorf("scanning lua: %w", err)
+		}
+		if tok.Type < 0 {
+			break
+		}
+		lx.PrevTokenType = tok.Type
+
+		for i+1 < len(ranges) && tok.Pos.Line >= ranges[i+1].start {
+			i++
+		}
+		// The scanner is positioned at the end of the token, which may span lines (e.g. long strings)
+		ranges[i].end = max(ranges[i].end, sc.Pos.Line)
+	}
+
+	return ranges, nil
+}
+
+// splitImport splits the lines of a Lua file into prose and code sections
+func splitImport(lines []string, ranges []statementRange) []importItem {
+	byStart := make(map[int]statementRange, len(ranges))
+	for _, r := range ranges {
+		byStart[r.start] = r
+	}
+
+	var items []importItem
+	var code, prose []string
+	codeStart := 0
+	// If the current code block only holds annotations or long comments, which belong to the next statement
+	commentsOnly := false
+	lastFunction := false
+
+	flushCode := func() {
+		if len(code) > 0 {
+			items = append(items, importItem{code: code, line: codeStart})
+		}
+		code = nil
+	}
+	flushProse := func() {
+		if p := cleanProse(prose); len(p) > 0 {
+			items = append(items, importItem{prose: p})
+		}
+		prose = nil
+	}
+
+	for ln := 1; ln <= len(lines); {
+		if r, ok := byStart[ln]; ok {
+			flushProse()
+			if len(code) > 0 && !commentsOnly && (r.function || lastFunction) {
+				flushCode()
+			}
+			if len(code) == 0 {
+				codeStart = ln
+			}
+			code = append(code, lines[r.start-1:r.end]...)
+			commentsOnly = false
+			lastFunction = r.function
+			ln = r.end + 1
+			continue
+		}
+
+		line := lines[ln-1]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flushCode()
+			if len(prose) > 0 {
+				prose = append(prose, "")
+			}
+			ln++
+
+		case isLongCommentStart(trimmed) || isAnnotation(trimmed) || !strings.HasPrefix(trimmed, "--"):
+			flushProse()
+			if len(code) == 0 {
+				commentsOnly = true
+				codeStart = ln
+			}
+			code = append(code, line)
+			ln++
+
+			// Keep the rest of a long comment with it
+			if closing, ok := longCommentClose(trimmed); ok && !strings.Contains(trimmed[strings.Index(trimmed, "[")+1:], closing) {
+				for ; ln <= len(lines); ln++ {
+					code = append(code, lines[ln-1])
+					if strings.Contains(lines[ln-1], closing) {
+						ln++
+						break
+					}
+				}
+			}
+
+		default:
+			flushCode()
+			prose = append(prose, commentText(trimmed))
+			ln++
+		}
+	}
+
+	flushCode()
+	flushProse()
+
+	return items
+}
+
+// checkImport parses the generated markdown, and checks the code blocks reproduce the expected Lua
+func checkImport(markdown string, want []string) error {
+	doc, err := NewParser().ParseMarkdownDoc(strings.NewReader(markdown), MetaData{})
+	if err != nil {
+		return fmt.Errorf("parsing imported document: %w", err)
+	}
+	if err := SubstituteVariables(doc, nil); err != nil {
+		return fmt.Errorf("imported document: %w", err)
+	}
+
+	var got strings.Builder
+	for _, block := range doc.Blocks {
+		got.WriteString(block.Code)
+	}
+
+	if strings.Join(want, "\n")+"\n" != got.String() {
+		return fmt.Errorf("imported document does not reproduce the original lua")
+	}
+
+	return nil
+}
+
+// checkVariables returns an error if Lua code contains a {{ .name }} placeholder
+//
+// {{ .name }} has no escape, so Lua containing it can not be imported. ${name} is kept as it is, as imported
+// documents don't set the expand pragma.
+func checkVariables(line string) error {
+	for _, m := range variableRegex.FindAllString(line, -1) {
+		if !strings.HasPrefix(m, "$") {
+			return fmt.Errorf("'%s' would be substituted as a variable and can not be escaped", m)
+		}
+	}
+	return nil
+}
+
+// codeFence returns a fence longer than any backtick fence in the code, so the code can't close it early
+func codeFence(code []string) string {
+	fence := "```"
+	for _, line := range code {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, fence) {
+			run := len(trimmed) - len(strings.TrimLeft(trimmed, "`"))
+			fence = strings.Repeat("`", run+1)
+		}
+	}
+	return fence
+}
+
+// cleanProse trims blank lines from the start and end of prose, and collapses repeated blank lines
+//
+// Decorative comments (e.g. -- =====) would render as headings or rules, so they are dropped
+func cleanProse(prose []string) []string {
+	var cleaned []string
+	for _, line := range prose {
+		if line != "" && !strings.ContainsFunc(line, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+			continue
+		}
+		if line == "" && (len(cleaned) == 0 || cleaned[len(cleaned)-1] == "") {
+			continue
+		}
+		cleaned = append(cleaned, line)
+	}
+
+	for len(cleaned) > 0 && cleaned[len(cleaned)-1] == "" {
+		cleaned = cleaned[:len(cleaned)-1]
+	}
+
+	return cleaned
+}
+
+// commentText returns the text of a line comment, without the leading dashes
+func commentText(comment string) string {
+	return strings.TrimPrefix(strings.TrimLeft(comment, "-"), " ")
+}
+
+func isFunctionStmt(stmt ast.Stmt) bool {
+	var exprs []ast.Expr
+	switch s := stmt.(type) {
+	case *ast.FuncDefStmt:
+		return true
+	case *ast.LocalAssignStmt:
+		exprs = s.Exprs
+	case *ast.AssignStmt:
+		exprs = s.Rhs
+	}
+
+	if len(exprs) != 1 {
+		return false
+	}
+	_, ok := exprs[0].(*ast.FunctionExpr)
+	return ok
+}
+
+// isAnnotation returns true for LuaLS annotations, which are kept with the code they annotate
+func isAnnotation(trimmed string) bool {
+	return strings.HasPrefix(trimmed, "---@") || strings.HasPrefix(trimmed, "---|")
+}
+
+func isLongCommentStart(trimmed string) bool {
+	_, ok := longCommentClose(trimmed)
+	return ok
+}
+
+// longCommentClose returns the closing brackets of a long comment (--[[ or --[==[) starting the line
+func longCommentClose(trimmed string) (string, bool) {
+	rest, ok := strings.CutPrefix(trimmed, "--[")
+	if !ok {
+		return "", false
+	}
+
+	level := len(rest) - len(strings.TrimLeft(rest, "="))
+	if !strings.HasPrefix(rest[level:], "[") {
+		return "", false
+	}
+
+	return "]" + strings.Repeat("=", level) + "]", true
+}
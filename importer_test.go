@@ -0,0 +1,83 @@
+package litlua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportLua(t *testing.T) {
+	tests := []struct {
+		name    string
+		lua     string
+		opts    ImportOptions
+		want    string
+		wantErr string
+	}{
+		{
+			name: "test pragma and title are written",
+			lua:  "vim.o.number = true\n",
+			opts: ImportOptions{Output: "init.lua", Title: "init.lua"},
+			want: "<!-- @pragma output: init.lua -->\n\n# init.lua\n\n```lua\nvim.o.number = true\n```\n",
+		},
+		{
+			name: "test top level comments become prose",
+			lua:  "-- Line numbers\n-- are useful\n--\n-- ====\n-- Really\nvim.o.number = true\n",
+			want: "Line numbers\nare useful\n\nReally\n\n```lua\nvim.o.number = true\n```\n",
+		},
+		{
+			name: "test code is split at blank lines",
+			lua:  "vim.o.number = true\nvim.o.wrap = false\n\n\nvim.o.tabstop = 4\n",
+			want: "```lua\nvim.o.number = true\nvim.o.wrap = false\n```\n\n```lua\nvim.o.tabstop = 4\n```\n",
+		},
+		{
+			name: "test code is split at function boundaries",
+			lua:  "local M = {}\nfunction M.setup()\n\n  return M\nend\nlocal x = function() end\nreturn M\n",
+			want: "```lua\nlocal M = {}\n```\n\n```lua\nfunction M.setup()\n\n  return M\nend\n```\n\n```lua\nlocal x = function() end\n```\n\n```lua\nreturn M\n```\n",
+		},
+		{
+			name: "test annotations are kept with the function",
+			lua:  "---@param a number\nlocal function f(a)\n  return a\nend\n",
+			want: "```lua\n---@param a number\nlocal function f(a)\n  return a\nend\n```\n",
+		},
+		{
+			name: "test shell style variables are kept",
+			lua:  "local home = \"${HOME}\"\n",
+			want: "```lua\nlocal home = \"${HOME}\"\n```\n",
+		},
+		{
+			name: "test fence is longer than backtick fences in the code",
+			lua:  "local md = [[\n```lua\n]]\n",
+			want: "````lua\nlocal md = [[\n```lua\n]]\n````\n",
+		},
+		{
+			name:    "test template style variables can not be imported",
+			lua:     "local x = \"{{ .name }}\"\n",
+			wantErr: "line 1: '{{ .name }}' would be substituted as a variable and can not be escaped",
+		},
+		{
+			name:    "test invalid lua is refused",
+			lua:     "local function f(\n",
+			wantErr: "parsing lua",
+		},
+		{
+			name:    "test lua without statements is refused",
+			lua:     "-- just a comment\n",
+			wantErr: "no lua statements found",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ImportLua(strings.NewReader(tc.lua), tc.opts)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/jwtly10/litlua"
+)
+
+type DocResult struct {
+	// The markdown source file
+	Path string
+	// The rendered HTML page
+	OutPath string
+}
+
+// docPage is a markdown document to render, and where its pages are written
+type docPage struct {
+	absPath string
+	// The page of the document, relative to the output directory
+	pageRel string
+	title   string
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { display: flex; margin: 0; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; line-height: 1.5; color: #1f2328; }
+nav { flex: 0 0 16rem; padding: 1rem; border-right: 1px solid #d0d7de; height: 100vh; overflow-y: auto; position: sticky; top: 0; box-sizing: border-box; }
+nav ul { list-style: none; padding: 0; }
+main { flex: 1; max-width: 60rem; padding: 1rem 2rem; }
+pre { padding: 1rem; overflow-x: auto; border-radius: 6px; }
+a { color: #0969da; }
+.toc-2 { margin-left: 1rem; } .toc-3 { margin-left: 2rem; } .toc-4, .toc-5, .toc-6 { margin-left: 3rem; }
+.litlua-output { margin-top: -0.5rem; font-size: 0.85rem; text-align: right; }
+</style>
+</head>
+<body>
+<nav>
+<a href="{{ .IndexHref }}">Index</a>
+<ul>
+{{- range .TOC }}
+<li class="toc-{{ .Level }}"><a href="#{{ .ID }}">{{ .Text }}</a></li>
+{{- end }}
+</ul>
+</nav>
+<main>
+{{ .Content }}
+</main>
+</body>
+</html>
+`))
+
+type pageData struct {
+	Title     string
+	IndexHref string
+	TOC       []litlua.Heading
+	Content   template.HTML
+}
+
+// DocPath renders a file, or all files found in a directory, to a static HTML site in outDir
+//
+// Each document gets a page with a table of contents, where links to other rendered documents point at their pages.
+// The generated Lua of each document is rendered to its own page, and each code block links to its line there.
+// An index page lists all documents.
+func (p *Processor) DocPath(path, outDir string) ([]DocResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing path: %w", err)
+	}
+
+	root, files := path, []string{path}
+	if info.IsDir() {
+		files, err = p.findFiles(path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		root = filepath.Dir(path)
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+
+	pages := make(map[string]*docPage, len(files))
+	var order []*docPage
+	for _, file := range files {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve absolute path: %w", err)
+		}
+
+		rel, err := filepath.Rel(absRoot, absPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve relative path: %w", err)
+		}
+
+		page := &docPage{
+			absPath: absPath,
+			pageRel: strings.TrimSuffix(rel, fileExtension) + ".html",
+			title:   filepath.Base(absPath),
+		}
+		pages[absPath] = page
+		order = append(order, page)
+	}
+
+	var results []DocResult
+	for _, page := range order {
+		if err := p.renderDocPage(page, pages, absRoot, absOut); err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", page.absPath, err)
+		}
+
+		results = append(results, DocResult{
+			Path:    page.absPath,
+			OutPath: filepath.Join(absOut, page.pageRel),
+		})
+	}
+
+	if err := writeIndexPage(order, absOut); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// renderDocPage renders a document, and the Lua generated from it, to their pages
+func (p *Processor) renderDocPage(page *docPage, pages map[string]*docPage, absRoot, absOut string) error {
+	content, err := os.ReadFile(page.absPath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+
+	doc, err := p.parser.ParseMarkdownDoc(bytes.NewReader(content), litlua.MetaData{
+		AbsSource: page.absPath,
+	})
+	if err != nil {
+		return fmt.Errorf("parse error: %w", err)
+	}
+
+	outPath, err := p.transformer.ResolveOutputPath(page.absPath, doc.Pragmas)
+	if err != nil {
+		return err
+	}
+
+	// The output page mirrors the output path, outputs outside the root are grouped together, under a directory
+	// named after a hash of their directory so outputs with the same name don't overwrite each other's page
+	luaRel, err := filepath.Rel(absRoot, outPath)
+	if err != nil || strings.HasPrefix(luaRel, "..") {
+		luaRel = filepath.Join("_outputs", outputDirKey(filepath.Dir(outPath)), filepath.Base(outPath))
+	}
+	luaPageRel := luaRel + ".html"
+
+	vars, err := p.transformer.ResolveVariables(doc.Pragmas)
+	if err != nil {
+		return fmt.Errorf("variables error: %w", err)
+	}
+	if err := litlua.SubstituteVariables(doc, vars); err != nil {
+		// The docs are still useful with placeholders, so we don't fail
+		slog.Warn("could not substitute variables, rendering placeholders", "path", page.absPath, "error", err)
+	}
+
+	writer := litlua.NewWriterWithOptions(litlua.ModePretty, litlua.WriterOptions{BlockMarkers: p.opts.BlockMarkers})
+	var lua bytes.Buffer
+	if err := writer.WriteHeader(&lua, litlua.WriterMetadata{
+		Version:   litlua.VERSION,
+		AbsSource: page.absPath,
+		Generated: time.Now().Format(time.RFC3339),
+	}); err != nil {
+		return fmt.Errorf("write header error: %w", err)
+	}
+	if err := writer.WriteContent(doc, &lua); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+
+	outputLines := make(map[int]int, len(doc.Blocks))
+	for i, line := range writer.BlockOutputLines(doc) {
+		outputLines[doc.Blocks[i].Position.StartLine] = line
+	}
+
+	var html bytes.Buffer
+	headings, err := p.parser.RenderHTML(content, &html, litlua.RenderOptions{
+		BlockLink: func(block litlua.CodeBlock) (string, string) {
+			line, ok := outputLines[block.Position.StartLine]
+			if !ok {
+				// Test blocks are not written to the output
+				return "", ""
+			}
+			return fmt.Sprintf("%s#L%d", relLink(page.pageRel, luaPageRel), line), fmt.Sprintf("%s:%d", filepath.Base(outPath), line)
+		},
+		LinkDestination: func(dest string) string {
+			return crossLink(page, pages, dest)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range headings {
+		if h.Level == 1 {
+			page.title = h.Text
+			break
+		}
+	}
+
+	if err := writePage(filepath.Join(absOut, page.pageRel), pageData{
+		Title:     page.title,
+		IndexHref: relLink(page.pageRel, "index.html"),
+		TOC:       headings,
+		Content:   template.HTML(html.String()),
+	}); err != nil {
+		return err
+	}
+
+	luaHTML, err := highlightLua(lua.String())
+	if err != nil {
+		return err
+	}
+
+	return writePage(filepath.Join(absOut, luaPageRel), pageData{
+		Title:     filepath.Base(outPath),
+		IndexHref: relLink(luaPageRel, "index.html"),
+		TOC:       []litlua.Heading{},
+		Content:   template.HTML(fmt.Sprintf(`<p>Generated from <a href="%s">%s</a></p>%s`, relLink(luaPageRel, page.pageRel), template.HTMLEscapeString(page.title), luaHTML)),
+	})
+}
+
+// outputDirKey returns the name of the directory the pages of outputs in dir, outside the docs root, are written to
+func outputDirKey(dir string) string {
+	sum := sha256.Sum256([]byte(dir))
+	return hex.EncodeToString(sum[:4])
+}
+
+// crossLink rewrites links to other rendered documents to point at their pages
+func crossLink(page *docPage, pages map[string]*docPage, dest string) string {
+	if dest == "" || strings.HasPrefix(dest, "#") || strings.HasPrefix(dest, "/") || strings.Contains(dest, ":") {
+		return dest
+	}
+
+	target, fragment, _ := strings.Cut(dest, "#")
+	linked, ok := pages[filepath.Join(filepath.Dir(page.absPath), filepath.FromSlash(target))]
+	if !ok {
+		return dest
+	}
+
+	link := relLink(page.pageRel, linked.pageRel)
+	if fragment != "" {
+		link += "#" + fragment
+	}
+	return link
+}
+
+// relLink returns a link from one page to another, both relative to the output directory
+func relLink(from, to string) string {
+	rel, err := filepath.Rel(filepath.Dir(from), to)
+	if err != nil {
+		return filepath.ToSlash(to)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// highlightLua renders Lua to HTML with linkable line numbers (#L1, #L2, ...)
+func highlightLua(lua string) (string, error) {
+	iterator, err := lexers.Get("lua").Tokenise(nil, lua)
+	if err != nil {
+		return "", fmt.Errorf("highlighting lua: %w", err)
+	}
+
+	formatter := chromahtml.New(
+		chromahtml.WithLineNumbers(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"),
+	)
+
+	var out bytes.Buffer
+	if err := formatter.Format(&out, styles.Get("github"), iterator); err != nil {
+		return "", fmt.Errorf("highlighting lua: %w", err)
+	}
+	return out.String(), nil
+}
+
+func writeIndexPage(pages []*docPage, absOut string) error {
+	var content strings.Builder
+	content.WriteString("<h1>Documents</h1>\n<ul>\n")
+	for _, page := range pages {
+		fmt.Fprintf(&content, "<li><a href=\"%s\">%s</a> <small>%s</small></li>\n",
+			filepath.ToSlash(page.pageRel),
+			template.HTMLEscapeString(page.title),
+			template.HTMLEscapeString(strings.TrimSuffix(page.pageRel, ".html")+fileExtension),
+		)
+	}
+	content.WriteString("</ul>\n")
+
+	return writePage(filepath.Join(absOut, "index.html"), pageData{
+		Title:     "Documents",
+		IndexHref: "index.html",
+		TOC:       []litlua.Heading{},
+		Content:   template.HTML(content.String()),
+	})
+}
+
+func writePage(path string, data pageData) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create page: %w", err)
+	}
+	defer f.Close()
+
+	if err := pageTemplate.Execute(f, data); err != nil {
+		return fmt.Errorf("rendering page: %w", err)
+	}
+
+	slog.Debug("wrote page", "path", path)
+	return nil
+}
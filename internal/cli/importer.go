@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jwtly10/litlua"
+)
+
+// ImportFile converts an existing Lua file into a new LitLua markdown document
+//
+// If mdPath is empty, the document is created next to the Lua file (init.lua -> init.litlua.md).
+// The output pragma of the document points back at the Lua file. An existing document is never overwritten.
+//
+// Returns the absolute path of the created document.
+func (p *Processor) ImportFile(luaPath, mdPath string) (string, error) {
+	absLua, err := filepath.Abs(luaPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+
+	if mdPath == "" {
+		base := strings.TrimSuffix(strings.TrimSuffix(absLua, ".lua"), ".litlua")
+		mdPath = base + fileExtension
+	}
+
+	absMd, err := filepath.Abs(mdPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+
+	if !strings.HasSuffix(absMd, fileExtension) {
+		return "", fmt.Errorf("invalid file extension, expected %s", fileExtension)
+	}
+
+	if _, err := os.Stat(absMd); err == nil {
+		return "", fmt.Errorf("%s already exists", absMd)
+	}
+
+	output, err := filepath.Rel(filepath.Dir(absMd), absLua)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve output pragma: %w", err)
+	}
+
+	f, err := os.Open(absLua)
+	if err != nil {
+		return "", fmt.Errorf("error reading file: %w", err)
+	}
+	defer f.Close()
+
+	md, err := litlua.ImportLua(f, litlua.ImportOptions{
+		Output: filepath.ToSlash(output),
+		Title:  filepath.Base(absLua),
+	})
+	if err != nil {
+		return "", fmt.Errorf("import error: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(absMd), 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	if err := os.WriteFile(absMd, []byte(md), 0644); err != nil {
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+
+	slog.Debug("imported lua file", "path", absLua, "output", absMd)
+
+	return absMd, nil
+}
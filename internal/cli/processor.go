@@ -10,8 +10,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 	"github.com/jwtly10/litlua"
+	"github.com/jwtly10/litlua/internal/luatest"
 	"github.com/jwtly10/litlua/internal/transformer"
 )
 
@@ -37,12 +37,22 @@ type ProcessResult struct {
 type Processor struct {
 	transformer *transformer.Transformer
 	opts        transformer.TransformOptions
+
+	// Used for running test blocks
+	parser *litlua.Parser
+	runner *luatest.Runner
+
+	// Used for backing up markdown sources before they are untangled
+	backup *litlua.BackupManager
 }
 
 func NewProcessor(opts transformer.TransformOptions) *Processor {
 	return &Processor{
 		transformer: transformer.NewTransformer(opts),
 		opts:        opts,
+		parser:      litlua.NewParserWithOptions(litlua.ParserOptions{Strict: opts.StrictPragmas}),
+		runner:      luatest.NewRunner(luatest.DefaultRunnerOptions),
+		backup:      litlua.NewBackupManager(),
 	}
 }
 
@@ -71,57 +81,7 @@ func (p *Processor) ProcessPath(path string) ([]TranspileResult, error) {
 //
 // If a .git directory is found, it will be used to load .gitignore patterns.
 func (p *Processor) findFiles(root string) ([]string, error) {
-	var files []string
-	var patterns []gitignore.Pattern
-
-	// If .git exists, set up gitignore patterns
-	if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
-		// Add .git directory pattern
-		patterns = append(patterns, gitignore.ParsePattern(".git/", nil))
-
-		// Load .gitignore if it exists
-		if data, err := os.ReadFile(filepath.Join(root, ".gitignore")); err == nil {
-			for _, p := range strings.Split(string(data), "\n") {
-				if p = strings.TrimSpace(p); p != "" && !strings.HasPrefix(p, "#") {
-					patterns = append(patterns, gitignore.ParsePattern(p, nil))
-				}
-			}
-		}
-	}
-
-	matcher := gitignore.NewMatcher(patterns)
-
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
-		}
-
-		pathComponents := strings.Split(relPath, string(os.PathSeparator))
-
-		if len(patterns) > 0 {
-			if matcher.Match(pathComponents, info.IsDir()) {
-				if info.IsDir() {
-					return filepath.SkipDir
-				}
-				return nil
-			}
-		}
-
-		if !info.IsDir() && strings.HasSuffix(path, fileExtension) {
-			if len(files) >= maxFiles {
-				return fmt.Errorf("max files limit reached (%d)", maxFiles)
-			}
-			files = append(files, path)
-		}
-
-		return nil
-	})
-
+	files, err := transformer.FindDocuments(root, maxFiles)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/jwtly10/litlua"
+	"github.com/jwtly10/litlua/internal/luatest"
+)
+
+type TestFileResult struct {
+	Path    string
+	Results []luatest.Result
+}
+
+// TestPath runs the test blocks of a file, or of all files found in a directory
+//
+// Files without test blocks are skipped. An error is only returned if a file could not be tested,
+// test failures are reported in the results.
+func (p *Processor) TestPath(path string) ([]TestFileResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing path: %w", err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = p.findFiles(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results []TestFileResult
+	for _, file := range files {
+		result, err := p.testFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to test %s: %w", file, err)
+		}
+
+		if len(result.Results) == 0 {
+			slog.Debug("no test blocks found", "path", result.Path)
+			continue
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (p *Processor) testFile(path string) (TestFileResult, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return TestFileResult{}, fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+
+	content, err := os.ReadFile(absPath)
+	if err != nil {
+		return TestFileResult{}, fmt.Errorf("error reading file: %w", err)
+	}
+
+	doc, err := p.parser.ParseMarkdownDoc(bytes.NewReader(content), litlua.MetaData{
+		AbsSource: absPath,
+	})
+	if err != nil {
+		return TestFileResult{}, fmt.Errorf("parse error: %w", err)
+	}
+
+	vars, err := p.transformer.ResolveVariables(doc.Pragmas)
+	if err != nil {
+		return TestFileResult{}, fmt.Errorf("variables error: %w", err)
+	}
+
+	if err := litlua.SubstituteVariables(doc, vars); err != nil {
+		return TestFileResult{}, fmt.Errorf("substitution error: %w", err)
+	}
+
+	results, err := p.runner.Run(doc)
+	if err != nil {
+		return TestFileResult{}, err
+	}
+
+	return TestFileResult{
+		Path:    absPath,
+		Results: results,
+	}, nil
+}
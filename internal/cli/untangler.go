@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jwtly10/litlua"
+)
+
+type UntangleResult struct {
+	// The generated Lua file that was untangled
+	Path string
+	// The markdown source file that was updated
+	Source string
+	// The code blocks that were updated
+	Updated []litlua.BlockUpdate
+	// The backup of the markdown source file, empty if nothing was updated
+	BackupPath string
+}
+
+// UntanglePath writes changes made directly to a generated Lua file back into the code blocks of its markdown source
+//
+// The Lua file must have been generated with block markers. Nothing is written if any region of the Lua file
+// can't be mapped to exactly one code block. A backup of the markdown source is created before it is updated.
+func (p *Processor) UntanglePath(path string) (*UntangleResult, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+
+	luaFile, err := os.Open(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	defer luaFile.Close()
+
+	out, err := litlua.ReadGeneratedOutput(luaFile, absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UntangleResult{
+		Path:   absPath,
+		Source: out.Source,
+	}
+
+	if !strings.HasSuffix(out.Source, fileExtension) {
+		return nil, fmt.Errorf("markdown source %s of %s is not a %s file", out.Source, absPath, fileExtension)
+	}
+
+	info, err := os.Stat(out.Source)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing markdown source: %w", err)
+	}
+
+	content, err := os.ReadFile(out.Source)
+	if err != nil {
+		return nil, fmt.Errorf("error reading markdown source: %w", err)
+	}
+
+	doc, err := p.parser.ParseMarkdownDoc(bytes.NewReader(content), litlua.MetaData{
+		AbsSource: out.Source,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+
+	if err := p.checkUntangleSource(absPath, out.Source, doc.Pragmas); err != nil {
+		return nil, err
+	}
+
+	vars, err := p.transformer.ResolveVariables(doc.Pragmas)
+	if err != nil {
+		return nil, fmt.Errorf("variables error: %w", err)
+	}
+
+	updates, err := litlua.Untangle(doc, vars, out)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(updates) == 0 {
+		slog.Debug("no changed blocks found", "path", absPath, "source", out.Source)
+		return result, nil
+	}
+
+	updated, err := litlua.ApplyBlockUpdates(content, updates)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.opts.NoBackup {
+		result.BackupPath, err = p.backup.CreateBackupOf(out.Source)
+		if err != nil {
+			return nil, fmt.Errorf("backup error: %w", err)
+		}
+	}
+
+	if err := os.WriteFile(out.Source, updated, info.Mode().Perm()); err != nil {
+		return nil, fmt.Errorf("error writing markdown source: %w", err)
+	}
+
+	result.Updated = updates
+	slog.Debug("untangled output", "path", absPath, "source", out.Source, "updated", len(updates))
+
+	return result, nil
+}
+
+// checkUntangleSource checks that the markdown source named by the header of a Lua file is the source of that file,
+// so an edited or foreign output can't have untangle overwrite any document
+//
+// The source must sit beside the Lua file, or within its directory, unless its output pragma resolves to the Lua file,
+// e.g. for an output written to the config directory of an application.
+func (p *Processor) checkUntangleSource(luaPath, source string, pragma litlua.Pragma) error {
+	resolvedSource, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return fmt.Errorf("error resolving markdown source: %w", err)
+	}
+	resolvedDir, err := filepath.EvalSymlinks(filepath.Dir(luaPath))
+	if err != nil {
+		return fmt.Errorf("error resolving directory of %s: %w", luaPath, err)
+	}
+	if rel, err := filepath.Rel(resolvedDir, resolvedSource); err == nil && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	if output, err := p.transformer.ResolveOutputPath(source, pragma); err == nil && output == luaPath {
+		return nil
+	}
+
+	return fmt.Errorf("markdown source %s is not beside %s and does not compile to it, refusing to untangle", source, luaPath)
+}
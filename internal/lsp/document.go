@@ -0,0 +1,177 @@
+package lsp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// openDocument is the state of a document open in the editor
+type openDocument struct {
+	text    string
+	version int
+	// If the document is a plain Lua file, which is synced to lua-language-server unchanged at its mirror URI
+	plain bool
+
+	// The URI of the shadow document, empty until the document is first transformed
+	shadowURI string
+	// The code lines of each block written to the shadow file, sorted by line. Nil if the shadow
+	// file has to be transformed from the whole document, e.g. after a change to the markdown
+	blocks []codeLines
+	// The text of the shadow document, as last synced to lua-language-server
+	shadow string
+	// The version of the document the shadow document was last synced at
+	shadowVersion int
+	// Changes to the document since the shadow file was last synced, which apply to the shadow file as they are
+	pending []lsp.TextDocumentContentChangeEvent
+	// If lua-language-server may not have the shadow document as last synced, e.g. forwarding a change failed, so
+	// the next sync sends it whole
+	resync bool
+}
+
+// codeLines are the 0-indexed lines of code of a block
+type codeLines struct {
+	first, last int
+	// If the fence is indented, in which case the code is written to the shadow file without the indentation
+	indented bool
+}
+
+// blockCodeLines returns the code lines of the blocks of a document, including test blocks, sorted by line
+func blockCodeLines(doc *litlua.Document, text string) []codeLines {
+	lines := strings.Split(text, "\n")
+
+	var blocks []codeLines
+	for _, block := range append(append([]litlua.CodeBlock{}, doc.Blocks...), doc.TestBlocks...) {
+		// Blocks are 1-indexed from the first line of code to the closing fence
+		b := codeLines{first: block.Position.StartLine - 1, last: block.Position.EndLine - 2}
+		if fence := block.Position.StartLine - 2; fence >= 0 && fence < len(lines) {
+			b.indented = strings.TrimLeft(lines[fence], " \t") != lines[fence]
+		}
+		blocks = append(blocks, b)
+	}
+
+	slices.SortFunc(blocks, func(a, b codeLines) int { return a.first - b.first })
+	return blocks
+}
+
+// mapShadowChange checks if a change to the document applies to its shadow file as it is, updating the
+// code lines of the blocks for the lines added or removed
+//
+// Shadow files keep the lines of the markdown, and the code of unindented blocks is written unchanged,
+// so a change within the code lines of a single block can be forwarded to lua-language-server without
+// transforming the document again. Any other change returns false, as it may change the blocks of the
+// document (e.g. typing a fence), or edit a variable placeholder that is masked in the shadow file.
+func mapShadowChange(blocks []codeLines, before, after string, change lsp.TextDocumentContentChangeEvent) bool {
+	if change.Range == nil {
+		return false
+	}
+	start, end := change.Range.Start.Line, change.Range.End.Line
+
+	i := slices.IndexFunc(blocks, func(b codeLines) bool {
+		return b.first <= start && end <= b.last
+	})
+	if i < 0 || blocks[i].indented {
+		return false
+	}
+
+	beforeLines := strings.Split(before, "\n")
+	if end >= len(beforeLines) || containsVariables(beforeLines[start:end+1]) {
+		return false
+	}
+
+	added := strings.Count(change.Text, "\n")
+	afterLines := strings.Split(after, "\n")
+	if start+added >= len(afterLines) || containsVariables(afterLines[start:start+added+1]) {
+		return false
+	}
+	for _, line := range afterLines[start : start+added+1] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			return false
+		}
+	}
+
+	delta := added - (end - start)
+	blocks[i].last += delta
+	for j := i + 1; j < len(blocks); j++ {
+		blocks[j].first += delta
+		blocks[j].last += delta
+	}
+
+	return true
+}
+
+// containsVariables returns true if any of the lines has a variable placeholder
+//
+// ${} placeholders are counted even if the document does not expand them, as the worst case is transforming
+// the document again.
+func containsVariables(lines []string) bool {
+	for _, line := range lines {
+		if litlua.ContainsVariables(line, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyContentChanges applies the changes of a didChange notification to a document, in order
+//
+// A change without a range replaces the whole document
+func ApplyContentChanges(text string, changes []lsp.TextDocumentContentChangeEvent) (string, error) {
+	for _, change := range changes {
+		var err error
+		if text, err = applyContentChange(text, change); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+func applyContentChange(text string, change lsp.TextDocumentContentChangeEvent) (string, error) {
+	if change.Range == nil {
+		return change.Text, nil
+	}
+
+	start, err := PositionOffset(text, change.Range.Start)
+	if err != nil {
+		return "", err
+	}
+	end, err := PositionOffset(text, change.Range.End)
+	if err != nil {
+		return "", err
+	}
+	if end < start {
+		return "", fmt.Errorf("invalid change range %d:%d-%d:%d", change.Range.Start.Line, change.Range.Start.Character,
+			change.Range.End.Line, change.Range.End.Character)
+	}
+
+	return text[:start] + change.Text + text[end:], nil
+}
+
+// PositionOffset returns the byte offset of a position in text, where characters are counted in UTF-16 code units
+//
+// A character past the end of a line is the end of the line, and the line after the last line is the end of the text.
+func PositionOffset(text string, pos lsp.Position) (int, error) {
+	lines := strings.SplitAfter(text, "\n")
+	if pos.Line >= len(lines) {
+		if pos.Line == len(lines) && pos.Character == 0 {
+			return len(text), nil
+		}
+		return 0, fmt.Errorf("position %d:%d is out of range", pos.Line, pos.Character)
+	}
+
+	off := len(strings.Join(lines[:pos.Line], ""))
+	line := strings.TrimSuffix(lines[pos.Line], "\n")
+	units := 0
+	for i, r := range line {
+		if units >= pos.Character {
+			return off + i, nil
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return off + len(line), nil
+}
@@ -0,0 +1,234 @@
+package lsp
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func change(startLine, startChar, endLine, endChar int, text string) lsp.TextDocumentContentChangeEvent {
+	return lsp.TextDocumentContentChangeEvent{
+		Range: &lsp.Range{
+			Start: lsp.Position{Line: startLine, Character: startChar},
+			End:   lsp.Position{Line: endLine, Character: endChar},
+		},
+		Text: text,
+	}
+}
+
+func TestApplyContentChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		changes []lsp.TextDocumentContentChangeEvent
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "test changes are applied in order",
+			text:    "local x = 1\n",
+			changes: []lsp.TextDocumentContentChangeEvent{change(0, 6, 0, 7, "y"), change(0, 11, 0, 11, "\nlocal z = y")},
+			want:    "local y = 1\nlocal z = y\n",
+		},
+		{
+			name:    "test change without a range replaces the document",
+			text:    "local x = 1\n",
+			changes: []lsp.TextDocumentContentChangeEvent{change(0, 0, 0, 5, ""), {Text: "# Replaced\n"}},
+			want:    "# Replaced\n",
+		},
+		{
+			name:    "test characters are counted in utf-16",
+			text:    "local s = \"😀\"\n",
+			changes: []lsp.TextDocumentContentChangeEvent{change(0, 14, 0, 14, " -- emoji")},
+			want:    "local s = \"😀\" -- emoji\n",
+		},
+		{
+			name:    "test change at the end of the document",
+			text:    "a\n",
+			changes: []lsp.TextDocumentContentChangeEvent{change(1, 0, 1, 0, "b\n")},
+			want:    "a\nb\n",
+		},
+		{
+			name:    "test out of range change",
+			text:    "a\n",
+			changes: []lsp.TextDocumentContentChangeEvent{change(3, 0, 3, 0, "b")},
+			wantErr: "position 3:0 is out of range",
+		},
+		{
+			name:    "test inverted range",
+			text:    "abc\n",
+			changes: []lsp.TextDocumentContentChangeEvent{change(0, 2, 0, 1, "")},
+			wantErr: "invalid change range 0:2-0:1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ApplyContentChanges(tc.text, tc.changes)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestMapShadowChange(t *testing.T) {
+	const text = "# Doc\n\n```lua\nlocal x = 1\nlocal y = 2\n```\n\n- item\n  ```lua\n  local z = 3\n  ```\n\n```lua\nprint(x, '$HOME', ${name})\n```\n\n```lua\nlocal font = {{ .font }}\n```\n"
+
+	blocks := func() []codeLines {
+		return []codeLines{{first: 3, last: 4}, {first: 9, last: 9, indented: true}, {first: 13, last: 13}, {first: 17, last: 17}}
+	}
+
+	tests := []struct {
+		name       string
+		change     lsp.TextDocumentContentChangeEvent
+		want       bool
+		wantBlocks []codeLines
+	}{
+		{
+			name:       "test edit within a line of code",
+			change:     change(3, 10, 3, 11, "2"),
+			want:       true,
+			wantBlocks: blocks(),
+		},
+		{
+			name:       "test new line shifts the blocks after",
+			change:     change(4, 11, 4, 11, "\nlocal w = 4"),
+			want:       true,
+			wantBlocks: []codeLines{{first: 3, last: 5}, {first: 10, last: 10, indented: true}, {first: 14, last: 14}, {first: 18, last: 18}},
+		},
+		{
+			name:       "test removed line shifts the blocks after",
+			change:     change(3, 11, 4, 11, ""),
+			want:       true,
+			wantBlocks: []codeLines{{first: 3, last: 3}, {first: 8, last: 8, indented: true}, {first: 12, last: 12}, {first: 16, last: 16}},
+		},
+		{
+			name:   "test edit of prose",
+			change: change(0, 2, 0, 5, "Title"),
+		},
+		{
+			name:   "test edit of a fence",
+			change: change(2, 3, 2, 6, ""),
+		},
+		{
+			name:   "test edit across blocks",
+			change: change(4, 0, 13, 0, ""),
+		},
+		{
+			name:   "test typing a fence in code",
+			change: change(4, 0, 4, 0, "```\n"),
+		},
+		{
+			name:   "test edit of an indented block",
+			change: change(9, 12, 9, 13, "4"),
+		},
+		{
+			name:   "test edit of a line with a variable placeholder",
+			change: change(13, 6, 13, 7, "y"),
+		},
+		{
+			name:   "test typing a variable placeholder",
+			change: change(3, 10, 3, 11, "${one}"),
+		},
+		{
+			name:   "test typing inside a {{ }} placeholder",
+			change: change(17, 21, 17, 21, "s"),
+		},
+		{
+			name:   "test completing a {{ }} placeholder",
+			change: change(3, 10, 3, 11, "{{ .x }}"),
+		},
+		{
+			name:       "test typing a $ that is not a placeholder",
+			change:     change(3, 10, 3, 11, "'$'"),
+			want:       true,
+			wantBlocks: blocks(),
+		},
+		{
+			name:   "test full change",
+			change: lsp.TextDocumentContentChangeEvent{Text: text},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			after, err := ApplyContentChanges(text, []lsp.TextDocumentContentChangeEvent{tc.change})
+			require.NoError(t, err)
+
+			b := blocks()
+			require.Equal(t, tc.want, mapShadowChange(b, text, after, tc.change))
+			if tc.want {
+				require.Equal(t, tc.wantBlocks, b)
+			}
+		})
+	}
+}
+
+func TestFlushShadowChanges(t *testing.T) {
+	opts := DefaultDocumentServiceOptions
+	opts.ShadowRoot = t.TempDir()
+	s, err := NewDocumentService(opts)
+	require.NoError(t, err)
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	text := "<!-- @pragma output: init.lua -->\n\n```lua\nlocal x = 1\n```\n\n# Keymaps\n\n```lua\nvim.g.mapleader = ' '\n```\n"
+
+	s.OpenDocument(uri, 1, text)
+	shadow, err := s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+	require.Equal(t, 1, shadow.Version)
+
+	// Changes within code are synced to the shadow document as they are
+	text, err = s.ApplyChanges(uri, 2, []lsp.TextDocumentContentChangeEvent{
+		change(3, 11, 3, 11, "\nlocal y = x"),
+		change(10, 0, 10, 0, "vim.o.number = true\n"),
+	})
+	require.NoError(t, err)
+
+	changes, ok := s.FlushShadowChanges(uri)
+	require.True(t, ok)
+	require.Equal(t, shadow.URI, changes.URI)
+	require.Equal(t, 2, changes.Version)
+	require.Len(t, changes.Changes, 2)
+
+	incremental, _ := s.ShadowText(string(uri))
+
+	// Shadow documents are only kept in memory
+	require.NoFileExists(t, strings.TrimPrefix(shadow.URI, "file://"))
+
+	// The shadow document matches transforming the whole document
+	full, err := s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+	require.Equal(t, text, full.Source)
+	require.Equal(t, full.Text, incremental)
+
+	// Nothing is pending after a sync
+	changes, ok = s.FlushShadowChanges(uri)
+	require.True(t, ok)
+	require.Empty(t, changes.Changes)
+
+	// A shadow document lua-language-server may not have is transformed again, even for changes within code
+	s.ResyncShadow(uri)
+	_, err = s.ApplyChanges(uri, 3, []lsp.TextDocumentContentChangeEvent{change(3, 10, 3, 11, "2")})
+	require.NoError(t, err)
+	_, ok = s.FlushShadowChanges(uri)
+	require.False(t, ok)
+	_, err = s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+	changes, ok = s.FlushShadowChanges(uri)
+	require.True(t, ok)
+	require.Empty(t, changes.Changes)
+
+	// Changes to the markdown require the document to be transformed again
+	_, err = s.ApplyChanges(uri, 4, []lsp.TextDocumentContentChangeEvent{change(6, 2, 6, 9, "Options")})
+	require.NoError(t, err)
+	_, ok = s.FlushShadowChanges(uri)
+	require.False(t, ok)
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// client is the state of a connection from an editor. In daemon mode, the clients of a workspace share a server.
+type client struct {
+	conn *jsonrpc2.Conn
+
+	// Requests from the client being handled, by their ID
+	requests inflightRequests
+
+	// If the client supports nested document symbols
+	hierarchicalSymbols bool
+	// If the client supports workspace/configuration requests, otherwise they are answered from settings
+	configuration bool
+
+	// The documents the client has open, guarded by Server.clientsMu
+	documents map[string]bool
+	// The text of the documents the client has open while another client is writing them, guarded by
+	// Server.clientsMu. Changes to them are kept here until the document is handed over to the client.
+	readOnly map[string]*readOnlyDocument
+}
+
+// readOnlyDocument is the text of a document as a client that isn't writing it has it
+type readOnlyDocument struct {
+	version int
+	text    string
+}
+
+type clientKey struct{}
+
+// withClient returns a context for handling a message from c
+func withClient(ctx context.Context, c *client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// clientFrom returns the client a message being handled is from, or an empty client for messages that aren't from
+// a client, e.g. from lua-language-server
+func clientFrom(ctx context.Context) *client {
+	if c, ok := ctx.Value(clientKey{}).(*client); ok {
+		return c
+	}
+	return &client{}
+}
+
+// Handler returns the handler for a client connection, which is attached to the server on its first message
+//
+// Notifications are handled in the order they are received, as each document change builds on the previous one,
+// while requests are handled concurrently, so a slow request to lua-language-server does not hold up the others.
+// The initialize request is also handled in order, as every other request depends on it.
+func (s *Server) Handler() jsonrpc2.Handler {
+	return &attachHandler{attach: func(conn *jsonrpc2.Conn, _ *jsonrpc2.Request) (jsonrpc2.Handler, error) {
+		return s.attach(conn), nil
+	}}
+}
+
+// attachHandler hands the messages of a connection to the handler attach returns for it on its first message
+//
+// If attach fails, the message is replied to with the error, and the next message tries again.
+type attachHandler struct {
+	attach  func(conn *jsonrpc2.Conn, req *jsonrpc2.Request) (jsonrpc2.Handler, error)
+	handler jsonrpc2.Handler
+}
+
+func (h *attachHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	// Messages are handed over one at a time, so the handler needs no lock
+	if h.handler == nil {
+		handler, err := h.attach(conn, req)
+		if err != nil {
+			slog.Error("failed to attach client", "method", req.Method, "error", err)
+			if !req.Notif {
+				var rpcErr *jsonrpc2.Error
+				if !errors.As(err, &rpcErr) {
+					rpcErr = &jsonrpc2.Error{Code: jsonrpc2.CodeInternalError, Message: err.Error()}
+				}
+				_ = conn.ReplyWithError(ctx, req.ID, rpcErr)
+			}
+			return
+		}
+		h.handler = handler
+	}
+	h.handler.Handle(ctx, conn, req)
+}
+
+// attach adds a client connected over conn, returning the handler of its messages. A connection is only attached once.
+func (s *Server) attach(conn *jsonrpc2.Conn) jsonrpc2.Handler {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	i := slices.IndexFunc(s.clients, func(c *client) bool { return c.conn == conn })
+	var c *client
+	if i >= 0 {
+		c = s.clients[i]
+	} else {
+		c = &client{conn: conn, documents: make(map[string]bool), readOnly: make(map[string]*readOnlyDocument)}
+		s.clients = append(s.clients, c)
+	}
+
+	handle := func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+		return s.handleCancellable(withClient(ctx, c), conn, req)
+	}
+	return orderedHandler{Handler: jsonrpc2.HandlerWithError(handle), requests: &c.requests}
+}
+
+// detach removes the client connected over conn once it disconnects, closing the documents no other client has open,
+// handing the documents it was writing over to the next client, and returns the number of clients left
+func (s *Server) detach(ctx context.Context, conn *jsonrpc2.Conn) int {
+	s.clientsMu.Lock()
+	i := slices.IndexFunc(s.clients, func(c *client) bool { return c.conn == conn })
+	if i < 0 {
+		left := len(s.clients)
+		s.clientsMu.Unlock()
+		return left
+	}
+	c := s.clients[i]
+	s.clients = slices.Delete(s.clients, i, i+1)
+	left := len(s.clients)
+	var closed, handedOver []string
+	for uri := range c.documents {
+		last, handOver := s.releaseLocked(c, uri)
+		if last {
+			closed = append(closed, uri)
+		} else if handOver {
+			handedOver = append(handedOver, uri)
+		}
+	}
+	s.clientsMu.Unlock()
+
+	for _, uri := range closed {
+		if err := s.closeDocument(ctx, lsp.DocumentURI(uri)); err != nil {
+			slog.Error("failed to close document of disconnected client", "uri", uri, "error", err)
+		}
+	}
+	for _, uri := range handedOver {
+		if err := s.handOverDocument(ctx, lsp.DocumentURI(uri)); err != nil {
+			slog.Error("failed to hand over document of disconnected client", "uri", uri, "error", err)
+		}
+	}
+	return left
+}
+
+// openDocument records a document opened by the client of ctx, adding a reference to its shadow document, and returns
+// false if another client is writing it
+//
+// Clients share one shadow document, but each client versions its changes against its own text, so the changes of
+// two clients can't be merged into it. Only the first client to open a document writes it. For any other client, the
+// document is read-only until it is handed over, and the text it opened is kept for the handover.
+func (s *Server) openDocument(ctx context.Context, uri lsp.DocumentURI, version int, text string) bool {
+	c := clientFrom(ctx)
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if c.documents == nil {
+		return true
+	}
+	if !c.documents[string(uri)] {
+		c.documents[string(uri)] = true
+		if s.refs == nil {
+			s.refs = make(map[string]int)
+		}
+		s.refs[string(uri)]++
+	}
+
+	if writer, exists := s.writers[string(uri)]; exists && writer != c {
+		c.readOnly[string(uri)] = &readOnlyDocument{version: version, text: text}
+		return false
+	}
+	if s.writers == nil {
+		s.writers = make(map[string]*client)
+	}
+	s.writers[string(uri)] = c
+	return true
+}
+
+// applyReadOnlyChanges applies changes from the client of ctx to its text of a document it isn't writing, returning
+// false if the client is writing the document
+func (s *Server) applyReadOnlyChanges(ctx context.Context, uri lsp.DocumentURI, version int, changes []lsp.TextDocumentContentChangeEvent) (bool, error) {
+	c := clientFrom(ctx)
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	doc, exists := c.readOnly[string(uri)]
+	if !exists {
+		return false, nil
+	}
+
+	text, err := iLsp.ApplyContentChanges(doc.text, changes)
+	if err != nil {
+		return true, fmt.Errorf("failed to apply change to read-only %s: %w", uri, err)
+	}
+	doc.version, doc.text = version, text
+	return true, nil
+}
+
+// releaseDocument records a document closed by the client of ctx, dropping its reference to the shadow document, and
+// returns true if it was the last reference, so the document can be closed, or if the client was writing it, so it
+// has to be handed over with [Server.handOverDocument]
+func (s *Server) releaseDocument(ctx context.Context, uri lsp.DocumentURI) (last bool, handOver bool) {
+	c := clientFrom(ctx)
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	return s.releaseLocked(c, string(uri))
+}
+
+// releaseLocked is releaseDocument for client c, must hold clientsMu
+func (s *Server) releaseLocked(c *client, uri string) (last bool, handOver bool) {
+	if c.documents[uri] {
+		delete(c.documents, uri)
+		s.refs[uri]--
+	}
+	delete(c.readOnly, uri)
+	if s.refs[uri] <= 0 {
+		delete(s.refs, uri)
+		delete(s.writers, uri)
+		return true, false
+	}
+	if s.writers[uri] == c {
+		// The document stays read-only for the other clients until it is handed over
+		s.writers[uri] = nil
+		return false, true
+	}
+	return false, false
+}
+
+// handOverDocument hands a document its writer closed to the next client that has it open, reopening it in
+// lua-language-server with the text of that client
+//
+// lua-language-server is sent the document as newly opened, as the versions of the next client may be behind the
+// versions it has seen.
+func (s *Server) handOverDocument(ctx context.Context, documentURI lsp.DocumentURI) error {
+	uri := string(documentURI)
+	s.cancelDebouncedChange(uri)
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	shadowURI, transformed := s.docService.CloseDocument(documentURI)
+	if transformed {
+		if _, err := s.LuaLS.ForwardRequest(ctx, "textDocument/didClose", lsp.DidCloseTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(shadowURI)},
+		}); err != nil {
+			return err
+		}
+	}
+
+	// The document is opened with the text of the next client under the lock, so its changes from here on apply to it
+	s.clientsMu.Lock()
+	var next *client
+	for _, c := range s.clients {
+		if _, exists := c.readOnly[uri]; exists {
+			next = c
+			break
+		}
+	}
+	if next == nil {
+		// The other clients closed the document in the meantime
+		delete(s.writers, uri)
+		s.clientsMu.Unlock()
+		return nil
+	}
+	doc := next.readOnly[uri]
+	delete(next.readOnly, uri)
+	s.writers[uri] = next
+	s.docService.OpenDocument(documentURI, doc.version, doc.text)
+	s.clientsMu.Unlock()
+
+	slog.Info("handed document over to the next client", "uri", uri, "version", doc.version)
+	_, err := s.openShadowDoc(ctx, documentURI)
+	return err
+}
+
+// clientConns returns the connections of every client
+func (s *Server) clientConns() []*jsonrpc2.Conn {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	conns := make([]*jsonrpc2.Conn, len(s.clients))
+	for i, c := range s.clients {
+		conns[i] = c.conn
+	}
+	return conns
+}
+
+// primaryClient returns the client that has been connected the longest, which messages from lua-language-server
+// that aren't for every client are forwarded to, or nil if there are no clients
+func (s *Server) primaryClient() *client {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if len(s.clients) == 0 {
+		return nil
+	}
+	return s.clients[0]
+}
+
+// replyConn returns the connection to send messages about a request to, which is the client that sent it,
+// or the primary client for messages that aren't from a client
+func (s *Server) replyConn(ctx context.Context) *jsonrpc2.Conn {
+	if c := clientFrom(ctx); c.conn != nil {
+		return c.conn
+	}
+	if c := s.primaryClient(); c != nil {
+		return c.conn
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// CodeAction is an implementation of the CodeAction LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#codeAction
+//
+// https://github.com/sourcegraph/go-lsp only supports commands as code actions
+type CodeAction struct {
+	Title       string           `json:"title"`
+	Kind        string           `json:"kind,omitempty"`
+	Diagnostics []lsp.Diagnostic `json:"diagnostics,omitempty"`
+	IsPreferred bool             `json:"isPreferred,omitempty"`
+	Edit        *WorkspaceEdit   `json:"edit,omitempty"`
+	Command     *lsp.Command     `json:"command,omitempty"`
+}
+
+const (
+	codeActionQuickFix = "quickfix"
+	codeActionRewrite  = "refactor.rewrite"
+)
+
+// codeActions returns the code actions of lua-language-server for the shadow file, with their edits mapped
+// back to the markdown document, and the litlua code actions for the document
+func (s *Server) codeActions(ctx context.Context, params lsp.CodeActionParams) ([]interface{}, error) {
+	uri := params.TextDocument.URI
+	actions := []interface{}{}
+
+	// Documents without code blocks have no shadow file, but can still use the litlua actions
+	if shadow, synced := s.syncedShadow(uri); synced {
+		luaActions, err := s.luaCodeActions(ctx, params, shadow.URI)
+		if err != nil {
+			slog.Error("failed to get code actions from lua-ls", "error", err)
+		}
+		if s.shadowChanged(uri, shadow.Version) {
+			slog.Debug("dropping code actions of document changed while they were requested", "uri", uri)
+			luaActions = nil
+		}
+		actions = append(actions, luaActions...)
+	}
+
+	text, exists := s.docService.DocumentText(string(uri))
+	if !exists {
+		return actions, nil
+	}
+
+	doc, err := s.docService.Document(string(uri))
+	if err != nil && !errors.Is(err, litlua.ErrNoCodeBlocks) {
+		slog.Debug("unable to parse document for code actions", "uri", uri, "error", err)
+		return actions, nil
+	}
+
+	var blocks []litlua.CodeBlock
+	if doc != nil {
+		blocks = append(doc.Blocks, doc.TestBlocks...)
+		if doc.Pragmas.Output == "" {
+			actions = append(actions, outputPragmaAction(uri, text))
+		}
+	}
+
+	if action, ok := wrapInFenceAction(uri, text, params.Range, blocks); ok {
+		actions = append(actions, action)
+	}
+
+	return actions, nil
+}
+
+// luaCodeActions forwards the code action request to lua-language-server for the shadow file
+//
+// Actions with edits outside of Lua code blocks are dropped, e.g. disabling a diagnostic on the line
+// before a block would edit the fence.
+func (s *Server) luaCodeActions(ctx context.Context, params lsp.CodeActionParams, shadowURI string) ([]interface{}, error) {
+	indents := s.indentsOf(string(params.TextDocument.URI))
+
+	// litlua diagnostics are not known to lua-language-server
+	var diags []lsp.Diagnostic
+	for _, d := range params.Context.Diagnostics {
+		if d.Source != "litlua" {
+			d.Range = indents.rangeToShadow(d.Range)
+			diags = append(diags, d)
+		}
+	}
+	params.Context.Diagnostics = diags
+	params.Range = indents.rangeToShadow(params.Range)
+	params.TextDocument.URI = lsp.DocumentURI(shadowURI)
+
+	result, err := s.LuaLS.ForwardRequest(ctx, "textDocument/codeAction", params)
+	if err != nil {
+		return nil, err
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	// Actions are kept as raw JSON, so fields we don't know about are kept for codeAction/resolve
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(resultBytes, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse code action response: %w", err)
+	}
+
+	var actions []interface{}
+	for _, action := range raw {
+		if rawEdit, ok := action["edit"]; ok {
+			var edit WorkspaceEdit
+			if err := json.Unmarshal(rawEdit, &edit); err != nil {
+				return nil, fmt.Errorf("unable to parse code action edit: %w", err)
+			}
+
+			if err := s.mapWorkspaceEdit(&edit); err != nil {
+				slog.Debug("dropping code action", "title", string(action["title"]), "error", err)
+				continue
+			}
+
+			if action["edit"], err = json.Marshal(edit); err != nil {
+				return nil, err
+			}
+		}
+		actions = append(actions, action)
+	}
+
+	return actions, nil
+}
+
+// outputPragmaAction returns an action adding an output pragma to the top of a document, after any front matter,
+// named after the document
+func outputPragmaAction(uri lsp.DocumentURI, text string) CodeAction {
+	output := strings.TrimSuffix(path.Base(string(uri)), ".litlua.md") + ".lua"
+	line := litlua.FrontMatterLines([]byte(text))
+
+	return CodeAction{
+		Title: fmt.Sprintf("Add output pragma (%s)", output),
+		Kind:  codeActionQuickFix,
+		Edit: &WorkspaceEdit{Changes: map[string][]lsp.TextEdit{
+			string(uri): {{
+				Range:   lsp.Range{Start: lsp.Position{Line: line}, End: lsp.Position{Line: line}},
+				NewText: fmt.Sprintf("<!-- @pragma %s: %s -->\n\n", litlua.PragmaOutput, output),
+			}},
+		}},
+	}
+}
+
+// wrapInFenceAction returns an action wrapping the lines of the selection in a lua fence
+//
+// No action is returned for an empty selection, or a selection overlapping a code block.
+func wrapInFenceAction(uri lsp.DocumentURI, text string, rng lsp.Range, blocks []litlua.CodeBlock) (CodeAction, bool) {
+	if rng.Start == rng.End {
+		return CodeAction{}, false
+	}
+
+	lines := strings.Split(text, "\n")
+	start, end := rng.Start.Line, rng.End.Line
+	if rng.End.Character == 0 && end > start {
+		// The selection ends at the start of the line after the last selected line
+		end--
+	}
+	if end >= len(lines) {
+		return CodeAction{}, false
+	}
+
+	for _, block := range blocks {
+		// Lines of the opening and closing fences, 0-indexed
+		opening, closing := block.Position.StartLine-2, block.Position.EndLine-1
+		if start <= closing && end >= opening {
+			return CodeAction{}, false
+		}
+	}
+
+	closingFence := lsp.TextEdit{
+		Range:   lsp.Range{Start: lsp.Position{Line: end + 1}, End: lsp.Position{Line: end + 1}},
+		NewText: "```\n",
+	}
+	if end == len(lines)-1 {
+		// The last line has no line ending to insert after
+		eol := lsp.Position{Line: end, Character: len(lines[end])}
+		closingFence = lsp.TextEdit{Range: lsp.Range{Start: eol, End: eol}, NewText: "\n```"}
+	}
+
+	return CodeAction{
+		Title: "Wrap in lua code block",
+		Kind:  codeActionRewrite,
+		Edit: &WorkspaceEdit{Changes: map[string][]lsp.TextEdit{
+			string(uri): {
+				{
+					Range:   lsp.Range{Start: lsp.Position{Line: start}, End: lsp.Position{Line: start}},
+					NewText: "```lua\n",
+				},
+				closingFence,
+			},
+		}},
+	}, true
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputPragmaAction(t *testing.T) {
+	uri := lsp.DocumentURI("file:///config/init.litlua.md")
+
+	tests := []struct {
+		name     string
+		text     string
+		wantLine int
+	}{
+		{
+			name:     "test pragma is added to the top of the document",
+			text:     "# Config\n",
+			wantLine: 0,
+		},
+		{
+			name:     "test pragma is added after front matter",
+			text:     "---\ntitle: Config\n---\n# Config\n",
+			wantLine: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pos := lsp.Position{Line: tc.wantLine}
+			require.Equal(t, CodeAction{
+				Title: "Add output pragma (init.lua)",
+				Kind:  codeActionQuickFix,
+				Edit: &WorkspaceEdit{Changes: map[string][]lsp.TextEdit{
+					string(uri): {{Range: lsp.Range{Start: pos, End: pos}, NewText: "<!-- @pragma output: init.lua -->\n\n"}},
+				}},
+			}, outputPragmaAction(uri, tc.text))
+		})
+	}
+}
+
+func TestCodeActionsWithoutCodeBlocks(t *testing.T) {
+	_, _, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "# Config\n"},
+	}))
+
+	var actions []CodeAction
+	require.NoError(t, client.Call(ctx, "textDocument/codeAction", lsp.CodeActionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+	}, &actions))
+	require.Len(t, actions, 1)
+	require.Equal(t, "Add output pragma (init.lua)", actions[0].Title)
+}
+
+func TestWrapInFenceAction(t *testing.T) {
+	uri := lsp.DocumentURI("file:///init.litlua.md")
+	text := "# Config\n\nvim.o.number = true\nvim.o.wrap = false\n\n```lua\nlocal x = 1\n```\n\nlocal y = 2"
+	// The code block is on line 7 (1-indexed), with its closing fence on line 8
+	blocks := []litlua.CodeBlock{{Position: litlua.Position{StartLine: 7, EndLine: 8}}}
+
+	at := func(line, char int) lsp.Position {
+		return lsp.Position{Line: line, Character: char}
+	}
+	insert := func(pos lsp.Position, text string) lsp.TextEdit {
+		return lsp.TextEdit{Range: lsp.Range{Start: pos, End: pos}, NewText: text}
+	}
+
+	tests := []struct {
+		name      string
+		rng       lsp.Range
+		wantEdits []lsp.TextEdit
+	}{
+		{
+			name:      "test selected lines are wrapped",
+			rng:       lsp.Range{Start: at(2, 4), End: at(3, 2)},
+			wantEdits: []lsp.TextEdit{insert(at(2, 0), "```lua\n"), insert(at(4, 0), "```\n")},
+		},
+		{
+			name:      "test selection ending at the start of a line excludes that line",
+			rng:       lsp.Range{Start: at(2, 0), End: at(4, 0)},
+			wantEdits: []lsp.TextEdit{insert(at(2, 0), "```lua\n"), insert(at(4, 0), "```\n")},
+		},
+		{
+			name:      "test last line without a line ending",
+			rng:       lsp.Range{Start: at(9, 0), End: at(9, 5)},
+			wantEdits: []lsp.TextEdit{insert(at(9, 0), "```lua\n"), insert(at(9, 11), "\n```")},
+		},
+		{
+			name: "test empty selection",
+			rng:  lsp.Range{Start: at(2, 0), End: at(2, 0)},
+		},
+		{
+			name: "test selection overlapping a code block",
+			rng:  lsp.Range{Start: at(3, 0), End: at(5, 3)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			action, ok := wrapInFenceAction(uri, text, tc.rng, blocks)
+			if tc.wantEdits == nil {
+				require.False(t, ok)
+				return
+			}
+
+			require.True(t, ok)
+			require.Equal(t, codeActionRewrite, action.Kind)
+			require.Equal(t, tc.wantEdits, action.Edit.Changes[string(uri)])
+		})
+	}
+}
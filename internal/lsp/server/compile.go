@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+const (
+	// Compiles a single document, given its URI as the only argument
+	commandCompile = "litlua.compile"
+	// Compiles every document in the workspace
+	commandCompileWorkspace = "litlua.compileWorkspace"
+)
+
+// litluaCommands are the workspace/executeCommand commands handled by litlua-ls
+var litluaCommands = []string{commandCompile, commandCompileWorkspace}
+
+// CompileParams are the params of the custom litlua/compile request
+type CompileParams struct {
+	// The document to compile, every document in the workspace is compiled if nil
+	TextDocument *lsp.TextDocumentIdentifier `json:"textDocument,omitempty"`
+	// A token from the client to report the progress of compiling the workspace with
+	WorkDoneToken interface{} `json:"workDoneToken,omitempty"`
+}
+
+// ExecuteCommandParams extends the go-lsp type with the work done token
+type ExecuteCommandParams struct {
+	lsp.ExecuteCommandParams
+	WorkDoneToken interface{} `json:"workDoneToken,omitempty"`
+}
+
+// CompileResult is the result of compiling a single document
+type CompileResult struct {
+	URI lsp.DocumentURI `json:"uri"`
+	// The absolute path of the compiled Lua file, empty if compilation failed
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// workDoneProgress is the value of a $/progress notification
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#workDoneProgress
+type workDoneProgress struct {
+	Kind       string `json:"kind"`
+	Title      string `json:"title,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Percentage *int   `json:"percentage,omitempty"`
+}
+
+// executeCommand runs a litlua command, returning false if the command is not a litlua command
+func (s *Server) executeCommand(ctx context.Context, params ExecuteCommandParams) (interface{}, bool, error) {
+	switch params.Command {
+	case commandCompile:
+		if len(params.Arguments) != 1 {
+			return nil, true, fmt.Errorf("%s expects the document URI as its only argument", commandCompile)
+		}
+		uri, ok := params.Arguments[0].(string)
+		if !ok {
+			return nil, true, fmt.Errorf("%s expects the document URI as its only argument", commandCompile)
+		}
+
+		result, err := s.compile(ctx, CompileParams{TextDocument: &lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(uri)}})
+		return result, true, err
+
+	case commandCompileWorkspace:
+		result, err := s.compile(ctx, CompileParams{WorkDoneToken: params.WorkDoneToken})
+		return result, true, err
+	}
+
+	return nil, false, nil
+}
+
+// compile compiles a single document, using its text in the editor if it is open, or every document in the workspace
+func (s *Server) compile(ctx context.Context, params CompileParams) ([]CompileResult, error) {
+	if params.TextDocument == nil {
+		return s.compileWorkspace(ctx, params.WorkDoneToken)
+	}
+
+	uri := params.TextDocument.URI
+	text, exists := s.docService.DocumentText(string(uri))
+	if !exists {
+		path, err := s.docService.URIToPath(uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get original path: %w", err)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+
+	result := s.compileDocument(ctx, uri, text)
+	s.showCompileResult(ctx, result)
+	return []CompileResult{result}, nil
+}
+
+// compileWorkspace compiles every document in the workspace, reporting progress if the client gave a token
+func (s *Server) compileWorkspace(ctx context.Context, token interface{}) ([]CompileResult, error) {
+	if s.workspaceRoot == "" {
+		return nil, fmt.Errorf("no workspace root to compile")
+	}
+
+	paths, err := s.docService.FindDocuments(s.workspaceRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	s.notifyProgress(ctx, token, workDoneProgress{Kind: "begin", Title: "Compiling LitLua documents", Percentage: new(int)})
+
+	results := []CompileResult{}
+	failed := 0
+	for i, path := range paths {
+		rel, _ := filepath.Rel(s.workspaceRoot, path)
+		percentage := i * 100 / len(paths)
+		s.notifyProgress(ctx, token, workDoneProgress{Kind: "report", Message: rel, Percentage: &percentage})
+
+		uri := lsp.DocumentURI(s.docService.PathToURI(path))
+		text, exists := s.docService.DocumentText(string(uri))
+		if !exists {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				results = append(results, CompileResult{URI: uri, Error: err.Error()})
+				failed++
+				continue
+			}
+			text = string(content)
+		}
+
+		result := s.compileDocument(ctx, uri, text)
+		if result.Error != "" {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	summary := fmt.Sprintf("compiled %d documents", len(paths)-failed)
+	if failed > 0 {
+		summary += fmt.Sprintf(", %d failed", failed)
+	}
+	s.notifyProgress(ctx, token, workDoneProgress{Kind: "end", Message: summary})
+
+	messageType := lsp.MessageType(lsp.Info)
+	if failed > 0 {
+		messageType = lsp.MTWarning
+	}
+	s.showMessage(ctx, messageType, "litlua: "+summary)
+
+	return results, nil
+}
+
+// compileDocument compiles a document to its final output, publishing any error as a diagnostic
+func (s *Server) compileDocument(ctx context.Context, uri lsp.DocumentURI, text string) CompileResult {
+	result := CompileResult{URI: uri}
+
+	path, err := s.docService.URIToPath(uri)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to get original path: %s", err)
+		return result
+	}
+
+	output, compileErr := s.docService.TransformFinalDoc(text, path)
+	if err := s.publishCompileDiagnostics(ctx, uri, text, compileErr); err != nil {
+		slog.Error("failed to publish compile diagnostics", "error", err)
+	}
+	if compileErr != nil {
+		slog.Error("failed to compile final output", "uri", uri, "error", compileErr)
+		result.Error = compileErr.Error()
+		return result
+	}
+
+	slog.Info("Compiled final output", "path", output)
+	result.Output = output
+	return result
+}
+
+// showCompileResult shows the result of compiling a single document in the editor
+func (s *Server) showCompileResult(ctx context.Context, result CompileResult) {
+	name := filepath.Base(string(result.URI))
+	if result.Error != "" {
+		s.showMessage(ctx, lsp.MTError, fmt.Sprintf("litlua: failed to compile %s: %s", name, result.Error))
+		return
+	}
+	s.showMessage(ctx, lsp.Info, fmt.Sprintf("litlua: compiled %s to %s", name, result.Output))
+}
+
+// showMessage shows a message to the client a request is from, or to every client for messages that aren't about a
+// request, such as lua-language-server restarting
+func (s *Server) showMessage(ctx context.Context, messageType lsp.MessageType, message string) {
+	conns := s.clientConns()
+	if c := clientFrom(ctx); c.conn != nil {
+		conns = []*jsonrpc2.Conn{c.conn}
+	}
+
+	for _, conn := range conns {
+		if err := conn.Notify(ctx, "window/showMessage", lsp.ShowMessageParams{Type: messageType, Message: message}); err != nil {
+			slog.Error("failed to show message", "error", err)
+		}
+	}
+}
+
+// notifyProgress sends a $/progress notification, if the client gave a token to report progress with
+func (s *Server) notifyProgress(ctx context.Context, token interface{}, value workDoneProgress) {
+	conn := s.replyConn(ctx)
+	if conn == nil || token == nil {
+		return
+	}
+
+	params := struct {
+		Token interface{}      `json:"token"`
+		Value workDoneProgress `json:"value"`
+	}{Token: token, Value: value}
+	if err := conn.Notify(ctx, "$/progress", params); err != nil {
+		slog.Error("failed to notify progress", "error", err)
+	}
+}
+
+// mergeCommands adds the litlua commands to the executeCommandProvider capability of lua-language-server
+func mergeCommands(caps map[string]interface{}) {
+	provider, ok := caps["executeCommandProvider"].(map[string]interface{})
+	if !ok {
+		provider = map[string]interface{}{}
+	}
+
+	var commands []interface{}
+	if existing, ok := provider["commands"].([]interface{}); ok {
+		commands = existing
+	}
+	for _, command := range litluaCommands {
+		commands = append(commands, command)
+	}
+
+	provider["commands"] = commands
+	caps["executeCommandProvider"] = provider
+}
+
+// unmarshalParams unmarshals request params, which may be missing for requests without params
+func unmarshalParams(params *json.RawMessage, v interface{}) error {
+	if params == nil {
+		return nil
+	}
+	return json.Unmarshal(*params, v)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileWorkspace(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, content string) {
+		path := filepath.Join(root, rel)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	write("init.litlua.md", "<!-- @pragma output: init.lua -->\n\n```lua\nvim.o.number = true\n```\n")
+	write("plugins/broken.litlua.md", "<!-- @pragma output: broken.lua -->\n\n```lua\nlocal function f(\n```\n")
+	// Documents ignored by git are skipped, as the CLI skips them
+	write(".git/HEAD", "")
+	write(".gitignore", "vendor/\n")
+	write("vendor/skipped.litlua.md", "<!-- @pragma output: skipped.lua -->\n\n```lua\nlocal x = 1\n```\n")
+
+	opts := iLsp.DefaultDocumentServiceOptions
+	opts.ShadowRoot = t.TempDir()
+	opts.FinalTransformerOpts.NoBackup = true
+	docService, err := iLsp.NewDocumentService(opts)
+	require.NoError(t, err)
+
+	s := &Server{docService: docService, diagnostics: newDiagnosticStore(), workspaceRoot: root}
+
+	results, err := s.compileWorkspace(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	require.Equal(t, lsp.DocumentURI("file://"+filepath.Join(root, "init.litlua.md")), results[0].URI)
+	require.Equal(t, filepath.Join(root, "init.litlua.lua"), results[0].Output)
+	require.Empty(t, results[0].Error)
+	require.FileExists(t, results[0].Output)
+
+	require.Empty(t, results[1].Output)
+	require.Contains(t, results[1].Error, "syntax error")
+	require.NoFileExists(t, filepath.Join(root, "plugins", "broken.litlua.lua"))
+
+	// the compile error is kept as a diagnostic of the document
+	diags := s.diagnostics.setLuaLS(string(results[1].URI), nil)
+	require.Len(t, diags, 1)
+	require.Equal(t, 3, diags[0].Range.Start.Line)
+}
+
+func TestMergeCommands(t *testing.T) {
+	caps := map[string]interface{}{
+		"executeCommandProvider": map[string]interface{}{"commands": []interface{}{"lua.solve"}},
+	}
+	mergeCommands(caps)
+	require.Equal(t, map[string]interface{}{
+		"commands": []interface{}{"lua.solve", commandCompile, commandCompileWorkspace},
+	}, caps["executeCommandProvider"])
+
+	caps = map[string]interface{}{}
+	mergeCommands(caps)
+	require.Equal(t, map[string]interface{}{
+		"commands": []interface{}{commandCompile, commandCompileWorkspace},
+	}, caps["executeCommandProvider"])
+}
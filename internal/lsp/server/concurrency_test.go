@@ -0,0 +1,528 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/stretchr/testify/require"
+)
+
+// assignmentRegex matches the = of an assignment, for the fake to format
+var assignmentRegex = regexp.MustCompile(`\s*=\s*`)
+
+// requireRegex matches a require of a module, for the fake to resolve
+var requireRegex = regexp.MustCompile(`require\(["']([\w.]+)["']\)`)
+
+// wordRegex matches an identifier, for the fake to rename
+var wordRegex = regexp.MustCompile(`[A-Za-z_]\w*`)
+
+// fakeLuaLS stands in for lua-language-server, keeping the shadow documents it is sent
+type fakeLuaLS struct {
+	mu          sync.Mutex
+	initialized bool
+	// The number of initialize requests received
+	initializes int
+	texts       map[string]string
+	versions    map[string]int
+	// Problems found with the notifications received, e.g. versions going backwards
+	errs []string
+
+	// The "test/slow" requests waiting to be cancelled, and the IDs of the requests cancelled
+	slow      map[jsonrpc2.ID]*jsonrpc2.Request
+	cancelled []jsonrpc2.ID
+
+	// The connection to the proxy, to send notifications and requests to the client through it
+	conn *jsonrpc2.Conn
+}
+
+// Handle replies to "test/slow" requests only once they are cancelled, handling anything else with handle
+func (f *fakeLuaLS) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	switch req.Method {
+	case "test/slow":
+		f.mu.Lock()
+		if f.slow == nil {
+			f.slow = make(map[jsonrpc2.ID]*jsonrpc2.Request)
+		}
+		f.slow[req.ID] = req
+		f.mu.Unlock()
+
+	case "$/cancelRequest":
+		var params lsp.CancelParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return
+		}
+		id := jsonrpc2.ID{Num: params.ID.Num, Str: params.ID.Str, IsString: params.ID.IsString}
+
+		f.mu.Lock()
+		slow, exists := f.slow[id]
+		delete(f.slow, id)
+		f.cancelled = append(f.cancelled, id)
+		f.mu.Unlock()
+
+		if exists {
+			_ = conn.ReplyWithError(ctx, slow.ID, &jsonrpc2.Error{Code: codeRequestCancelled, Message: "cancelled"})
+		}
+
+	default:
+		jsonrpc2.HandlerWithError(f.handle).Handle(ctx, conn, req)
+	}
+}
+
+func (f *fakeLuaLS) handle(_ context.Context, _ *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch req.Method {
+	case "initialize":
+		f.initialized = true
+		f.initializes++
+		return map[string]interface{}{"capabilities": map[string]interface{}{}}, nil
+
+	case "textDocument/didOpen":
+		var params lsp.DidOpenTextDocumentParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+		f.texts[string(params.TextDocument.URI)] = params.TextDocument.Text
+		f.versions[string(params.TextDocument.URI)] = params.TextDocument.Version
+
+	case "textDocument/didClose":
+		var params lsp.DidCloseTextDocumentParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+		if _, exists := f.texts[string(params.TextDocument.URI)]; !exists {
+			f.errs = append(f.errs, fmt.Sprintf("close of unopened document %s", params.TextDocument.URI))
+		}
+		delete(f.texts, string(params.TextDocument.URI))
+		delete(f.versions, string(params.TextDocument.URI))
+
+	case "textDocument/didChange":
+		var params lsp.DidChangeTextDocumentParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		uri := string(params.TextDocument.URI)
+		if _, exists := f.texts[uri]; !exists {
+			f.errs = append(f.errs, fmt.Sprintf("change of unopened document %s", uri))
+		}
+		if params.TextDocument.Version <= f.versions[uri] {
+			f.errs = append(f.errs, fmt.Sprintf("%s version %d after %d", uri, params.TextDocument.Version, f.versions[uri]))
+		}
+		text, err := iLsp.ApplyContentChanges(f.texts[uri], params.ContentChanges)
+		if err != nil {
+			f.errs = append(f.errs, err.Error())
+		}
+		f.texts[uri] = text
+		f.versions[uri] = params.TextDocument.Version
+
+	case "textDocument/hover":
+		if !f.initialized {
+			return nil, fmt.Errorf("hover before initialize")
+		}
+		var params lsp.TextDocumentPositionParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		text, exists := f.texts[string(params.TextDocument.URI)]
+		if !exists {
+			return nil, fmt.Errorf("hover of unopened document %s", params.TextDocument.URI)
+		}
+		lines := strings.Split(text, "\n")
+		if params.Position.Line >= len(lines) {
+			return nil, nil
+		}
+		return lsp.Hover{Contents: []lsp.MarkedString{{Language: "lua", Value: lines[params.Position.Line]}}}, nil
+
+	case "textDocument/rangeFormatting":
+		// Formats assignments in the range as `a = b`
+		var params lsp.DocumentRangeFormattingParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		lines := strings.Split(f.texts[string(params.TextDocument.URI)], "\n")
+		var edits []lsp.TextEdit
+		for i := params.Range.Start.Line; i < params.Range.End.Line && i < len(lines); i++ {
+			formatted := assignmentRegex.ReplaceAllString(lines[i], " = ")
+			if formatted != lines[i] {
+				edits = append(edits, lsp.TextEdit{
+					Range:   lsp.Range{Start: lsp.Position{Line: i}, End: lsp.Position{Line: i, Character: len(lines[i])}},
+					NewText: formatted,
+				})
+			}
+		}
+		return edits, nil
+
+	case "textDocument/rename":
+		// Renames every occurrence of the word at the position in its document
+		var params lsp.RenameParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		uri := string(params.TextDocument.URI)
+		lines := strings.Split(f.texts[uri], "\n")
+		if params.Position.Line >= len(lines) {
+			return nil, nil
+		}
+		var word string
+		for _, loc := range wordRegex.FindAllStringIndex(lines[params.Position.Line], -1) {
+			if loc[0] <= params.Position.Character && params.Position.Character < loc[1] {
+				word = lines[params.Position.Line][loc[0]:loc[1]]
+			}
+		}
+		if word == "" {
+			return nil, nil
+		}
+
+		var edits []lsp.TextEdit
+		for i, line := range lines {
+			for _, loc := range wordRegex.FindAllStringIndex(line, -1) {
+				if line[loc[0]:loc[1]] == word {
+					edits = append(edits, lsp.TextEdit{
+						Range:   lsp.Range{Start: lsp.Position{Line: i, Character: loc[0]}, End: lsp.Position{Line: i, Character: loc[1]}},
+						NewText: params.NewName,
+					})
+				}
+			}
+		}
+		return WorkspaceEdit{Changes: map[string][]lsp.TextEdit{uri: edits}}, nil
+
+	case "textDocument/definition":
+		// A require is defined at the start of the open document it resolves to, everything else where it is used
+		var params lsp.TextDocumentPositionParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		lines := strings.Split(f.texts[string(params.TextDocument.URI)], "\n")
+		if params.Position.Line < len(lines) {
+			if m := requireRegex.FindStringSubmatch(lines[params.Position.Line]); m != nil {
+				if uri, ok := f.resolveModule(m[1]); ok {
+					return []LocationLink{{TargetURI: lsp.DocumentURI(uri)}}, nil
+				}
+				return nil, nil
+			}
+		}
+
+		target := lsp.Range{Start: params.Position, End: params.Position}
+		return []LocationLink{{TargetURI: params.TextDocument.URI, TargetRange: target, TargetSelectionRange: target}}, nil
+	}
+
+	return nil, nil
+}
+
+// resolveModule returns the open document a module resolves to through the runtime paths of the shadow root, must
+// hold mu
+func (f *fakeLuaLS) resolveModule(module string) (string, bool) {
+	for _, pattern := range append(slices.Clone(defaultRuntimePaths), shadowRuntimePaths...) {
+		suffix := "/" + strings.ReplaceAll(pattern.(string), "?", strings.ReplaceAll(module, ".", "/"))
+		for uri := range f.texts {
+			if strings.HasSuffix(uri, suffix) {
+				return uri, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (f *fakeLuaLS) text(uri string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.texts[uri]
+}
+
+// newTestServer returns a server proxying to a fake lua-language-server, and a client connected to it
+func newTestServer(t *testing.T) (*Server, *fakeLuaLS, *jsonrpc2.Conn) {
+	t.Helper()
+
+	// The client ignores the notifications from the server, such as diagnostics
+	return newTestServerWithClient(t, jsonrpc2.HandlerWithError(func(context.Context, *jsonrpc2.Conn, *jsonrpc2.Request) (interface{}, error) {
+		return nil, nil
+	}))
+}
+
+// newTestServerWithClient is newTestServer with a client handling messages from the server with clientHandler
+func newTestServerWithClient(t *testing.T, clientHandler jsonrpc2.Handler) (*Server, *fakeLuaLS, *jsonrpc2.Conn) {
+	t.Helper()
+	ctx := context.Background()
+
+	s, fake := newFakeLuaLSServer(t, t.TempDir())
+
+	clientSide, serverSide := net.Pipe()
+	serverConn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(serverSide, jsonrpc2.VSCodeObjectCodec{}), s.Handler())
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientSide, jsonrpc2.VSCodeObjectCodec{}), clientHandler)
+
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+
+	return s, fake, client
+}
+
+// newFakeLuaLSServer returns a server with no clients, proxying to a fake lua-language-server
+func newFakeLuaLSServer(t *testing.T, shadowRoot string) (*Server, *fakeLuaLS) {
+	t.Helper()
+	ctx := context.Background()
+
+	opts := iLsp.DefaultDocumentServiceOptions
+	opts.ShadowRoot = shadowRoot
+	docService, err := iLsp.NewDocumentService(opts)
+	require.NoError(t, err)
+
+	s := &Server{
+		docService:    docService,
+		debounceTimer: make(map[string]*time.Timer),
+		diagnostics:   newDiagnosticStore(),
+	}
+
+	fake := &fakeLuaLS{texts: make(map[string]string), versions: make(map[string]int)}
+	lualsProxy, lualsFake := net.Pipe()
+	s.LuaLS = &LuaLS{server: s}
+	s.LuaLS.conn = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(lualsProxy, jsonrpc2.VSCodeObjectCodec{}),
+		s.LuaLS.handler())
+	fakeConn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(lualsFake, jsonrpc2.VSCodeObjectCodec{}),
+		fake)
+	fake.conn = fakeConn
+
+	t.Cleanup(func() {
+		s.LuaLS.conn.Close()
+		fakeConn.Close()
+	})
+
+	return s, fake
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	const documents = 4
+	const edits = 40
+
+	dir := t.TempDir()
+	finalTexts := make([]string, documents)
+
+	var wg sync.WaitGroup
+	for d := 0; d < documents; d++ {
+		wg.Add(1)
+		go func(d int) {
+			defer wg.Done()
+
+			uri := lsp.DocumentURI("file://" + filepath.Join(dir, fmt.Sprintf("doc%d.litlua.md", d)))
+			text := "# Config\n\n```lua\nlocal x = 0\n```\n"
+			require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+				TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: text},
+			}))
+
+			// Hovers run alongside the changes
+			var hovers sync.WaitGroup
+			hovers.Add(1)
+			go func() {
+				defer hovers.Done()
+				for i := 0; i < edits; i++ {
+					var hover lsp.Hover
+					err := client.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{
+						TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+						Position:     lsp.Position{Line: 3, Character: 6},
+					}, &hover)
+					require.NoError(t, err)
+				}
+			}()
+
+			for i := 0; i < edits; i++ {
+				var change lsp.TextDocumentContentChangeEvent
+				if i%10 == 9 {
+					// Editing the heading transforms the whole document
+					change = lsp.TextDocumentContentChangeEvent{
+						Range: &lsp.Range{Start: lsp.Position{Line: 0, Character: 2}, End: lsp.Position{Line: 0, Character: 2}},
+						Text:  "x",
+					}
+				} else {
+					// Adding a line of code is forwarded as it is
+					change = lsp.TextDocumentContentChangeEvent{
+						Range: &lsp.Range{Start: lsp.Position{Line: 4}, End: lsp.Position{Line: 4}},
+						Text:  fmt.Sprintf("x = x + %d\n", i),
+					}
+				}
+
+				var err error
+				text, err = iLsp.ApplyContentChanges(text, []lsp.TextDocumentContentChangeEvent{change})
+				require.NoError(t, err)
+
+				require.NoError(t, client.Notify(ctx, "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+					TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: i + 2},
+					ContentChanges: []lsp.TextDocumentContentChangeEvent{change},
+				}))
+				if i%5 == 0 {
+					// Let some of the debounced syncs run between changes
+					time.Sleep(250 * time.Millisecond)
+				}
+			}
+
+			hovers.Wait()
+			finalTexts[d] = text
+		}(d)
+	}
+	wg.Wait()
+
+	for d, text := range finalTexts {
+		uri := "file://" + filepath.Join(dir, fmt.Sprintf("doc%d.litlua.md", d))
+
+		got, exists := s.docService.DocumentText(uri)
+		require.True(t, exists)
+		require.Equal(t, text, got)
+
+		shadowURI, exists := s.docService.ShadowURI(uri)
+		require.True(t, exists)
+
+		// lua-language-server ends up with the shadow document of the latest text
+		opts := iLsp.DefaultDocumentServiceOptions
+		opts.ShadowRoot = s.docService.ShadowRoot()
+		fresh, err := iLsp.NewDocumentService(opts)
+		require.NoError(t, err)
+		fresh.OpenDocument(lsp.DocumentURI(uri), 0, text)
+		want, err := fresh.TransformShadowDoc(lsp.DocumentURI(uri))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return fake.text(shadowURI) == want.Text
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Empty(t, fake.errs)
+}
+
+func TestDidClose(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "```lua\nlocal x = 1\n```\n"},
+	}))
+
+	var shadowURI string
+	require.Eventually(t, func() bool {
+		var exists bool
+		shadowURI, exists = s.docService.ShadowURI(string(uri))
+		return exists && fake.text(shadowURI) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	// A change waiting to be synced is dropped when the document is closed
+	require.NoError(t, client.Notify(ctx, "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument:   lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: 2},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: "# Changed\n\n```lua\nlocal x = 2\n```\n"}},
+	}))
+	require.NoError(t, client.Notify(ctx, "textDocument/didClose", lsp.DidCloseTextDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+	}))
+
+	require.Eventually(t, func() bool {
+		_, open := s.docService.DocumentText(string(uri))
+		return !open
+	}, time.Second, 10*time.Millisecond)
+
+	// Wait past the debounce of the change
+	time.Sleep(300 * time.Millisecond)
+
+	s.mu.Lock()
+	require.Empty(t, s.debounceTimer)
+	s.mu.Unlock()
+
+	_, exists := s.docService.OriginalURI(shadowURI)
+	require.False(t, exists)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Empty(t, fake.texts)
+	require.Empty(t, fake.errs)
+}
+
+func TestCancelRequest(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	id := jsonrpc2.ID{Num: 100}
+	call, err := client.DispatchCall(ctx, "test/slow", nil, jsonrpc2.PickID(id))
+	require.NoError(t, err)
+
+	// Wait for the request to reach lua-language-server
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.slow) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Notify(ctx, "$/cancelRequest", lsp.CancelParams{ID: lsp.ID{Num: id.Num}}))
+
+	err = call.Wait(ctx, nil)
+	var rpcErr *jsonrpc2.Error
+	require.ErrorAs(t, err, &rpcErr)
+	require.Equal(t, int64(codeRequestCancelled), rpcErr.Code)
+
+	// The request is cancelled in lua-language-server with the ID it was forwarded with
+	fake.mu.Lock()
+	require.Len(t, fake.cancelled, 1)
+	require.NotEqual(t, id, fake.cancelled[0])
+	require.Empty(t, fake.slow)
+	fake.mu.Unlock()
+
+	// The request is forgotten once it has been replied to
+	require.Eventually(t, func() bool {
+		requests := &s.primaryClient().requests
+		requests.mu.Lock()
+		defer requests.mu.Unlock()
+		return len(requests.cancels) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+	s.LuaLS.methodTimeouts = map[string]time.Duration{"test/slow": 50 * time.Millisecond}
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	start := time.Now()
+	err := client.Call(ctx, "test/slow", nil, nil)
+	require.ErrorContains(t, err, "test/slow request to lua-language-server abandoned: context deadline exceeded")
+	require.Less(t, time.Since(start), DefaultRequestTimeout)
+
+	// The abandoned request is cancelled in lua-language-server
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.cancelled) == 1 && len(fake.slow) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Other methods keep the default timeout
+	require.Equal(t, DefaultRequestTimeout, s.LuaLS.requestTimeout("textDocument/hover"))
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// luarcFiles are the names of the lua-language-server config file of a workspace, in the order they are looked for
+var luarcFiles = []string{".luarc.json", ".luarc.jsonc"}
+
+// luaLSPathSettings are the lua-language-server settings holding paths, where relative paths are relative to the workspace root
+var luaLSPathSettings = []string{"workspace.library", "workspace.userThirdParty", "runtime.plugin"}
+
+// ConfigurationParams is an implementation of the ConfigurationParams LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#configurationParams
+type ConfigurationParams struct {
+	Items []ConfigurationItem `json:"items"`
+}
+
+type ConfigurationItem struct {
+	ScopeURI string `json:"scopeUri,omitempty"`
+	Section  string `json:"section,omitempty"`
+}
+
+// shadowRuntimePaths are added to the runtime.path of lua-language-server when compiled outputs are ignored, so a
+// require of a compiled output resolves to the shadow document of the litlua document it is compiled from
+var shadowRuntimePaths = []interface{}{"?.litlua.lua", "?/init.litlua.lua"}
+
+// defaultRuntimePaths are the runtime.path of lua-language-server if it isn't set
+var defaultRuntimePaths = []interface{}{"?.lua", "?/init.lua"}
+
+// syncWorkspaceConfig copies the lua-language-server config of the client's workspace to the shadow root, which is the
+// workspace lua-language-server sees, with relative paths made absolute to the client's workspace
+//
+// The compiled outputs of the litlua documents in the workspace are ignored, as lua-language-server would otherwise
+// see their code twice, once in the output and once in the shadow document. A copy left in the shadow root by an
+// earlier workspace is removed if the workspace has no config and no outputs to ignore.
+func (s *Server) syncWorkspaceConfig() error {
+	shadowConfig := filepath.Join(s.docService.ShadowRoot(), luarcFiles[0])
+
+	var data []byte
+	var configPath string
+	if s.workspaceRoot != "" {
+		for _, name := range luarcFiles {
+			path := filepath.Join(s.workspaceRoot, name)
+			content, err := os.ReadFile(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", path, err)
+			}
+			data, configPath = content, path
+			break
+		}
+	}
+
+	var outputs []string
+	if s.workspaceRoot != "" {
+		var err error
+		if outputs, err = s.docService.CompiledOutputs(s.workspaceRoot); err != nil {
+			slog.Warn("failed to find compiled outputs to ignore", "error", err)
+		}
+	}
+
+	if configPath == "" && len(outputs) == 0 {
+		if err := os.Remove(shadowConfig); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale config: %w", err)
+		}
+		return nil
+	}
+
+	config := make(map[string]interface{})
+	if configPath != "" {
+		if err := json.Unmarshal(stripJSONComments(data), &config); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", configPath, err)
+		}
+		rewriteConfigPaths(config, "", s.workspaceRoot)
+	}
+
+	if len(outputs) > 0 {
+		// Outputs are seen through the link of the workspace at the path it mirrors, and ignoreDir patterns are
+		// anchored to the shadow root, so the pattern of an output is its absolute path
+		ignored := make([]interface{}, len(outputs))
+		for i, output := range outputs {
+			ignored[i] = filepath.ToSlash(output)
+		}
+		appendConfigList(config, "workspace.ignoreDir", nil, ignored)
+		appendConfigList(config, "runtime.path", defaultRuntimePaths, shadowRuntimePaths)
+	}
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(shadowConfig, out, 0644); err != nil {
+		return fmt.Errorf("failed to write config to shadow root: %w", err)
+	}
+
+	slog.Info("synced lua-language-server config to shadow root", "config", configPath, "shadow", shadowConfig, "ignored-outputs", len(outputs))
+	return nil
+}
+
+// appendConfigList appends values to a list setting of a lua-language-server config, where the setting may be nested
+// or flat, under the "Lua" section or not. An unset setting is added starting from its defaults, in the settings
+// nested deepest along its key, e.g. "ignoreDir" in an existing "workspace" object.
+func appendConfigList(config map[string]interface{}, key string, defaults, values []interface{}) {
+	parent, field := findConfigSetting(config, key)
+	if parent == nil {
+		parent, field = config, key
+		if lua, ok := parent["Lua"].(map[string]interface{}); ok {
+			parent = lua
+		}
+		for {
+			head, tail, found := strings.Cut(field, ".")
+			child, ok := parent[head].(map[string]interface{})
+			if !found || !ok {
+				break
+			}
+			parent, field = child, tail
+		}
+	}
+
+	var list []interface{}
+	switch v := parent[field].(type) {
+	case []interface{}:
+		list = v
+	case string:
+		list = []interface{}{v}
+	default:
+		list = slices.Clone(defaults)
+	}
+	parent[field] = append(list, values...)
+}
+
+// findConfigSetting returns the settings holding a dotted setting and its key in them, or nil if it is unset
+func findConfigSetting(settings map[string]interface{}, key string) (map[string]interface{}, string) {
+	for _, k := range []string{key, "Lua." + key} {
+		if _, ok := settings[k]; ok {
+			return settings, k
+		}
+	}
+
+	for k, value := range settings {
+		child, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if k == "Lua" {
+			if parent, field := findConfigSetting(child, key); parent != nil {
+				return parent, field
+			}
+		}
+		if strings.HasPrefix(key, k+".") {
+			if parent, field := findConfigSetting(child, strings.TrimPrefix(key, k+".")); parent != nil {
+				return parent, field
+			}
+		}
+	}
+	return nil, ""
+}
+
+// rewriteConfigPaths makes the relative paths of lua-language-server settings absolute to root, returning the value
+//
+// Settings may be nested ({"workspace": {"library": []}}) or flat ("workspace.library"), under the "Lua" section or
+// not, and key is the setting v is the value of. Paths starting with a variable such as ${3rd}, or ~, are left alone.
+func rewriteConfigPaths(v interface{}, key string, root string) interface{} {
+	if slices.Contains(luaLSPathSettings, strings.TrimPrefix(key, "Lua.")) {
+		switch v := v.(type) {
+		case string:
+			return absConfigPath(v, root)
+		case []interface{}:
+			for i, path := range v {
+				if path, ok := path.(string); ok {
+					v[i] = absConfigPath(path, root)
+				}
+			}
+		}
+		return v
+	}
+
+	if settings, ok := v.(map[string]interface{}); ok {
+		for k, value := range settings {
+			child := k
+			if key != "" {
+				child = key + "." + k
+			}
+			settings[k] = rewriteConfigPaths(value, child, root)
+		}
+	}
+	return v
+}
+
+func absConfigPath(path, root string) string {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "$") || strings.HasPrefix(path, "~") {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+// stripJSONComments removes the comments and trailing commas from JSON with comments, which lua-language-server accepts
+func stripJSONComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out = append(out, c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := strings.Index(string(data[i+2:]), "*/")
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		case c == '}' || c == ']':
+			// Drop a trailing comma before the closing bracket
+			j := len(out) - 1
+			for j >= 0 && strings.ContainsRune(" \t\r\n", rune(out[j])) {
+				j--
+			}
+			if j >= 0 && out[j] == ',' {
+				out = append(out[:j], out[j+1:]...)
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// workspaceConfiguration answers a workspace/configuration request from lua-language-server with the editor's settings
+//
+// Clients that support the request are asked, with the shadow URIs of the items mapped to their documents. Otherwise,
+// the settings last sent with workspace/didChangeConfiguration are used. Either way, relative paths are made absolute
+// to the client's workspace, as lua-language-server resolves them against the shadow root.
+func (s *Server) workspaceConfiguration(ctx context.Context, req *jsonrpc2.Request) (interface{}, error) {
+	var params ConfigurationParams
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		return nil, err
+	}
+
+	results := make([]interface{}, len(params.Items))
+	if c := s.primaryClient(); c != nil && c.configuration {
+		conn := c.conn
+		items := make([]ConfigurationItem, len(params.Items))
+		for i, item := range params.Items {
+			items[i] = item
+			if uri, ok := s.clientURI(item.ScopeURI); ok {
+				items[i].ScopeURI = uri
+			}
+		}
+		if err := conn.Call(ctx, req.Method, ConfigurationParams{Items: items}, &results); err != nil {
+			return nil, err
+		}
+		if len(results) != len(params.Items) {
+			return nil, fmt.Errorf("client returned %d settings for %d items", len(results), len(params.Items))
+		}
+	} else {
+		s.settingsMu.Lock()
+		for i, item := range params.Items {
+			results[i] = copySettings(lookupSetting(s.settings, item.Section))
+		}
+		s.settingsMu.Unlock()
+	}
+
+	for i, item := range params.Items {
+		results[i] = rewriteConfigPaths(results[i], item.Section, s.workspaceRoot)
+	}
+	return results, nil
+}
+
+// didChangeConfiguration keeps the settings sent by the client, to answer workspace/configuration requests with,
+// returning them with relative paths made absolute to forward to lua-language-server
+func (s *Server) didChangeConfiguration(params lsp.DidChangeConfigurationParams) lsp.DidChangeConfigurationParams {
+	settings, _ := copySettings(params.Settings).(map[string]interface{})
+
+	s.settingsMu.Lock()
+	s.settings = settings
+	s.settingsMu.Unlock()
+
+	params.Settings = rewriteConfigPaths(copySettings(params.Settings), "", s.workspaceRoot)
+	return params
+}
+
+// copySettings returns a deep copy of JSON settings, as decoded into interface{}
+func copySettings(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var settings interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil
+	}
+	return settings
+}
+
+// lookupSetting returns the value of a dotted section in settings, which may be nested or flat, or nil if unset
+func lookupSetting(settings map[string]interface{}, section string) interface{} {
+	if section == "" {
+		return settings
+	}
+	if value, ok := settings[section]; ok {
+		return value
+	}
+
+	for key, value := range settings {
+		if child, ok := value.(map[string]interface{}); ok && strings.HasPrefix(section, key+".") {
+			if found := lookupSetting(child, strings.TrimPrefix(section, key+".")); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
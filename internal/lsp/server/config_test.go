@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteConfigPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		setting string
+		want    string
+	}{
+		{
+			name:    "test nested settings",
+			setting: `{"workspace": {"library": ["types", "/usr/share/lua"], "checkThirdParty": false}}`,
+			want:    `{"workspace": {"library": ["/project/types", "/usr/share/lua"], "checkThirdParty": false}}`,
+		},
+		{
+			name:    "test flat settings",
+			setting: `{"workspace.library": ["types"], "runtime.plugin": "plugin.lua", "runtime.version": "LuaJIT"}`,
+			want:    `{"workspace.library": ["/project/types"], "runtime.plugin": "/project/plugin.lua", "runtime.version": "LuaJIT"}`,
+		},
+		{
+			name:    "test settings under the Lua section",
+			setting: `{"Lua": {"workspace": {"userThirdParty": ["3rd"]}}}`,
+			want:    `{"Lua": {"workspace": {"userThirdParty": ["/project/3rd"]}}}`,
+		},
+		{
+			name:    "test value of a section",
+			key:     "Lua.workspace",
+			setting: `{"library": ["types"]}`,
+			want:    `{"library": ["/project/types"]}`,
+		},
+		{
+			name:    "test variables and home paths are kept",
+			setting: `{"workspace": {"library": ["${3rd}/luv/library", "~/lua"]}}`,
+			want:    `{"workspace": {"library": ["${3rd}/luv/library", "~/lua"]}}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var setting interface{}
+			require.NoError(t, json.Unmarshal([]byte(tc.setting), &setting))
+
+			got, err := json.Marshal(rewriteConfigPaths(setting, tc.key, "/project"))
+			require.NoError(t, err)
+			require.JSONEq(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "test line comments",
+			input: "{\n  // the runtime\n  \"runtime.version\": \"LuaJIT\" // trailing\n}",
+			want:  `{"runtime.version": "LuaJIT"}`,
+		},
+		{
+			name:  "test block comments",
+			input: `{/* the runtime */ "runtime.version": /* inline */ "LuaJIT"}`,
+			want:  `{"runtime.version": "LuaJIT"}`,
+		},
+		{
+			name:  "test trailing commas",
+			input: "{\"workspace.library\": [\"a\", \"b\",\n],\n}",
+			want:  `{"workspace.library": ["a", "b"]}`,
+		},
+		{
+			name:  "test comments within strings are kept",
+			input: `{"url": "https://example.com/*", "quote": "\"//\""}`,
+			want:  `{"url": "https://example.com/*", "quote": "\"//\""}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.JSONEq(t, tc.want, string(stripJSONComments([]byte(tc.input))))
+		})
+	}
+}
+
+func TestSyncWorkspaceConfig(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	shadowConfig := filepath.Join(s.docService.ShadowRoot(), ".luarc.json")
+
+	s.workspaceRoot = t.TempDir()
+	config := "{\n  // Neovim\n  \"runtime.version\": \"LuaJIT\",\n  \"workspace\": {\"library\": [\"types\"]},\n}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(s.workspaceRoot, ".luarc.jsonc"), []byte(config), 0644))
+
+	require.NoError(t, s.syncWorkspaceConfig())
+	got, err := os.ReadFile(shadowConfig)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"runtime.version": "LuaJIT", "workspace": {"library": ["`+filepath.Join(s.workspaceRoot, "types")+`"]}}`, string(got))
+
+	t.Run("test compiled outputs are ignored", func(t *testing.T) {
+		// The output of plugins is named by force, the output of init is at the path of its shadow document
+		write := func(rel, content string) {
+			path := filepath.Join(s.workspaceRoot, rel)
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		}
+		write("lua/plugins.litlua.md", "<!-- @pragma output: plugins.lua -->\n<!-- @pragma force: true -->\n\n```lua\nreturn {}\n```\n")
+		write("init.litlua.md", "<!-- @pragma output: init.lua -->\n\n```lua\nrequire('plugins')\n```\n")
+
+		require.NoError(t, s.syncWorkspaceConfig())
+		got, err := os.ReadFile(shadowConfig)
+		require.NoError(t, err)
+		require.JSONEq(t, `{
+			"runtime.version": "LuaJIT",
+			"runtime.path": ["?.lua", "?/init.lua", "?.litlua.lua", "?/init.litlua.lua"],
+			"workspace": {
+				"library": ["`+filepath.Join(s.workspaceRoot, "types")+`"],
+				"ignoreDir": ["`+filepath.Join(s.workspaceRoot, "lua", "plugins.lua")+`"]
+			}
+		}`, string(got))
+	})
+
+	// A workspace without a config doesn't keep the config of the last one
+	s.workspaceRoot = t.TempDir()
+	require.NoError(t, s.syncWorkspaceConfig())
+	require.NoFileExists(t, shadowConfig)
+}
+
+func TestAppendConfigList(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "test unset setting starts from its defaults",
+			config: `{}`,
+			want:   `{"runtime.path": ["?.lua", "b"]}`,
+		},
+		{
+			name:   "test flat setting",
+			config: `{"runtime.path": ["a"]}`,
+			want:   `{"runtime.path": ["a", "b"]}`,
+		},
+		{
+			name:   "test nested setting under the Lua section",
+			config: `{"Lua": {"runtime": {"path": ["a"]}}}`,
+			want:   `{"Lua": {"runtime": {"path": ["a", "b"]}}}`,
+		},
+		{
+			name:   "test unset setting is added to its nested settings",
+			config: `{"Lua": {"runtime": {"version": "LuaJIT"}}}`,
+			want:   `{"Lua": {"runtime": {"version": "LuaJIT", "path": ["?.lua", "b"]}}}`,
+		},
+		{
+			name:   "test string setting",
+			config: `{"Lua.runtime.path": "a"}`,
+			want:   `{"Lua.runtime.path": ["a", "b"]}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var config map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tc.config), &config))
+
+			appendConfigList(config, "runtime.path", []interface{}{"?.lua"}, []interface{}{"b"})
+
+			got, err := json.Marshal(config)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestWorkspaceConfigurationFromSettings(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	// The client doesn't support workspace/configuration, so the settings it sends are used
+	workspace := t.TempDir()
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + workspace)}, &initResult))
+	require.False(t, s.primaryClient().configuration)
+
+	require.NoError(t, client.Notify(ctx, "workspace/didChangeConfiguration", lsp.DidChangeConfigurationParams{
+		Settings: map[string]interface{}{
+			"Lua": map[string]interface{}{
+				"diagnostics": map[string]interface{}{"globals": []string{"vim"}},
+				"workspace":   map[string]interface{}{"library": []string{"types"}},
+			},
+		},
+	}))
+	require.Eventually(t, func() bool {
+		s.settingsMu.Lock()
+		defer s.settingsMu.Unlock()
+		return s.settings != nil
+	}, time.Second, 10*time.Millisecond)
+
+	var result []interface{}
+	err := fake.conn.Call(ctx, "workspace/configuration", ConfigurationParams{Items: []ConfigurationItem{
+		{Section: "Lua"},
+		{Section: "Lua.diagnostics"},
+		{Section: "files.associations"},
+	}}, &result)
+	require.NoError(t, err)
+
+	got, err := json.Marshal(result)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"diagnostics": {"globals": ["vim"]}, "workspace": {"library": ["`+filepath.Join(workspace, "types")+`"]}},
+		{"globals": ["vim"]},
+		null
+	]`, string(got))
+
+	// The settings kept are left as the client sent them
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	require.Equal(t, []interface{}{"types"}, s.settings["Lua"].(map[string]interface{})["workspace"].(map[string]interface{})["library"])
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// codeServerNotInitialized is the LSP error code for a request sent before initialize
+const codeServerNotInitialized = -32002
+
+// Daemon serves the clients connecting to a listener, sharing a server, and so a lua-language-server, between the
+// clients of the same workspace root
+//
+// Each workspace has its own shadow root under the shadow root of the options, as lua-language-server sees the
+// shadow root as its workspace. A workspace is shut down once its last client disconnects.
+type Daemon struct {
+	opts Options
+	// Creates and starts the server of a workspace
+	newServer func(shadowRoot string) (*Server, error)
+
+	mu         sync.Mutex
+	workspaces map[string]*sharedWorkspace
+}
+
+// sharedWorkspace is the server of a workspace root, and the number of clients connected to it
+type sharedWorkspace struct {
+	server  *Server
+	clients int
+}
+
+func NewDaemon(opts Options) (*Daemon, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid server options: %w", err)
+	}
+
+	d := &Daemon{opts: opts, workspaces: make(map[string]*sharedWorkspace)}
+	d.newServer = func(shadowRoot string) (*Server, error) {
+		opts := d.opts
+		opts.ShadowRoot = shadowRoot
+
+		s, err := NewServer(opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Start(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return d, nil
+}
+
+// Serve accepts clients until the listener is closed
+func (d *Daemon) Serve(ctx context.Context, l net.Listener) error {
+	slog.Info("listening for clients", "address", l.Addr())
+	for {
+		nc, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept client: %w", err)
+		}
+
+		go d.serveConn(ctx, nc)
+	}
+}
+
+// serveConn serves a client until it disconnects, attaching it to the server of its workspace on initialize
+func (d *Daemon) serveConn(ctx context.Context, nc net.Conn) {
+	slog.Info("client connected", "remote", nc.RemoteAddr())
+
+	var root string
+	var server *Server
+	conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(nc, jsonrpc2.VSCodeObjectCodec{}), &attachHandler{
+		attach: func(conn *jsonrpc2.Conn, req *jsonrpc2.Request) (jsonrpc2.Handler, error) {
+			if req.Method != "initialize" {
+				return nil, &jsonrpc2.Error{Code: codeServerNotInitialized, Message: fmt.Sprintf("%s before initialize", req.Method)}
+			}
+
+			var params lsp.InitializeParams
+			if err := json.Unmarshal(*req.Params, &params); err != nil {
+				return nil, err
+			}
+
+			s, err := d.join(workspaceRootOf(params))
+			if err != nil {
+				return nil, err
+			}
+			root, server = workspaceRootOf(params), s
+			return s.attach(conn), nil
+		},
+	})
+
+	<-conn.DisconnectNotify()
+	slog.Info("client disconnected", "remote", nc.RemoteAddr(), "root", root)
+
+	if server != nil {
+		d.leave(ctx, root, server, conn)
+	}
+}
+
+// join returns the server of a workspace root for a new client, starting it if the workspace has no clients
+func (d *Daemon) join(root string) (*Server, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if w, exists := d.workspaces[root]; exists {
+		w.clients++
+		return w.server, nil
+	}
+
+	base := d.opts.ShadowRoot
+	if base == "" {
+		base = iLsp.DefaultDocumentServiceOptions.ShadowRoot
+	}
+	shadowRoot, err := workspaceShadowRoot(base, root)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := d.newServer(shadowRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server for %s: %w", root, err)
+	}
+	s.shared = true
+	s.docService.SetWorkspaceShadowRoot(shadowRoot)
+
+	slog.Info("started workspace", "root", root, "shadow-root", shadowRoot)
+	d.workspaces[root] = &sharedWorkspace{server: s, clients: 1}
+	return s, nil
+}
+
+// leave detaches a disconnected client from the server of its workspace, shutting the server down if it was the
+// last client
+func (d *Daemon) leave(ctx context.Context, root string, server *Server, conn *jsonrpc2.Conn) {
+	server.detach(ctx, conn)
+
+	d.mu.Lock()
+	w, exists := d.workspaces[root]
+	last := exists && w.server == server && w.clients == 1
+	if last {
+		delete(d.workspaces, root)
+	} else if exists && w.server == server {
+		w.clients--
+	}
+	d.mu.Unlock()
+
+	if last {
+		slog.Info("shutting down workspace without clients", "root", root)
+		server.shutdown()
+	}
+}
+
+// Close shuts down the server of every workspace
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	workspaces := d.workspaces
+	d.workspaces = make(map[string]*sharedWorkspace)
+	d.mu.Unlock()
+
+	for root, w := range workspaces {
+		slog.Info("shutting down workspace", "root", root)
+		w.server.shutdown()
+	}
+}
+
+// workspaceShadowRoot creates the shadow root of a workspace root under a base shadow root, so lua-language-servers
+// of different workspaces never share a workspace
+func workspaceShadowRoot(base, root string) (string, error) {
+	shadowRoot := filepath.Join(base, workspaceKey(root))
+	if err := os.MkdirAll(shadowRoot, 0755); err != nil {
+		return "", fmt.Errorf("failed to create shadow root: %w", err)
+	}
+	return shadowRoot, nil
+}
+
+// workspaceKey returns the name of the shadow root of a workspace root
+func workspaceKey(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDaemon returns a daemon listening on a unix socket, starting a fake lua-language-server for each workspace,
+// and a func to connect a client to it
+func newTestDaemon(t *testing.T) (*Daemon, func(shadowRoot string) *fakeLuaLS, func() *jsonrpc2.Conn) {
+	t.Helper()
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	fakes := make(map[string]*fakeLuaLS)
+
+	d := &Daemon{opts: Options{ShadowRoot: t.TempDir()}, workspaces: make(map[string]*sharedWorkspace)}
+	d.newServer = func(shadowRoot string) (*Server, error) {
+		s, fake := newFakeLuaLSServer(t, shadowRoot)
+		mu.Lock()
+		fakes[shadowRoot] = fake
+		mu.Unlock()
+		return s, nil
+	}
+
+	socket := filepath.Join(t.TempDir(), "litlua.sock")
+	l, err := Listen("unix://" + socket)
+	require.NoError(t, err)
+	go d.Serve(ctx, l)
+	t.Cleanup(func() {
+		l.Close()
+		d.Close()
+	})
+
+	fakeOf := func(shadowRoot string) *fakeLuaLS {
+		mu.Lock()
+		defer mu.Unlock()
+		return fakes[shadowRoot]
+	}
+
+	connect := func() *jsonrpc2.Conn {
+		nc, err := net.Dial("unix", socket)
+		require.NoError(t, err)
+		// The client ignores the notifications from the server, such as diagnostics
+		conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(nc, jsonrpc2.VSCodeObjectCodec{}),
+			jsonrpc2.HandlerWithError(func(context.Context, *jsonrpc2.Conn, *jsonrpc2.Request) (interface{}, error) {
+				return nil, nil
+			}))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	return d, fakeOf, connect
+}
+
+// workspace returns a copy of the workspace of a root, as its clients change under the lock
+func (d *Daemon) workspace(root string) (sharedWorkspace, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w, exists := d.workspaces[root]
+	if !exists {
+		return sharedWorkspace{}, false
+	}
+	return *w, true
+}
+
+func TestDaemon(t *testing.T) {
+	d, fakeOf, connect := newTestDaemon(t)
+	ctx := context.Background()
+
+	initialize := func(client *jsonrpc2.Conn, root string) {
+		var result map[string]interface{}
+		require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + root)}, &result))
+		require.NoError(t, client.Notify(ctx, "initialized", struct{}{}))
+	}
+
+	t.Run("test requests before initialize are refused", func(t *testing.T) {
+		client := connect()
+		var result interface{}
+		err := client.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{}, &result)
+
+		var rpcErr *jsonrpc2.Error
+		require.True(t, errors.As(err, &rpcErr))
+		require.Equal(t, int64(codeServerNotInitialized), rpcErr.Code)
+	})
+
+	workspace := t.TempDir()
+	first, second := connect(), connect()
+	initialize(first, workspace)
+	initialize(second, workspace)
+
+	w, exists := d.workspace(workspace)
+	require.True(t, exists)
+	require.Equal(t, 2, w.clients)
+	fake := fakeOf(w.server.docService.ShadowRoot())
+	fake.mu.Lock()
+	require.Equal(t, 1, fake.initializes)
+	fake.mu.Unlock()
+
+	t.Run("test other workspaces get their own server", func(t *testing.T) {
+		other := connect()
+		initialize(other, t.TempDir())
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		require.Len(t, d.workspaces, 2)
+	})
+
+	// Both clients open the same document
+	uri := lsp.DocumentURI("file://" + filepath.Join(workspace, "init.litlua.md"))
+	for _, client := range []*jsonrpc2.Conn{first, second} {
+		require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+			TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "# Config\n\n```lua\nlocal x = 1\n```\n"},
+		}))
+	}
+
+	var shadowURI string
+	require.Eventually(t, func() bool {
+		shadowURI, exists = w.server.docService.ShadowURI(string(uri))
+		return exists && fake.text(shadowURI) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	t.Run("test a document stays open until every client closes it", func(t *testing.T) {
+		require.NoError(t, first.Notify(ctx, "textDocument/didClose", lsp.DidCloseTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		}))
+		require.Eventually(t, func() bool {
+			w.server.clientsMu.Lock()
+			defer w.server.clientsMu.Unlock()
+			return !w.server.clients[0].documents[string(uri)]
+		}, time.Second, 10*time.Millisecond)
+
+		var hover lsp.Hover
+		require.NoError(t, second.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+			Position:     lsp.Position{Line: 3},
+		}, &hover))
+		require.Equal(t, "local x = 1", hover.Contents[0].Value)
+		require.NotEmpty(t, fake.text(shadowURI))
+	})
+
+	t.Run("test the workspace is shut down once its last client disconnects", func(t *testing.T) {
+		first.Close()
+		require.Eventually(t, func() bool {
+			w, exists := d.workspace(workspace)
+			return exists && w.clients == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// The document is closed for the client that didn't close it
+		second.Close()
+		require.Eventually(t, func() bool {
+			_, exists := d.workspace(workspace)
+			return !exists && fake.text(shadowURI) == ""
+		}, time.Second, 10*time.Millisecond)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		require.Empty(t, fake.errs)
+	})
+}
+
+func TestWorkspaceShadowRoot(t *testing.T) {
+	ctx := context.Background()
+
+	// Servers of a client each, as in stdio mode, started with the same shadow root
+	base := t.TempDir()
+	initialize := func(workspace string) *Server {
+		s, _ := newFakeLuaLSServer(t, base)
+		clientSide, serverSide := net.Pipe()
+		jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(serverSide, jsonrpc2.VSCodeObjectCodec{}), s.Handler())
+		client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientSide, jsonrpc2.VSCodeObjectCodec{}),
+			jsonrpc2.HandlerWithError(func(context.Context, *jsonrpc2.Conn, *jsonrpc2.Request) (interface{}, error) {
+				return nil, nil
+			}))
+		t.Cleanup(func() { client.Close() })
+
+		var result map[string]interface{}
+		require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + workspace)}, &result))
+		return s
+	}
+
+	first, second := t.TempDir(), t.TempDir()
+	firstServer, secondServer := initialize(first), initialize(second)
+
+	require.Equal(t, filepath.Join(base, workspaceKey(first)), firstServer.docService.ShadowRoot())
+	require.Equal(t, filepath.Join(base, workspaceKey(second)), secondServer.docService.ShadowRoot())
+	require.DirExists(t, firstServer.docService.ShadowRoot())
+	require.NotEqual(t, firstServer.docService.ShadowRoot(), secondServer.docService.ShadowRoot())
+}
+
+func TestDaemonSharedDocument(t *testing.T) {
+	d, fakeOf, connect := newTestDaemon(t)
+	ctx := context.Background()
+
+	workspace := t.TempDir()
+	first, second := connect(), connect()
+	for _, client := range []*jsonrpc2.Conn{first, second} {
+		var result map[string]interface{}
+		require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + workspace)}, &result))
+	}
+	w, exists := d.workspace(workspace)
+	require.True(t, exists)
+	fake := fakeOf(w.server.docService.ShadowRoot())
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(workspace, "init.litlua.md"))
+	open := func(client *jsonrpc2.Conn) {
+		require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+			TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "# Config\n\n```lua\nlocal x = 1\n```\n"},
+		}))
+	}
+	change := func(client *jsonrpc2.Conn, version int, value string) {
+		require.NoError(t, client.Notify(ctx, "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+			TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: version},
+			ContentChanges: []lsp.TextDocumentContentChangeEvent{{
+				Range: &lsp.Range{Start: lsp.Position{Line: 3, Character: 10}, End: lsp.Position{Line: 3, Character: 11}},
+				Text:  value,
+			}},
+		}))
+	}
+	// A request is handled after the notifications sent before it, and answers with the text of the writer
+	hover := func(client *jsonrpc2.Conn) string {
+		var hover lsp.Hover
+		require.NoError(t, client.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+			Position:     lsp.Position{Line: 3},
+		}, &hover))
+		return hover.Contents[0].Value
+	}
+
+	open(first)
+	var shadowURI string
+	require.Eventually(t, func() bool {
+		shadowURI, exists = w.server.docService.ShadowURI(string(uri))
+		return exists && fake.text(shadowURI) != ""
+	}, time.Second, 10*time.Millisecond)
+	open(second)
+
+	t.Run("test changes from a client that isn't writing the document are ignored", func(t *testing.T) {
+		change(second, 2, "2")
+		require.Equal(t, "local x = 1", hover(second))
+
+		// The change is kept with the text of the client, for when the document is handed over to it
+		w.server.clientsMu.Lock()
+		text := w.server.clients[1].readOnly[string(uri)].text
+		w.server.clientsMu.Unlock()
+		require.Equal(t, "# Config\n\n```lua\nlocal x = 2\n```\n", text)
+
+		change(first, 2, "3")
+		require.Eventually(t, func() bool {
+			return strings.Contains(fake.text(shadowURI), "local x = 3")
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("test the document is handed over with the text of the next client", func(t *testing.T) {
+		require.NoError(t, first.Notify(ctx, "textDocument/didClose", lsp.DidCloseTextDocumentParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		}))
+		require.Eventually(t, func() bool {
+			return strings.Contains(fake.text(shadowURI), "local x = 2")
+		}, time.Second, 10*time.Millisecond)
+
+		change(second, 3, "4")
+		require.Eventually(t, func() bool {
+			return strings.Contains(fake.text(shadowURI), "local x = 4")
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, "local x = 4", hover(second))
+	})
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	require.Empty(t, fake.errs)
+}
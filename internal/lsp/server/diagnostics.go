@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jwtly10/litlua"
+	"github.com/jwtly10/litlua/internal/transformer"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// diagnosticStore tracks the latest diagnostics for each document URI, per source.
+//
+// The editor replaces all diagnostics for a URI on every publish, so we need to keep
+// the latest set from each source to be able to publish them merged.
+type diagnosticStore struct {
+	mu sync.Mutex
+	// diagnostics forwarded from lua-language-server, keyed by original URI
+	luals map[string][]lsp.Diagnostic
+	// diagnostics generated by litlua for the current text of a document, keyed by original URI
+	litlua map[string][]lsp.Diagnostic
+	// diagnostics from the last compilation of a document on save, keyed by original URI
+	compile map[string][]lsp.Diagnostic
+}
+
+func newDiagnosticStore() *diagnosticStore {
+	return &diagnosticStore{
+		luals:   make(map[string][]lsp.Diagnostic),
+		litlua:  make(map[string][]lsp.Diagnostic),
+		compile: make(map[string][]lsp.Diagnostic),
+	}
+}
+
+// setLuaLS stores the lua-language-server diagnostics for a URI and returns the merged set
+func (d *diagnosticStore) setLuaLS(uri string, diags []lsp.Diagnostic) []lsp.Diagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.luals[uri] = diags
+	return d.merged(uri)
+}
+
+// setLitLua stores the litlua diagnostics for a URI and returns the merged set
+func (d *diagnosticStore) setLitLua(uri string, diags []lsp.Diagnostic) []lsp.Diagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.litlua[uri] = diags
+	return d.merged(uri)
+}
+
+// setCompile stores the compile diagnostics for a URI and returns the merged set
+func (d *diagnosticStore) setCompile(uri string, diags []lsp.Diagnostic) []lsp.Diagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.compile[uri] = diags
+	return d.merged(uri)
+}
+
+// remove forgets all diagnostics for a URI
+func (d *diagnosticStore) remove(uri string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.luals, uri)
+	delete(d.litlua, uri)
+	delete(d.compile, uri)
+}
+
+func (d *diagnosticStore) merged(uri string) []lsp.Diagnostic {
+	merged := make([]lsp.Diagnostic, 0, len(d.luals[uri])+len(d.litlua[uri])+len(d.compile[uri]))
+	merged = append(merged, d.litlua[uri]...)
+	merged = append(merged, d.compile[uri]...)
+	merged = append(merged, d.luals[uri]...)
+	return merged
+}
+
+// publishDocumentDiagnostics validates the pragmas of a document, and publishes any problems found along with
+// any error from transforming the document to its shadow file
+func (s *Server) publishDocumentDiagnostics(ctx context.Context, uri lsp.DocumentURI, text string, transformErr error) error {
+	lines := strings.Split(text, "\n")
+
+	var diags []lsp.Diagnostic
+	for _, d := range s.docService.PragmaDiagnostics(text, uri) {
+		diags = append(diags, pragmaToLspDiagnostic(d, lines))
+	}
+	diags = append(diags, transformErrorDiagnostics(transformErr, lines)...)
+
+	return s.publishDiagnostics(ctx, uri, s.diagnostics.setLitLua(string(uri), diags))
+}
+
+// publishCompileDiagnostics publishes the error from compiling a document on save, or clears
+// the previous compile error if compileErr is nil
+func (s *Server) publishCompileDiagnostics(ctx context.Context, uri lsp.DocumentURI, text string, compileErr error) error {
+	var diags []lsp.Diagnostic
+	// A missing output pragma is already reported for the current text
+	if !errors.Is(compileErr, transformer.ErrOutputPragmaRequired) {
+		diags = transformErrorDiagnostics(compileErr, strings.Split(text, "\n"))
+	}
+
+	return s.publishDiagnostics(ctx, uri, s.diagnostics.setCompile(string(uri), diags))
+}
+
+// transformErrorDiagnostics converts an error from transforming a document to diagnostics, on the lines
+// of the problem when they are known or the first line otherwise
+//
+// Pragma errors are skipped, as they are reported by [DocumentService.PragmaDiagnostics], and so are documents
+// without code blocks, which are valid to edit.
+func transformErrorDiagnostics(err error, lines []string) []lsp.Diagnostic {
+	if err == nil {
+		return nil
+	}
+
+	var pragmaErr *litlua.PragmaError
+	if errors.As(err, &pragmaErr) || errors.Is(err, litlua.ErrNoCodeBlocks) {
+		return nil
+	}
+
+	var overlapErr *litlua.OverlappingCodeError
+	if errors.As(err, &overlapErr) {
+		return []lsp.Diagnostic{lineDiagnostic(overlapErr.Line-1, lines, lsp.Error,
+			"code blocks overlap on this line, lua code can not be mapped to it")}
+	}
+
+	var syntaxErr *litlua.LuaSyntaxError
+	if errors.As(err, &syntaxErr) {
+		message := "lua syntax error: " + syntaxErr.Message
+		if syntaxErr.Token != "" {
+			message = fmt.Sprintf("lua syntax error near '%s': %s", syntaxErr.Token, syntaxErr.Message)
+		}
+		return []lsp.Diagnostic{lineDiagnostic(syntaxErr.Line-1, lines, lsp.Error, message)}
+	}
+
+	var varErr *litlua.VariableError
+	if errors.As(err, &varErr) {
+		var diags []lsp.Diagnostic
+		for _, u := range varErr.Undefined {
+			diags = append(diags, lineDiagnostic(u.Line-1, lines, lsp.Error, fmt.Sprintf("undefined variable '%s'", u.Name)))
+		}
+		return diags
+	}
+
+	return []lsp.Diagnostic{lineDiagnostic(0, lines, lsp.Error, err.Error())}
+}
+
+// lineDiagnostic returns a diagnostic spanning a whole line, with the 0-indexed line clamped to the document
+func lineDiagnostic(line int, lines []string, severity lsp.DiagnosticSeverity, message string) lsp.Diagnostic {
+	line = max(0, min(line, len(lines)-1))
+	var lineLen int
+	if line < len(lines) {
+		lineLen = len(strings.TrimRight(lines[line], "\r"))
+	}
+
+	return lsp.Diagnostic{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: line, Character: 0},
+			End:   lsp.Position{Line: line, Character: lineLen},
+		},
+		Severity: severity,
+		Source:   "litlua",
+		Message:  message,
+	}
+}
+
+// pragmaToLspDiagnostic converts a pragma diagnostic to an LSP diagnostic spanning the pragma line
+func pragmaToLspDiagnostic(d litlua.PragmaDiagnostic, lines []string) lsp.Diagnostic {
+	severity := lsp.DiagnosticSeverity(lsp.Warning)
+	if d.Severity == litlua.SeverityError {
+		severity = lsp.Error
+	}
+
+	message := d.Message
+	if d.Suggestion != "" {
+		message += ". Did you mean '" + d.Suggestion + "'?"
+	}
+
+	// LSP lines are 0-indexed
+	return lineDiagnostic(d.Line-1, lines, severity, message)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnosticStoreMergesSources(t *testing.T) {
+	store := newDiagnosticStore()
+	uri := "file:///test.litlua.md"
+
+	litluaDiag := lsp.Diagnostic{Message: "unknown pragma key 'ouptut'", Source: "litlua"}
+	luaDiag := lsp.Diagnostic{Message: "Undefined global `b`.", Source: "Lua Diagnostics."}
+
+	merged := store.setLitLua(uri, []lsp.Diagnostic{litluaDiag})
+	require.Equal(t, []lsp.Diagnostic{litluaDiag}, merged)
+
+	// publishing lua-ls diagnostics should not drop litlua diagnostics
+	merged = store.setLuaLS(uri, []lsp.Diagnostic{luaDiag})
+	require.Equal(t, []lsp.Diagnostic{litluaDiag, luaDiag}, merged)
+
+	// and clearing litlua diagnostics should keep the lua-ls diagnostics
+	merged = store.setLitLua(uri, nil)
+	require.Equal(t, []lsp.Diagnostic{luaDiag}, merged)
+
+	// compile diagnostics are kept separately from the diagnostics of the current text
+	compileDiag := lsp.Diagnostic{Message: "lua syntax error: unexpected symbol", Source: "litlua"}
+	merged = store.setCompile(uri, []lsp.Diagnostic{compileDiag})
+	require.Equal(t, []lsp.Diagnostic{compileDiag, luaDiag}, merged)
+
+	merged = store.setLitLua(uri, []lsp.Diagnostic{litluaDiag})
+	require.Equal(t, []lsp.Diagnostic{litluaDiag, compileDiag, luaDiag}, merged)
+}
+
+func TestPragmaToLspDiagnostic(t *testing.T) {
+	lines := []string{
+		"<!-- @pragma output: init.lua -->",
+		"<!-- @pragma ouptut: init.lua -->",
+	}
+
+	got := pragmaToLspDiagnostic(litlua.PragmaDiagnostic{
+		Severity:   litlua.SeverityWarning,
+		Key:        "ouptut",
+		Value:      "init.lua",
+		Line:       2,
+		Message:    "unknown pragma key 'ouptut'",
+		Suggestion: "output",
+	}, lines)
+
+	require.Equal(t, lsp.Diagnostic{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: 1, Character: 0},
+			End:   lsp.Position{Line: 1, Character: len(lines[1])},
+		},
+		Severity: lsp.Warning,
+		Source:   "litlua",
+		Message:  "unknown pragma key 'ouptut'. Did you mean 'output'?",
+	}, got)
+}
+
+func TestTransformErrorDiagnostics(t *testing.T) {
+	lines := []string{
+		"# Config",
+		"```lua",
+		"local x = ${missing}",
+		"```",
+	}
+
+	lineDiag := func(line int, message string) lsp.Diagnostic {
+		return lsp.Diagnostic{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: line, Character: 0},
+				End:   lsp.Position{Line: line, Character: len(lines[line])},
+			},
+			Severity: lsp.Error,
+			Source:   "litlua",
+			Message:  message,
+		}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want []lsp.Diagnostic
+	}{
+		{
+			name: "test no error",
+			err:  nil,
+		},
+		{
+			name: "test overlapping code is reported on its line",
+			err:  fmt.Errorf("transform error: %w", &litlua.OverlappingCodeError{Line: 3}),
+			want: []lsp.Diagnostic{lineDiag(2, "code blocks overlap on this line, lua code can not be mapped to it")},
+		},
+		{
+			name: "test syntax error is reported on its line",
+			err:  fmt.Errorf("syntax error: %w", &litlua.LuaSyntaxError{Line: 3, Token: "=", Message: "unexpected symbol"}),
+			want: []lsp.Diagnostic{lineDiag(2, "lua syntax error near '=': unexpected symbol")},
+		},
+		{
+			name: "test undefined variables are reported on their lines",
+			err:  fmt.Errorf("substitution error: %w", &litlua.VariableError{Undefined: []litlua.UndefinedVariable{{Name: "missing", Line: 3, Column: 11}}}),
+			want: []lsp.Diagnostic{lineDiag(2, "undefined variable 'missing'")},
+		},
+		{
+			name: "test pragma errors are skipped",
+			err:  fmt.Errorf("parse error: %w", &litlua.PragmaError{}),
+		},
+		{
+			name: "test documents without code blocks are skipped",
+			err:  fmt.Errorf("parse error: %w", litlua.ErrNoCodeBlocks),
+		},
+		{
+			name: "test other errors are reported on the first line",
+			err:  errors.New("failed to create output file"),
+			want: []lsp.Diagnostic{lineDiag(0, "failed to create output file")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, transformErrorDiagnostics(tc.err, lines))
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jwtly10/litlua"
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// formatRangeFunc formats the code lines [start, end) (0-indexed) of a shadow file, returning the whole formatted file
+type formatRangeFunc func(ctx context.Context, shadowURI, shadowText string, start, end int, opts lsp.FormattingOptions) (string, error)
+
+// formatDocument formats the Lua code blocks of a document, returning an edit for each block that changed
+//
+// If a range is given, only blocks overlapping it are formatted. Each block is formatted through the shadow file,
+// so formatting has the context of the other blocks, and the result is only used if the lines outside the block are
+// unchanged. Prose and fences are never edited, and neither are blocks with variable placeholders, as the shadow
+// file has them masked.
+//
+// Changes waiting to be synced are synced first, and no edits are returned if the document changes while it is
+// formatted, as they would apply to an older version.
+func (s *Server) formatDocument(ctx context.Context, uri lsp.DocumentURI, rng *lsp.Range, opts lsp.FormattingOptions) ([]lsp.TextEdit, error) {
+	// The shadow file is formatted, so it must have every change made to the document
+	shadow, synced := s.syncedShadow(uri)
+	if !synced {
+		slog.Debug("skipping formatting of document not synced to lua-ls", "uri", uri)
+		return []lsp.TextEdit{}, nil
+	}
+	text, shadowURI, shadowText := shadow.Source, shadow.URI, shadow.Text
+
+	doc, err := s.docService.ParseDocument(text, string(uri))
+	if err != nil {
+		return nil, err
+	}
+	blocks := append(slices.Clone(doc.Blocks), doc.TestBlocks...)
+	slices.SortFunc(blocks, func(a, b litlua.CodeBlock) int {
+		return a.Position.StartLine - b.Position.StartLine
+	})
+
+	var format formatRangeFunc = s.formatWithLuaLS
+	if s.styluaPath != "" {
+		format = s.formatWithStylua
+	}
+
+	lines := strings.Split(text, "\n")
+	indents := newBlockIndents(blocks, text)
+	edits := []lsp.TextEdit{}
+	for _, block := range blocks {
+		// Blocks are 1-indexed from the first line of code to the closing fence, LSP lines are 0-indexed
+		start, end := block.Position.StartLine-1, block.Position.EndLine-1
+		if start >= end || end > len(lines) {
+			continue
+		}
+		if rng != nil && (rng.End.Line < start || rng.Start.Line >= end) {
+			continue
+		}
+		if litlua.ContainsVariables(block.Code, doc.Pragmas.Expand) {
+			slog.Debug("skipping formatting of code block with variables", "uri", uri, "line", block.Position.StartLine)
+			continue
+		}
+
+		formatted, err := format(ctx, shadowURI, shadowText, start, end, opts)
+		if err != nil {
+			slog.Warn("failed to format code block", "uri", uri, "line", block.Position.StartLine, "error", err)
+			continue
+		}
+
+		code, ok := extractFormattedLines(shadowText, formatted, start, end)
+		if !ok {
+			slog.Warn("formatting changed code outside of the block, skipping", "uri", uri, "line", block.Position.StartLine)
+			continue
+		}
+
+		if edit, changed := blockFormatEdit(lines, start, end, indents[start], code); changed {
+			edits = append(edits, edit)
+		}
+	}
+
+	if s.shadowChanged(uri, shadow.Version) {
+		slog.Debug("dropping formatting of document changed while formatting", "uri", uri)
+		return []lsp.TextEdit{}, nil
+	}
+
+	return edits, nil
+}
+
+// formatWithLuaLS formats a range of the shadow file with lua-language-server range formatting
+func (s *Server) formatWithLuaLS(ctx context.Context, shadowURI, shadowText string, start, end int, opts lsp.FormattingOptions) (string, error) {
+	result, err := s.LuaLS.ForwardRequest(ctx, "textDocument/rangeFormatting", lsp.DocumentRangeFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(shadowURI)},
+		Range: lsp.Range{
+			Start: lsp.Position{Line: start},
+			End:   lsp.Position{Line: end},
+		},
+		Options: opts,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	var edits []lsp.TextEdit
+	if err := json.Unmarshal(resultBytes, &edits); err != nil {
+		return "", fmt.Errorf("unable to parse formatting response: %w", err)
+	}
+
+	return applyTextEdits(shadowText, edits)
+}
+
+// formatWithStylua formats a range of the shadow file with StyLua, using the StyLua config of the document
+func (s *Server) formatWithStylua(ctx context.Context, shadowURI, shadowText string, start, end int, _ lsp.FormattingOptions) (string, error) {
+	lines := strings.SplitAfter(shadowText, "\n")
+	rangeStart := len(strings.Join(lines[:min(start, len(lines))], ""))
+	rangeEnd := len(strings.Join(lines[:min(end, len(lines))], ""))
+
+	args := []string{
+		"--search-parent-directories",
+		"--range-start", strconv.Itoa(rangeStart),
+		"--range-end", strconv.Itoa(rangeEnd),
+		"-",
+	}
+
+	cmd := exec.CommandContext(ctx, s.styluaPath, args...)
+	cmd.Stdin = strings.NewReader(shadowText)
+	if originalURI, exists := s.getShadowToOriginalURI(shadowURI); exists {
+		// StyLua looks for its config from the working directory
+		if originalPath, err := s.docService.URIToPath(lsp.DocumentURI(originalURI)); err == nil {
+			cmd.Dir = filepath.Dir(originalPath)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("stylua failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// extractFormattedLines returns the formatted lines replacing lines [start, end) of the original text
+//
+// Returns false if the lines before or after the range were changed by formatting
+func extractFormattedLines(original, formatted string, start, end int) (string, bool) {
+	lines := strings.SplitAfter(original, "\n")
+	if end > len(lines) {
+		return "", false
+	}
+
+	prefix := strings.Join(lines[:start], "")
+	suffix := strings.Join(lines[end:], "")
+	if !strings.HasPrefix(formatted, prefix) || !strings.HasSuffix(formatted[len(prefix):], suffix) {
+		return "", false
+	}
+
+	code := formatted[len(prefix) : len(formatted)-len(suffix)]
+	if code != "" && suffix != "" && !strings.HasSuffix(code, "\n") {
+		// The lines after the block were merged into it
+		return "", false
+	}
+
+	return code, true
+}
+
+// blockFormatEdit returns an edit replacing the code lines [start, end) of the markdown with the formatted code,
+// indented by the indent of the fence of the block
+func blockFormatEdit(lines []string, start, end int, indent, code string) (lsp.TextEdit, bool) {
+	var newText strings.Builder
+	for _, line := range strings.SplitAfter(code, "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			newText.WriteString(indent)
+		}
+		newText.WriteString(line)
+	}
+	if code != "" && !strings.HasSuffix(code, "\n") {
+		newText.WriteString("\n")
+	}
+
+	current := strings.Join(lines[start:end], "\n") + "\n"
+	if newText.String() == current {
+		return lsp.TextEdit{}, false
+	}
+
+	return lsp.TextEdit{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: start},
+			End:   lsp.Position{Line: end},
+		},
+		NewText: newText.String(),
+	}, true
+}
+
+// applyTextEdits applies non-overlapping edits to text, where characters are counted in UTF-16 code units
+func applyTextEdits(text string, edits []lsp.TextEdit) (string, error) {
+	sorted := slices.Clone(edits)
+	slices.SortFunc(sorted, func(a, b lsp.TextEdit) int {
+		if a.Range.Start.Line != b.Range.Start.Line {
+			return b.Range.Start.Line - a.Range.Start.Line
+		}
+		return b.Range.Start.Character - a.Range.Start.Character
+	})
+
+	// Apply from the end of the text, so earlier offsets stay valid
+	for _, edit := range sorted {
+		start, err := iLsp.PositionOffset(text, edit.Range.Start)
+		if err != nil {
+			return "", err
+		}
+		end, err := iLsp.PositionOffset(text, edit.Range.End)
+		if err != nil {
+			return "", err
+		}
+		if end < start {
+			return "", fmt.Errorf("invalid edit range %d:%d-%d:%d", edit.Range.Start.Line, edit.Range.Start.Character, edit.Range.End.Line, edit.Range.End.Character)
+		}
+
+		text = text[:start] + edit.NewText + text[end:]
+	}
+
+	return text, nil
+}
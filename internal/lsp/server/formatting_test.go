@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyTextEdits(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		edits   []lsp.TextEdit
+		want    string
+		wantErr string
+	}{
+		{
+			name: "test edits are applied in any order",
+			text: "local x=1\nlocal y=2\n",
+			edits: []lsp.TextEdit{
+				{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 7}, End: lsp.Position{Line: 0, Character: 8}}, NewText: " = "},
+				{Range: lsp.Range{Start: lsp.Position{Line: 1, Character: 7}, End: lsp.Position{Line: 1, Character: 8}}, NewText: " = "},
+			},
+			want: "local x = 1\nlocal y = 2\n",
+		},
+		{
+			name: "test edit replacing whole lines",
+			text: "a\nb\nc\n",
+			edits: []lsp.TextEdit{
+				{Range: lsp.Range{Start: lsp.Position{Line: 1}, End: lsp.Position{Line: 3}}, NewText: "B\nC\n"},
+			},
+			want: "a\nB\nC\n",
+		},
+		{
+			name: "test characters are counted in utf-16",
+			text: "local s = \"😀\"--x\n",
+			edits: []lsp.TextEdit{
+				{Range: lsp.Range{Start: lsp.Position{Line: 0, Character: 14}, End: lsp.Position{Line: 0, Character: 14}}, NewText: " "},
+			},
+			want: "local s = \"😀\" --x\n",
+		},
+		{
+			name: "test out of range edit",
+			text: "a\n",
+			edits: []lsp.TextEdit{
+				{Range: lsp.Range{Start: lsp.Position{Line: 5}, End: lsp.Position{Line: 5}}, NewText: "b"},
+			},
+			wantErr: "position 5:0 is out of range",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := applyTextEdits(tc.text, tc.edits)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestExtractFormattedLines(t *testing.T) {
+	original := "\n\nlocal x=1\n\n\nlocal y=2\n"
+
+	got, ok := extractFormattedLines(original, "\n\nlocal x = 1\n\n\nlocal y=2\n", 2, 3)
+	require.True(t, ok)
+	require.Equal(t, "local x = 1\n", got)
+
+	// formatting collapsed the blank lines after the block
+	_, ok = extractFormattedLines(original, "\n\nlocal x = 1\n\nlocal y=2\n", 2, 3)
+	require.False(t, ok)
+
+	// formatting changed a line before the block
+	_, ok = extractFormattedLines(original, "\nlocal x = 1\n\n\nlocal y=2\n", 2, 3)
+	require.False(t, ok)
+}
+
+func TestBlockFormatEdit(t *testing.T) {
+	lines := []string{
+		"- A list item",
+		"  ```lua",
+		"  local x=1",
+		"",
+		"  local y=2",
+		"  ```",
+	}
+
+	edit, changed := blockFormatEdit(lines, 2, 5, "  ", "local x = 1\n\nlocal y = 2\n")
+	require.True(t, changed)
+	require.Equal(t, lsp.TextEdit{
+		Range:   lsp.Range{Start: lsp.Position{Line: 2}, End: lsp.Position{Line: 5}},
+		NewText: "  local x = 1\n\n  local y = 2\n",
+	}, edit)
+
+	_, changed = blockFormatEdit(lines, 2, 5, "  ", "local x=1\n\nlocal y=2\n")
+	require.False(t, changed)
+}
+
+func TestFormatDocument(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	text := "# Config\n\n```lua\nlocal x=1\n```\n\n```lua\nlocal font={{ .font }}\n```\n"
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: text},
+	}))
+	require.Eventually(t, func() bool {
+		shadowURI, exists := s.docService.ShadowURI(string(uri))
+		return exists && fake.text(shadowURI) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	var edits []lsp.TextEdit
+	require.NoError(t, client.Call(ctx, "textDocument/formatting", lsp.DocumentFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+	}, &edits))
+
+	// The block with a placeholder is masked in the shadow file, so it is left as it is
+	require.Equal(t, []lsp.TextEdit{{
+		Range:   lsp.Range{Start: lsp.Position{Line: 3}, End: lsp.Position{Line: 4}},
+		NewText: "local x = 1\n",
+	}}, edits)
+}
+
+func TestFormatDocumentAfterChange(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "```lua\nlocal x=1\n```\n"},
+	}))
+	require.Eventually(t, func() bool {
+		shadowURI, exists := s.docService.ShadowURI(string(uri))
+		return exists && fake.text(shadowURI) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	// Formatting straight after a change must not wait for the debounced sync
+	require.NoError(t, client.Notify(ctx, "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: 2},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{
+			Range: &lsp.Range{Start: lsp.Position{Line: 2}, End: lsp.Position{Line: 2}},
+			Text:  "local y=2\n",
+		}},
+	}))
+
+	var edits []lsp.TextEdit
+	require.NoError(t, client.Call(ctx, "textDocument/formatting", lsp.DocumentFormattingParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+	}, &edits))
+
+	require.Equal(t, []lsp.TextEdit{{
+		Range:   lsp.Range{Start: lsp.Position{Line: 1}, End: lsp.Position{Line: 3}},
+		NewText: "local x = 1\nlocal y = 2\n",
+	}}, edits)
+}
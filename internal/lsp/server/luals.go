@@ -3,11 +3,14 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sourcegraph/go-lsp"
@@ -16,46 +19,111 @@ import (
 
 type lspServer interface {
 	SendDiagnostics(ctx context.Context, params lsp.PublishDiagnosticsParams) error
+	// showMessage shows a message to the user in the editor
+	showMessage(ctx context.Context, messageType lsp.MessageType, message string)
+	// reopenDocuments opens every shadow document in a restarted lua-language-server with forward, calling
+	// done once they are all open, before any other change to a shadow document can be forwarded
+	reopenDocuments(forward func(method string, params interface{}) error, done func()) error
+	// forwardToClient forwards a notification or request from lua-language-server to the client
+	forwardToClient(ctx context.Context, req *jsonrpc2.Request) (interface{}, error)
 }
 
+// DefaultRequestTimeout is how long a request to lua-language-server is waited on, unless configured for its method
+const DefaultRequestTimeout = 5 * time.Second
+
+const (
+	// The delay before the first restart of lua-language-server, doubled for each restart after
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 30 * time.Second
+	// lua-language-server is given up on after this many restarts in a row, without running for restartResetAfter
+	maxRestarts       = 5
+	restartResetAfter = time.Minute
+)
+
+// LuaLS runs lua-language-server as a child process, restarting it if it exits unexpectedly
 type LuaLS struct {
+	// Guards the process and the restart state, the fields up to Path
+	mu   sync.Mutex
 	conn *jsonrpc2.Conn
 	cmd  *exec.Cmd
+	// Set while lua-language-server is restarting, requests fail straight away instead of waiting on it
+	restarting bool
+	// Set once the server is shutting down, so lua-language-server exiting is expected
+	stopping bool
+	// Restarts in a row, reset once lua-language-server runs for restartResetAfter
+	restarts int
+	// The initialize params forwarded from the client, and if it has been initialized, replayed on restart
+	initParams  interface{}
+	initialized bool
 
 	Path string
+	// Arguments to run lua-language-server with
+	args []string
+	// The delay before the first restart, minRestartBackoff unless set
+	backoff time.Duration
+	// How long requests are waited on, DefaultRequestTimeout unless set, and the timeouts of specific methods
+	timeout        time.Duration
+	methodTimeouts map[string]time.Duration
+	// The ID of the last request sent
+	nextID atomic.Uint64
+	// Requests from lua-language-server being forwarded to the client, so they can be cancelled
+	requests inflightRequests
 
 	server lspServer
 }
 
-func NewLuaLs(server lspServer, luaLSPath string) (*LuaLS, error) {
+func NewLuaLs(server lspServer, luaLSPath string, timeout time.Duration, methodTimeouts map[string]time.Duration) (*LuaLS, error) {
 	luaPath, err := findLuaLS(luaLSPath)
 	if err != nil {
 		return nil, fmt.Errorf("lua-language-server not found: %w", err)
 	}
 
-	cmd := exec.Command(luaPath)
+	return &LuaLS{
+		server:  server,
+		Path:    luaPath,
+		backoff: minRestartBackoff,
+
+		timeout:        timeout,
+		methodTimeouts: methodTimeouts,
+	}, nil
+}
+
+func (l *LuaLS) Start() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.launch(); err != nil {
+		return err
+	}
+
+	slog.Info("lua-language-server started", "path", l.Path)
+	return nil
+}
+
+// launch starts a lua-language-server process and connects to it, supervising it until it exits
+//
+// Must be called with l.mu held
+func (l *LuaLS) launch() error {
+	cmd := exec.Command(l.Path, l.args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
-	rw := NewRWC(stdout, stdin)
-	stream := jsonrpc2.NewBufferedStream(rw, jsonrpc2.VSCodeObjectCodec{})
-
-	l := &LuaLS{
-		cmd:    cmd,
-		server: server,
-		Path:   luaPath,
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start lua-language-server: %w", err)
 	}
 
-	l.conn = jsonrpc2.NewConn(
+	rw := NewRWC(stdout, stdin)
+	stream := jsonrpc2.NewBufferedStream(rw, jsonrpc2.VSCodeObjectCodec{})
+	conn := jsonrpc2.NewConn(
 		context.Background(),
 		stream,
-		jsonrpc2.HandlerWithError(l.HandleResponse),
+		l.handler(),
 		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, _ *jsonrpc2.Response) {
 			if req != nil {
 				// Additional debugging if for some reason we are not even handling the request
@@ -64,30 +132,146 @@ func NewLuaLs(server lspServer, luaLSPath string) (*LuaLS, error) {
 		}),
 	)
 
-	return l, nil
+	l.cmd = cmd
+	l.conn = conn
+	go l.supervise(cmd, conn, time.Now())
+
+	return nil
 }
 
-func (l *LuaLS) Start() error {
-	if err := l.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start lua-language-server: %w", err)
+// supervise waits for a lua-language-server process to exit, restarting it with backoff unless it was stopped
+func (l *LuaLS) supervise(cmd *exec.Cmd, conn *jsonrpc2.Conn, started time.Time) {
+	err := cmd.Wait()
+	conn.Close()
+
+	l.mu.Lock()
+	if l.stopping {
+		l.mu.Unlock()
+		slog.Info("lua-language-server stopped")
+		return
+	}
+
+	slog.Error("lua-language-server exited", "error", err)
+	l.restarting = true
+	if time.Since(started) >= restartResetAfter {
+		l.restarts = 0
 	}
+	l.mu.Unlock()
 
-	go func() {
-		err := l.cmd.Wait()
-		if err != nil {
-			slog.Error("lua-language-server exited", "error", err)
+	ctx := context.Background()
+	for {
+		l.mu.Lock()
+		l.restarts++
+		restarts := l.restarts
+		l.mu.Unlock()
+
+		if restarts > maxRestarts {
+			slog.Error("giving up on restarting lua-language-server", "restarts", maxRestarts)
+			l.server.showMessage(ctx, lsp.MTError, fmt.Sprintf(
+				"litlua: lua-language-server crashed %d times in a row and will not be restarted, restart the language server to try again", maxRestarts))
+			return
 		}
-	}()
 
-	slog.Info("lua-language-server started", "path", l.Path)
+		backoff := min(l.backoff<<(restarts-1), maxRestartBackoff)
+		l.server.showMessage(ctx, lsp.MTWarning, fmt.Sprintf("litlua: lua-language-server exited unexpectedly, restarting in %s", backoff))
+		time.Sleep(backoff)
+
+		if err := l.restart(); err != nil {
+			slog.Error("failed to restart lua-language-server", "error", err)
+			continue
+		}
+		// The restarted process is supervised by its own goroutine
+		return
+	}
+}
+
+// restart launches lua-language-server again, replaying the initialization and the open documents of the client
+//
+// Only an error launching the process is returned. If the replay fails the new process is killed, so its own
+// supervisor restarts it again.
+func (l *LuaLS) restart() error {
+	l.mu.Lock()
+	if l.stopping {
+		l.mu.Unlock()
+		return nil
+	}
+	if err := l.launch(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	conn, cmd := l.conn, l.cmd
+	initParams, initialized := l.initParams, l.initialized
+	l.mu.Unlock()
 
+	forward := func(method string, params interface{}) error {
+		_, err := l.call(context.Background(), conn, method, params)
+		return err
+	}
+
+	if err := l.replay(forward, initParams, initialized); err != nil {
+		slog.Error("failed to replay to restarted lua-language-server", "error", err)
+		_ = cmd.Process.Kill()
+		return nil
+	}
+
+	slog.Info("lua-language-server restarted", "path", l.Path)
+	l.server.showMessage(context.Background(), lsp.Info, "litlua: lua-language-server restarted")
 	return nil
 }
 
-// HandleResponse handles responses from the lua-language-server
-// and forwards them to the proxy
+// replay initializes a restarted lua-language-server as the client did, and opens every shadow document again
+func (l *LuaLS) replay(forward func(method string, params interface{}) error, initParams interface{}, initialized bool) error {
+	if initParams != nil {
+		if err := forward("initialize", initParams); err != nil {
+			return fmt.Errorf("failed to replay initialize: %w", err)
+		}
+		if initialized {
+			if err := forward("initialized", struct{}{}); err != nil {
+				return fmt.Errorf("failed to replay initialized: %w", err)
+			}
+		}
+	}
+
+	err := l.server.reopenDocuments(forward, func() {
+		l.mu.Lock()
+		l.restarting = false
+		l.mu.Unlock()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reopen documents: %w", err)
+	}
+	return nil
+}
+
+// Stop shuts lua-language-server down, without restarting it
+func (l *LuaLS) Stop() {
+	l.mu.Lock()
+	l.stopping = true
+	conn := l.conn
+	l.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+	if _, err := l.call(context.Background(), conn, "shutdown", nil); err != nil {
+		slog.Error("failed to shut down lua-language-server", "error", err)
+	}
+	if err := conn.Notify(context.Background(), "exit", nil); err != nil {
+		slog.Error("failed to exit lua-language-server", "error", err)
+	}
+}
+
+// handler returns the handler for the connection to lua-language-server
+//
+// As for the client, notifications are handled in order and requests concurrently, so a request waiting on the
+// client does not hold up the responses of lua-language-server.
+func (l *LuaLS) handler() jsonrpc2.Handler {
+	return orderedHandler{Handler: jsonrpc2.HandlerWithError(l.HandleResponse), requests: &l.requests}
+}
+
+// HandleResponse handles notifications and requests from the lua-language-server, forwarding them to the client
 func (l *LuaLS) HandleResponse(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
-	slog.Debug("received notification from lua-ls", "method", req.Method)
+	slog.Debug("received message from lua-ls", "method", req.Method)
 	switch req.Method {
 	case "textDocument/publishDiagnostics":
 		var params lsp.PublishDiagnosticsParams
@@ -95,12 +279,18 @@ func (l *LuaLS) HandleResponse(ctx context.Context, conn *jsonrpc2.Conn, req *js
 			return nil, err
 		}
 
-		// Get the markdown file this diagnostic is for
-		originalURI, exists := l.server.(*Server).getShadowToOriginalURI(string(params.URI))
+		// Get the markdown file this diagnostic is for, or the plain lua file of the workspace it mirrors
+		s := l.server.(*Server)
+		originalURI, exists := s.clientURI(string(params.URI))
 		if !exists {
 			return nil, fmt.Errorf("no mapping for shadow URI: %s", params.URI)
 		}
 
+		indents := s.indentsOf(originalURI)
+		for i := range params.Diagnostics {
+			params.Diagnostics[i].Range = indents.rangeToMarkdown(params.Diagnostics[i].Range)
+		}
+
 		slog.Debug("forwarding diagnostics",
 			"shadow_uri", params.URI,
 			"original_uri", originalURI,
@@ -108,17 +298,78 @@ func (l *LuaLS) HandleResponse(ctx context.Context, conn *jsonrpc2.Conn, req *js
 
 		params.URI = lsp.DocumentURI(originalURI)
 		return nil, l.server.SendDiagnostics(ctx, params)
+
+	case "$/cancelRequest":
+		// A request forwarded to the client is abandoned, the client's reply is dropped
+		var params lsp.CancelParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+		l.requests.cancel(jsonrpc2.ID{Num: params.ID.Num, Str: params.ID.Str, IsString: params.ID.IsString})
+		return nil, nil
+
+	default:
+		return l.server.forwardToClient(ctx, req)
 	}
-	return nil, nil
 }
 
+// ErrLuaLSUnavailable is returned when forwarding a request while lua-language-server is restarting
+var ErrLuaLSUnavailable = errors.New("lua-language-server is restarting")
+
 // ForwardRequest forwards a request from proxy to the lua-language-server
-func (l *LuaLS) ForwardRequest(method string, params interface{}) (interface{}, error) {
-	var result interface{}
-	slog.Info("sending request to lua-ls", "method", method)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//
+// The request is abandoned once ctx is done or the timeout for its method passes, cancelling it in lua-language-server.
+// The initialize params are kept, so they can be replayed if lua-language-server is restarted.
+func (l *LuaLS) ForwardRequest(ctx context.Context, method string, params interface{}) (interface{}, error) {
+	l.mu.Lock()
+	if l.restarting {
+		l.mu.Unlock()
+		return nil, ErrLuaLSUnavailable
+	}
+	switch method {
+	case "initialize":
+		l.initParams = params
+	case "initialized":
+		l.initialized = true
+	}
+	conn := l.conn
+	l.mu.Unlock()
+
+	return l.call(ctx, conn, method, params)
+}
+
+// requestTimeout returns how long a request to lua-language-server is waited on
+func (l *LuaLS) requestTimeout(method string) time.Duration {
+	if timeout, ok := l.methodTimeouts[method]; ok {
+		return timeout
+	}
+	if l.timeout > 0 {
+		return l.timeout
+	}
+	return DefaultRequestTimeout
+}
+
+func (l *LuaLS) call(ctx context.Context, conn *jsonrpc2.Conn, method string, params interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.requestTimeout(method))
 	defer cancel()
-	err := l.conn.Call(ctx, method, params, &result)
+
+	// Requests are sent with IDs picked here, so they can be cancelled
+	id := jsonrpc2.ID{Num: l.nextID.Add(1)}
+	slog.Info("sending request to lua-ls", "method", method, "id", id)
+	call, err := conn.DispatchCall(ctx, method, params, jsonrpc2.PickID(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	err = call.Wait(ctx, &result)
+	if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		slog.Debug("cancelling request to lua-ls", "method", method, "id", id, "reason", ctxErr)
+		if err := conn.Notify(context.Background(), "$/cancelRequest", lsp.CancelParams{ID: lsp.ID{Num: id.Num}}); err != nil {
+			slog.Error("failed to cancel request to lua-ls", "method", method, "id", id, "error", err)
+		}
+		return nil, fmt.Errorf("%s request to lua-language-server abandoned: %w", method, ctxErr)
+	}
 	return result, err
 }
 
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/stretchr/testify/require"
+)
+
+const fakeLuaLSEnv = "LITLUA_FAKE_LUALS"
+
+// TestFakeLuaLSProcess is not a test, but the fake lua-language-server process started by the supervisor tests
+//
+// The "test/crash" method exits the process, and with the "exit" mode it exits as soon as it starts.
+func TestFakeLuaLSProcess(t *testing.T) {
+	mode := os.Getenv(fakeLuaLSEnv)
+	switch mode {
+	case "":
+		t.Skip("only run as a fake lua-language-server")
+	case "exit":
+		os.Exit(1)
+	}
+
+	fake := &fakeLuaLS{texts: make(map[string]string), versions: make(map[string]int)}
+	stream := jsonrpc2.NewBufferedStream(NewStdRWC(), jsonrpc2.VSCodeObjectCodec{})
+	conn := jsonrpc2.NewConn(context.Background(), stream,
+		jsonrpc2.HandlerWithError(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+			switch req.Method {
+			case "test/crash":
+				os.Exit(1)
+			case "exit":
+				os.Exit(0)
+			}
+			return fake.handle(ctx, conn, req)
+		}))
+	<-conn.DisconnectNotify()
+	os.Exit(0)
+}
+
+// messageRecorder is a client keeping the messages shown to the user
+type messageRecorder struct {
+	mu       sync.Mutex
+	messages []lsp.ShowMessageParams
+}
+
+func (m *messageRecorder) handle(_ context.Context, _ *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+	if req.Method != "window/showMessage" {
+		return nil, nil
+	}
+
+	var params lsp.ShowMessageParams
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, params)
+	return nil, nil
+}
+
+func (m *messageRecorder) has(messageType lsp.MessageType) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, message := range m.messages {
+		if message.Type == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// newSupervisedTestServer returns a server running the fake lua-language-server process in mode, and a client connected to it
+func newSupervisedTestServer(t *testing.T, mode string) (*Server, *messageRecorder, *jsonrpc2.Conn) {
+	t.Helper()
+	ctx := context.Background()
+
+	// The fake process inherits the environment of the test
+	t.Setenv(fakeLuaLSEnv, mode)
+
+	opts := iLsp.DefaultDocumentServiceOptions
+	opts.ShadowRoot = t.TempDir()
+	docService, err := iLsp.NewDocumentService(opts)
+	require.NoError(t, err)
+
+	s := &Server{
+		docService:    docService,
+		debounceTimer: make(map[string]*time.Timer),
+		diagnostics:   newDiagnosticStore(),
+	}
+	s.LuaLS = &LuaLS{
+		server:  s,
+		Path:    os.Args[0],
+		args:    []string{"-test.run=^TestFakeLuaLSProcess$"},
+		backoff: time.Millisecond,
+	}
+
+	recorder := &messageRecorder{}
+	clientSide, serverSide := net.Pipe()
+	serverConn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(serverSide, jsonrpc2.VSCodeObjectCodec{}), s.Handler())
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientSide, jsonrpc2.VSCodeObjectCodec{}),
+		jsonrpc2.HandlerWithError(recorder.handle))
+	// Messages can be shown before the client sends anything
+	s.attach(serverConn)
+
+	require.NoError(t, s.LuaLS.Start())
+
+	t.Cleanup(func() {
+		s.LuaLS.Stop()
+		client.Close()
+		serverConn.Close()
+	})
+
+	return s, recorder, client
+}
+
+func TestLuaLSRestart(t *testing.T) {
+	s, recorder, client := newSupervisedTestServer(t, "serve")
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+	require.NoError(t, client.Notify(ctx, "initialized", struct{}{}))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "# Config\n\n```lua\nlocal x = 1\n```\n"},
+	}))
+
+	hover := func() (lsp.Hover, error) {
+		var hover lsp.Hover
+		err := client.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+			Position:     lsp.Position{Line: 3, Character: 6},
+		}, &hover)
+		return hover, err
+	}
+	want := []lsp.MarkedString{{Language: "lua", Value: "local x = 1"}}
+
+	got, err := hover()
+	require.NoError(t, err)
+	require.Equal(t, want, got.Contents)
+
+	// Crash lua-language-server, the request fails as the process exits
+	require.Error(t, client.Call(ctx, "test/crash", nil, nil))
+
+	// The restarted lua-language-server is initialized and has the document open again
+	require.Eventually(t, func() bool {
+		got, err := hover()
+		return err == nil && len(got.Contents) == 1 && got.Contents[0] == want[0]
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return recorder.has(lsp.MTWarning) && recorder.has(lsp.Info)
+	}, time.Second, 10*time.Millisecond)
+	require.False(t, recorder.has(lsp.MTError))
+
+	s.LuaLS.mu.Lock()
+	defer s.LuaLS.mu.Unlock()
+	require.False(t, s.LuaLS.restarting)
+}
+
+func TestLuaLSRestartGivesUp(t *testing.T) {
+	s, recorder, _ := newSupervisedTestServer(t, "exit")
+
+	// lua-language-server exits every time it is started, so it is given up on after the maximum restarts
+	require.Eventually(t, func() bool {
+		return recorder.has(lsp.MTError)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := s.LuaLS.ForwardRequest(context.Background(), "textDocument/hover", nil)
+	require.ErrorIs(t, err, ErrLuaLSUnavailable)
+
+	s.LuaLS.mu.Lock()
+	defer s.LuaLS.mu.Unlock()
+	require.Equal(t, maxRestarts+1, s.LuaLS.restarts)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// forwardPlainDocument forwards a request about a plain Lua file to lua-language-server, as the file's mirror in the
+// shadow root, with the shadow URIs in the result mapped back. Returns false if the request is not about a plain Lua file.
+func (s *Server) forwardPlainDocument(ctx context.Context, req *jsonrpc2.Request) (interface{}, bool, error) {
+	if req.Params == nil || !strings.HasPrefix(req.Method, "textDocument/") {
+		return nil, false, nil
+	}
+
+	var params map[string]interface{}
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		return nil, false, nil
+	}
+	textDocument, ok := params["textDocument"].(map[string]interface{})
+	if !ok {
+		return nil, false, nil
+	}
+	uri, ok := textDocument["uri"].(string)
+	if !ok || !iLsp.IsPlainLuaDocument(lsp.DocumentURI(uri)) {
+		return nil, false, nil
+	}
+
+	shadowURI, exists := s.docService.ShadowURI(uri)
+	if !exists {
+		return nil, true, fmt.Errorf("no shadow file found for %s", uri)
+	}
+	textDocument["uri"] = shadowURI
+
+	result, err := s.LuaLS.ForwardRequest(ctx, req.Method, params)
+	if err != nil {
+		return nil, true, err
+	}
+	return s.mapShadowURIs(result), true, nil
+}
+
+// linkWorkspace links the client's workspace into the shadow root, at the path it mirrors, so lua-language-server
+// finds the plain Lua modules of the workspace next to the shadow documents, and requires between them resolve
+//
+// A link left by an earlier workspace is replaced, as is a directory left by earlier versions that wrote shadow files
+// to disk, as long as it holds nothing else.
+func (s *Server) linkWorkspace() error {
+	if s.workspaceRoot == "" {
+		return nil
+	}
+
+	shadowRoot := s.docService.ShadowRoot()
+	if within(shadowRoot, s.workspaceRoot) || within(s.workspaceRoot, shadowRoot) {
+		return fmt.Errorf("shadow root %s and workspace %s must not be within each other", shadowRoot, s.workspaceRoot)
+	}
+
+	link := filepath.Join(shadowRoot, s.workspaceRoot)
+	info, err := os.Lstat(link)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	case info.Mode()&fs.ModeSymlink != 0:
+		if target, err := os.Readlink(link); err == nil && target == s.workspaceRoot {
+			return nil
+		}
+		if err := os.Remove(link); err != nil {
+			return fmt.Errorf("failed to remove stale link: %w", err)
+		}
+	case info.IsDir():
+		if err := removeShadowDir(link); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s is in the way of linking the workspace", link)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return fmt.Errorf("failed to create shadow directory: %w", err)
+	}
+	if err := os.Symlink(s.workspaceRoot, link); err != nil {
+		return fmt.Errorf("failed to link workspace: %w", err)
+	}
+
+	slog.Info("linked workspace into shadow root", "workspace", s.workspaceRoot, "link", link)
+	return nil
+}
+
+// removeShadowDir removes a directory of the shadow root, if it only holds directories and shadow files
+func removeShadowDir(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !strings.HasSuffix(d.Name(), "litlua.lua") {
+			return fmt.Errorf("%s is not a shadow file", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace shadow directory %s: %w", dir, err)
+	}
+	return os.RemoveAll(dir)
+}
+
+// within returns true if path is dir or within it
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
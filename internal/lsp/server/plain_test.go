@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlainLuaDocument(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	workspace := t.TempDir()
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + workspace)}, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(workspace, "lua", "util.lua"))
+	mirrorURI := "file://" + filepath.Join(s.docService.ShadowRoot(), workspace, "lua", "util.lua")
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "lua", Version: 1, Text: "local M = {}\nreturn M\n"},
+	}))
+
+	// The file is sent to lua-language-server unchanged, at its mirror in the shadow root
+	require.Eventually(t, func() bool {
+		return fake.text(mirrorURI) == "local M = {}\nreturn M\n"
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Notify(ctx, "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: uri}, Version: 2},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{
+			Range: &lsp.Range{Start: lsp.Position{Line: 1, Character: 7}, End: lsp.Position{Line: 1, Character: 8}},
+			Text:  "{}",
+		}},
+	}))
+	require.Eventually(t, func() bool {
+		return fake.text(mirrorURI) == "local M = {}\nreturn {}\n"
+	}, time.Second, 10*time.Millisecond)
+
+	t.Run("test requests are forwarded at the mirror", func(t *testing.T) {
+		var hover lsp.Hover
+		require.NoError(t, client.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+			Position:     lsp.Position{Line: 1},
+		}, &hover))
+		require.Equal(t, "return {}", hover.Contents[0].Value)
+	})
+
+	t.Run("test definitions are mapped back from the mirror", func(t *testing.T) {
+		var links []LocationLink
+		require.NoError(t, client.Call(ctx, "textDocument/definition", lsp.TextDocumentPositionParams{
+			TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+			Position:     lsp.Position{Line: 0, Character: 6},
+		}, &links))
+		require.Len(t, links, 1)
+		require.Equal(t, uri, links[0].TargetURI)
+	})
+
+	require.NoError(t, client.Notify(ctx, "textDocument/didClose", lsp.DidCloseTextDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+	}))
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		_, open := fake.texts[mirrorURI]
+		return !open && len(fake.errs) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRequireDocument(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	workspace := t.TempDir()
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + workspace)}, &initResult))
+
+	docURI := lsp.DocumentURI("file://" + filepath.Join(workspace, "lua", "plugins.litlua.md"))
+	plainURI := lsp.DocumentURI("file://" + filepath.Join(workspace, "init.lua"))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: docURI, LanguageID: "markdown", Version: 1,
+			Text: "<!-- @pragma output: plugins.lua -->\n\n```lua\nreturn {}\n```\n"},
+	}))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: plainURI, LanguageID: "lua", Version: 1, Text: "local plugins = require('lua.plugins')\n"},
+	}))
+
+	// The shadow document mirrors the document in the shadow root, next to the plain files of the workspace
+	shadowURI := "file://" + filepath.Join(s.docService.ShadowRoot(), workspace, "lua", "plugins.litlua.lua")
+	require.Eventually(t, func() bool {
+		uri, exists := s.docService.ShadowURI(string(docURI))
+		return exists && uri == shadowURI && fake.text(shadowURI) != "" && fake.text(s.docService.MirrorURI(plainURI)) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	var links []LocationLink
+	require.NoError(t, client.Call(ctx, "textDocument/definition", lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: plainURI},
+		Position:     lsp.Position{Line: 0, Character: 20},
+	}, &links))
+	require.Len(t, links, 1)
+	require.Equal(t, docURI, links[0].TargetURI)
+}
+
+func TestLinkWorkspace(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, link string)
+		expectErr bool
+	}{
+		{
+			name:  "test no shadow directory",
+			setup: func(t *testing.T, link string) {},
+		},
+		{
+			name: "test stale link",
+			setup: func(t *testing.T, link string) {
+				require.NoError(t, os.MkdirAll(filepath.Dir(link), 0755))
+				require.NoError(t, os.Symlink(t.TempDir(), link))
+			},
+		},
+		{
+			name: "test directory of shadow files",
+			setup: func(t *testing.T, link string) {
+				require.NoError(t, os.MkdirAll(filepath.Join(link, "lua"), 0755))
+				require.NoError(t, os.WriteFile(filepath.Join(link, "lua", "init.litlua.lua"), nil, 0644))
+			},
+		},
+		{
+			name: "test directory with other files",
+			setup: func(t *testing.T, link string) {
+				require.NoError(t, os.MkdirAll(link, 0755))
+				require.NoError(t, os.WriteFile(filepath.Join(link, "notes.txt"), nil, 0644))
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _, _ := newTestServer(t)
+			s.workspaceRoot = t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(s.workspaceRoot, "util.lua"), []byte("return {}\n"), 0644))
+
+			link := filepath.Join(s.docService.ShadowRoot(), s.workspaceRoot)
+			tc.setup(t, link)
+
+			err := s.linkWorkspace()
+			if tc.expectErr {
+				require.Error(t, err)
+				require.FileExists(t, filepath.Join(link, "notes.txt"))
+				return
+			}
+			require.NoError(t, err)
+			require.FileExists(t, filepath.Join(link, "util.lua"))
+
+			// Linking again keeps the link
+			require.NoError(t, s.linkWorkspace())
+			require.FileExists(t, filepath.Join(link, "util.lua"))
+		})
+	}
+
+	t.Run("test workspace within the shadow root", func(t *testing.T) {
+		s, _, _ := newTestServer(t)
+		s.workspaceRoot = filepath.Join(s.docService.ShadowRoot(), "project")
+		require.Error(t, s.linkWorkspace())
+	})
+}
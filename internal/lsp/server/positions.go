@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jwtly10/litlua"
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// blockIndents are the indentation of the fence of each code line of a document, keyed by 0-indexed line
+//
+// Shadow files keep the lines of the markdown, but the code of a block indented in markdown (e.g. in a list) is
+// written to the shadow file without the indentation of its fence, so characters on its lines are shifted by it.
+// Every position and edit is mapped between a document and its shadow file with them. A nil blockIndents maps
+// positions as they are, e.g. for plain Lua files.
+type blockIndents map[int]string
+
+// newBlockIndents returns the indents of the code lines of the blocks of a document
+func newBlockIndents(blocks []litlua.CodeBlock, text string) blockIndents {
+	lines := strings.Split(text, "\n")
+
+	indents := make(blockIndents)
+	for _, block := range blocks {
+		// Blocks are 1-indexed from the first line of code to the closing fence, LSP lines are 0-indexed
+		first, last := block.Position.StartLine-1, block.Position.EndLine-2
+
+		indent := ""
+		if first > 0 && first-1 < len(lines) {
+			fence := lines[first-1]
+			indent = fence[:len(fence)-len(strings.TrimLeft(fence, " \t"))]
+		}
+
+		for line := first; line <= last; line++ {
+			indents[line] = indent
+		}
+	}
+	return indents
+}
+
+// indentsOf returns the block indents of an open document, or nil if it has no code blocks
+func (s *Server) indentsOf(originalURI string) blockIndents {
+	if iLsp.IsPlainLuaDocument(lsp.DocumentURI(originalURI)) {
+		return nil
+	}
+
+	text, exists := s.docService.DocumentText(originalURI)
+	if !exists {
+		return nil
+	}
+	blocks, err := s.docService.CodeBlocks(originalURI)
+	if err != nil {
+		return nil
+	}
+	return newBlockIndents(blocks, text)
+}
+
+// isCodeLine returns true if a 0-indexed line is a line of code of a block
+func (b blockIndents) isCodeLine(line int) bool {
+	_, ok := b[line]
+	return ok
+}
+
+// toShadow maps a position in the markdown document to its shadow file
+func (b blockIndents) toShadow(pos lsp.Position) lsp.Position {
+	pos.Character = max(0, pos.Character-len(b[pos.Line]))
+	return pos
+}
+
+// toMarkdown maps a position in the shadow file to its markdown document
+func (b blockIndents) toMarkdown(pos lsp.Position) lsp.Position {
+	pos.Character += len(b[pos.Line])
+	return pos
+}
+
+func (b blockIndents) rangeToShadow(r lsp.Range) lsp.Range {
+	return lsp.Range{Start: b.toShadow(r.Start), End: b.toShadow(r.End)}
+}
+
+func (b blockIndents) rangeToMarkdown(r lsp.Range) lsp.Range {
+	return lsp.Range{Start: b.toMarkdown(r.Start), End: b.toMarkdown(r.End)}
+}
+
+// editsToMarkdown maps edits of the shadow file to its markdown document
+//
+// Each line the new text of an edit starts in the block is indented, so inserted lines stay in the block.
+func (b blockIndents) editsToMarkdown(edits []lsp.TextEdit) []lsp.TextEdit {
+	mapped := make([]lsp.TextEdit, len(edits))
+	for i, edit := range edits {
+		mapped[i] = lsp.TextEdit{Range: b.rangeToMarkdown(edit.Range), NewText: edit.NewText}
+		if indent := b[edit.Range.Start.Line]; indent != "" {
+			mapped[i].NewText = strings.ReplaceAll(edit.NewText, "\n", "\n"+indent)
+		}
+	}
+	return mapped
+}
+
+// mapRawRange maps a range in raw JSON with mapRange, keeping the JSON as it is if it is not a range
+func mapRawRange(raw json.RawMessage, mapRange func(lsp.Range) lsp.Range) json.RawMessage {
+	var r lsp.Range
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return raw
+	}
+	mapped, err := json.Marshal(mapRange(r))
+	if err != nil {
+		return raw
+	}
+	return mapped
+}
+
+// mapResultRange maps the range of a result from lua-language-server to the markdown, where the result is either
+// a range, or has an optional range field, e.g. hover and prepareRename results
+func mapResultRange(result interface{}, indents blockIndents) (interface{}, error) {
+	if result == nil || indents == nil {
+		return result, nil
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(resultBytes, &fields); err != nil {
+		return result, nil
+	}
+
+	if r, ok := fields["range"]; ok {
+		fields["range"] = mapRawRange(r, indents.rangeToMarkdown)
+		return fields, nil
+	}
+	if _, ok := fields["start"]; ok {
+		return mapRawRange(resultBytes, indents.rangeToMarkdown), nil
+	}
+	return result, nil
+}
+
+// mapCompletionEdits maps the edits of the completion items of a result from lua-language-server to the markdown
+//
+// Items are kept as raw JSON, so fields we don't know about are kept for completionItem/resolve.
+func mapCompletionEdits(result interface{}, indents blockIndents) (interface{}, error) {
+	if result == nil || indents == nil {
+		return result, nil
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	// The result is either a list of items, or a CompletionList with the items in its items field
+	var list map[string]json.RawMessage
+	itemsBytes := json.RawMessage(resultBytes)
+	if err := json.Unmarshal(resultBytes, &list); err == nil {
+		itemsBytes = list["items"]
+	}
+
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(itemsBytes, &items); err != nil {
+		return nil, fmt.Errorf("unable to parse completion response: %w", err)
+	}
+
+	for _, item := range items {
+		if raw, ok := item["textEdit"]; ok {
+			mapped, err := mapCompletionTextEdit(raw, indents)
+			if err != nil {
+				return nil, err
+			}
+			item["textEdit"] = mapped
+		}
+
+		if raw, ok := item["additionalTextEdits"]; ok {
+			var edits []lsp.TextEdit
+			if err := json.Unmarshal(raw, &edits); err != nil {
+				return nil, fmt.Errorf("unable to parse completion edits: %w", err)
+			}
+			if item["additionalTextEdits"], err = json.Marshal(indents.editsToMarkdown(edits)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if list == nil {
+		return items, nil
+	}
+	if list["items"], err = json.Marshal(items); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// mapCompletionTextEdit maps the text edit of a completion item, which is either a TextEdit, or an
+// InsertReplaceEdit with an insert and a replace range
+func mapCompletionTextEdit(raw json.RawMessage, indents blockIndents) (json.RawMessage, error) {
+	var edit struct {
+		NewText string     `json:"newText"`
+		Range   *lsp.Range `json:"range,omitempty"`
+		Insert  *lsp.Range `json:"insert,omitempty"`
+		Replace *lsp.Range `json:"replace,omitempty"`
+	}
+	if err := json.Unmarshal(raw, &edit); err != nil {
+		return nil, fmt.Errorf("unable to parse completion edit: %w", err)
+	}
+
+	// The insert and replace ranges start at the same position, so the new text is mapped the same for both
+	newText := edit.NewText
+	for _, r := range []*lsp.Range{edit.Range, edit.Insert, edit.Replace} {
+		if r == nil {
+			continue
+		}
+		mapped := indents.editsToMarkdown([]lsp.TextEdit{{Range: *r, NewText: newText}})[0]
+		*r = mapped.Range
+		edit.NewText = mapped.NewText
+	}
+
+	return json.Marshal(edit)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBlockIndents(t *testing.T) {
+	text := "# Config\n```lua\nlocal x = 1\n```\n- item\n  ```lua\n  local y = 2\n  local z = 3\n  ```\n"
+
+	got := newBlockIndents([]litlua.CodeBlock{
+		{Position: litlua.Position{StartLine: 3, EndLine: 4}},
+		{Position: litlua.Position{StartLine: 7, EndLine: 9}},
+	}, text)
+
+	require.Equal(t, blockIndents{2: "", 6: "  ", 7: "  "}, got)
+}
+
+func TestBlockIndentsMapping(t *testing.T) {
+	indents := blockIndents{2: "", 6: "  ", 7: "  "}
+
+	tests := []struct {
+		name     string
+		markdown lsp.Position
+		shadow   lsp.Position
+	}{
+		{
+			name:     "test a line of a block without indent",
+			markdown: lsp.Position{Line: 2, Character: 6},
+			shadow:   lsp.Position{Line: 2, Character: 6},
+		},
+		{
+			name:     "test a line of an indented block",
+			markdown: lsp.Position{Line: 6, Character: 8},
+			shadow:   lsp.Position{Line: 6, Character: 6},
+		},
+		{
+			name:     "test a line outside of a block",
+			markdown: lsp.Position{Line: 4, Character: 3},
+			shadow:   lsp.Position{Line: 4, Character: 3},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.shadow, indents.toShadow(tc.markdown))
+			require.Equal(t, tc.markdown, indents.toMarkdown(tc.shadow))
+		})
+	}
+
+	t.Run("test a position in the indent maps to the start of the code", func(t *testing.T) {
+		require.Equal(t, lsp.Position{Line: 6}, indents.toShadow(lsp.Position{Line: 6, Character: 1}))
+	})
+
+	t.Run("test nil indents map positions as they are", func(t *testing.T) {
+		pos := lsp.Position{Line: 6, Character: 8}
+		require.Equal(t, pos, blockIndents(nil).toShadow(pos))
+		require.Equal(t, pos, blockIndents(nil).toMarkdown(pos))
+	})
+}
+
+func TestEditsToMarkdown(t *testing.T) {
+	indents := blockIndents{2: "", 6: "  ", 7: "  "}
+
+	got := indents.editsToMarkdown([]lsp.TextEdit{
+		{Range: lsp.Range{Start: lsp.Position{Line: 2, Character: 6}, End: lsp.Position{Line: 2, Character: 7}}, NewText: "a\nb"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 6, Character: 6}, End: lsp.Position{Line: 7, Character: 0}}, NewText: "y = 2\nlocal w = 4\n"},
+	})
+
+	require.Equal(t, []lsp.TextEdit{
+		{Range: lsp.Range{Start: lsp.Position{Line: 2, Character: 6}, End: lsp.Position{Line: 2, Character: 7}}, NewText: "a\nb"},
+		{Range: lsp.Range{Start: lsp.Position{Line: 6, Character: 8}, End: lsp.Position{Line: 7, Character: 2}}, NewText: "y = 2\n  local w = 4\n  "},
+	}, got)
+}
+
+func TestMapResultRange(t *testing.T) {
+	indents := blockIndents{6: "  "}
+	shadow := lsp.Range{Start: lsp.Position{Line: 6, Character: 6}, End: lsp.Position{Line: 6, Character: 7}}
+	markdown := lsp.Range{Start: lsp.Position{Line: 6, Character: 8}, End: lsp.Position{Line: 6, Character: 9}}
+
+	t.Run("test a result with a range field", func(t *testing.T) {
+		got, err := mapResultRange(lsp.Hover{Contents: []lsp.MarkedString{{Value: "y"}}, Range: &shadow}, indents)
+		require.NoError(t, err)
+		require.JSONEq(t, mustMarshal(t, lsp.Hover{Contents: []lsp.MarkedString{{Value: "y"}}, Range: &markdown}), mustMarshal(t, got))
+	})
+
+	t.Run("test a range result", func(t *testing.T) {
+		got, err := mapResultRange(shadow, indents)
+		require.NoError(t, err)
+		require.JSONEq(t, mustMarshal(t, markdown), mustMarshal(t, got))
+	})
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// ApplyWorkspaceEditParams is an implementation of the ApplyWorkspaceEditParams LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#applyWorkspaceEditParams
+type ApplyWorkspaceEditParams struct {
+	Label string        `json:"label,omitempty"`
+	Edit  WorkspaceEdit `json:"edit"`
+}
+
+// ApplyWorkspaceEditResult is an implementation of the ApplyWorkspaceEditResult LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#applyWorkspaceEditResult
+type ApplyWorkspaceEditResult struct {
+	Applied       bool   `json:"applied"`
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+// forwardToClient forwards a notification or request from lua-language-server to the client, with the shadow
+// URIs in its params mapped to the client's documents, returning the client's result for a request
+//
+// Settings are answered by [Server.workspaceConfiguration]. Edits lua-language-server asks the client to apply are
+// checked as for a rename, see [Server.mapWorkspaceEdit], and refused without asking the client if any can't be mapped.
+func (s *Server) forwardToClient(ctx context.Context, req *jsonrpc2.Request) (interface{}, error) {
+	if req.Method == "workspace/configuration" {
+		return s.workspaceConfiguration(ctx, req)
+	}
+
+	// Requests need a single answer, and notifications such as $/progress refer to requests, so messages go to the
+	// primary client
+	conn := s.replyConn(ctx)
+	if conn == nil {
+		return nil, fmt.Errorf("no client connection to forward %s to", req.Method)
+	}
+
+	var params interface{}
+	if req.Method == "workspace/applyEdit" {
+		var editParams ApplyWorkspaceEditParams
+		if err := json.Unmarshal(*req.Params, &editParams); err != nil {
+			return nil, err
+		}
+		if err := s.mapWorkspaceEdit(&editParams.Edit); err != nil {
+			slog.Warn("refusing edit from lua-ls", "label", editParams.Label, "error", err)
+			return ApplyWorkspaceEditResult{Applied: false, FailureReason: err.Error()}, nil
+		}
+		params = editParams
+	} else if req.Params != nil {
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+		params = s.mapShadowURIs(params)
+	}
+
+	slog.Debug("forwarding message from lua-ls to client", "method", req.Method, "notification", req.Notif)
+	if req.Notif {
+		return nil, conn.Notify(ctx, req.Method, params)
+	}
+
+	var result interface{}
+	if err := conn.Call(ctx, req.Method, params, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// mapShadowURIs rewrites every shadow URI in a JSON value from lua-language-server to the URI the client knows
+//
+// Shadow documents are mapped to their markdown documents, the shadow root to the client's workspace root, and any
+// other URI under the shadow root to the path it mirrors. URIs are mapped as keys as well as values.
+func (s *Server) mapShadowURIs(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		mapped := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			// URIs are keys of some values, such as the changes of a WorkspaceEdit
+			if uri, ok := s.clientURI(key); ok {
+				key = uri
+			}
+			mapped[key] = s.mapShadowURIs(value)
+		}
+		return mapped
+	case []interface{}:
+		for i, value := range v {
+			v[i] = s.mapShadowURIs(value)
+		}
+		return v
+	case string:
+		if uri, ok := s.clientURI(v); ok {
+			return uri
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// clientURI returns the URI the client knows for a URI under the shadow root, or false for any other string
+func (s *Server) clientURI(shadowURI string) (string, bool) {
+	rootURI := s.docService.PathToURI(s.docService.ShadowRoot())
+	if !strings.HasPrefix(shadowURI, rootURI) {
+		return "", false
+	}
+
+	if originalURI, exists := s.getShadowToOriginalURI(shadowURI); exists {
+		return originalURI, true
+	}
+
+	rest := strings.TrimPrefix(shadowURI, rootURI)
+	switch {
+	case rest == "" || rest == "/":
+		if s.workspaceRoot == "" {
+			return "", false
+		}
+		return s.docService.PathToURI(s.workspaceRoot), true
+	case strings.HasPrefix(rest, "/"):
+		return s.docService.PathToURI(rest), true
+	default:
+		// A sibling of the shadow root sharing its prefix
+		return "", false
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/stretchr/testify/require"
+)
+
+// clientRecorder is a client keeping the messages it receives, replying to workspace/configuration
+// and workspace/applyEdit requests
+type clientRecorder struct {
+	mu       sync.Mutex
+	messages map[string][]json.RawMessage
+}
+
+func (c *clientRecorder) handle(_ context.Context, _ *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.messages == nil {
+		c.messages = make(map[string][]json.RawMessage)
+	}
+	var params json.RawMessage
+	if req.Params != nil {
+		params = *req.Params
+	}
+	c.messages[req.Method] = append(c.messages[req.Method], params)
+
+	switch req.Method {
+	case "workspace/configuration":
+		var config ConfigurationParams
+		if err := json.Unmarshal(params, &config); err != nil {
+			return nil, err
+		}
+		results := make([]interface{}, len(config.Items))
+		for i := range results {
+			results[i] = map[string]interface{}{"runtime": map[string]interface{}{"version": "LuaJIT"}}
+		}
+		return results, nil
+	case "workspace/applyEdit":
+		return ApplyWorkspaceEditResult{Applied: true}, nil
+	}
+	return nil, nil
+}
+
+func (c *clientRecorder) received(method string) []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.messages[method]
+}
+
+func TestForwardToClient(t *testing.T) {
+	recorder := &clientRecorder{}
+	s, fake, client := newTestServerWithClient(t, jsonrpc2.HandlerWithError(recorder.handle))
+	ctx := context.Background()
+
+	workspace := t.TempDir()
+	var initResult map[string]interface{}
+	initParams := lsp.InitializeParams{RootURI: lsp.DocumentURI("file://" + workspace)}
+	initParams.Capabilities.Workspace.Configuration = true
+	require.NoError(t, client.Call(ctx, "initialize", initParams, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(workspace, "init.litlua.md"))
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: "# Config\n\n```lua\nlocal x = 1\n```\n"},
+	}))
+
+	var shadowURI string
+	require.Eventually(t, func() bool {
+		var exists bool
+		shadowURI, exists = s.docService.ShadowURI(string(uri))
+		return exists
+	}, time.Second, 10*time.Millisecond)
+	shadowRootURI := "file://" + s.docService.ShadowRoot()
+
+	t.Run("test notifications are forwarded", func(t *testing.T) {
+		require.NoError(t, fake.conn.Notify(ctx, "window/logMessage", lsp.LogMessageParams{Type: lsp.Info, Message: "loading"}))
+		require.NoError(t, fake.conn.Notify(ctx, "$/progress", map[string]interface{}{
+			"token": "load",
+			"value": map[string]interface{}{"kind": "begin", "title": "Loading workspace"},
+		}))
+
+		require.Eventually(t, func() bool {
+			return len(recorder.received("window/logMessage")) == 1 && len(recorder.received("$/progress")) == 1
+		}, time.Second, 10*time.Millisecond)
+		require.JSONEq(t, `{"type":3,"message":"loading"}`, string(recorder.received("window/logMessage")[0]))
+	})
+
+	t.Run("test requests are answered by the client with mapped URIs", func(t *testing.T) {
+		var result []map[string]interface{}
+		err := fake.conn.Call(ctx, "workspace/configuration", map[string]interface{}{
+			"items": []map[string]interface{}{
+				{"scopeUri": shadowURI, "section": "Lua"},
+				{"scopeUri": shadowRootURI, "section": "Lua"},
+				{"scopeUri": shadowRootURI + workspace, "section": "Lua"},
+			},
+		}, &result)
+		require.NoError(t, err)
+		require.Len(t, result, 3)
+		require.Equal(t, map[string]interface{}{"runtime": map[string]interface{}{"version": "LuaJIT"}}, result[0])
+
+		require.Len(t, recorder.received("workspace/configuration"), 1)
+		require.JSONEq(t, `{"items":[
+			{"scopeUri":"`+string(uri)+`","section":"Lua"},
+			{"scopeUri":"file://`+workspace+`","section":"Lua"},
+			{"scopeUri":"file://`+workspace+`","section":"Lua"}
+		]}`, string(recorder.received("workspace/configuration")[0]))
+	})
+
+	t.Run("test edits are mapped to the document", func(t *testing.T) {
+		var result ApplyWorkspaceEditResult
+		err := fake.conn.Call(ctx, "workspace/applyEdit", ApplyWorkspaceEditParams{
+			Edit: WorkspaceEdit{Changes: map[string][]lsp.TextEdit{
+				shadowURI: {{Range: lsp.Range{Start: lsp.Position{Line: 3, Character: 6}, End: lsp.Position{Line: 3, Character: 7}}, NewText: "y"}},
+			}},
+		}, &result)
+		require.NoError(t, err)
+		require.True(t, result.Applied)
+
+		require.Len(t, recorder.received("workspace/applyEdit"), 1)
+		var params ApplyWorkspaceEditParams
+		require.NoError(t, json.Unmarshal(recorder.received("workspace/applyEdit")[0], &params))
+		require.Contains(t, params.Edit.Changes, string(uri))
+	})
+
+	t.Run("test edits outside of code blocks are refused", func(t *testing.T) {
+		var result ApplyWorkspaceEditResult
+		err := fake.conn.Call(ctx, "workspace/applyEdit", ApplyWorkspaceEditParams{
+			Edit: WorkspaceEdit{Changes: map[string][]lsp.TextEdit{
+				shadowURI: {{Range: lsp.Range{Start: lsp.Position{Line: 0}, End: lsp.Position{Line: 0, Character: 1}}, NewText: "--"}},
+			}},
+		}, &result)
+		require.NoError(t, err)
+		require.False(t, result.Applied)
+		require.Contains(t, result.FailureReason, "outside of a lua code block")
+
+		// The client is never asked
+		require.Len(t, recorder.received("workspace/applyEdit"), 1)
+	})
+}
+
+func TestClientURI(t *testing.T) {
+	s, _, _ := newTestServer(t)
+	workspace := t.TempDir()
+	s.workspaceRoot = workspace
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(workspace, "init.litlua.md"))
+	s.docService.OpenDocument(uri, 1, "```lua\nlocal x = 1\n```\n")
+	shadow, err := s.docService.TransformShadowDoc(uri)
+	require.NoError(t, err)
+	root := "file://" + s.docService.ShadowRoot()
+
+	tests := []struct {
+		name   string
+		uri    string
+		want   string
+		wantOk bool
+	}{
+		{
+			name:   "test shadow document",
+			uri:    shadow.URI,
+			want:   string(uri),
+			wantOk: true,
+		},
+		{
+			name:   "test shadow root",
+			uri:    root,
+			want:   "file://" + workspace,
+			wantOk: true,
+		},
+		{
+			name:   "test directory under the shadow root",
+			uri:    root + workspace + "/lua",
+			want:   "file://" + workspace + "/lua",
+			wantOk: true,
+		},
+		{
+			name:   "test plain lua file mirrored from the workspace",
+			uri:    root + workspace + "/lua/util.lua",
+			want:   "file://" + workspace + "/lua/util.lua",
+			wantOk: true,
+		},
+		{
+			name: "test uri outside of the shadow root",
+			uri:  "file:///usr/share/lua/5.1/foo.lua",
+		},
+		{
+			name: "test sibling of the shadow root",
+			uri:  root + "-other/file.lua",
+		},
+		{
+			name: "test string that isn't a uri",
+			uri:  "Lua.runtime.version",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := s.clientURI(tc.uri)
+			require.Equal(t, tc.wantOk, ok)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
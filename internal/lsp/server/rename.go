@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/jwtly10/litlua"
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// WorkspaceEdit is an implementation of the WorkspaceEdit LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#workspaceEdit
+//
+// https://github.com/sourcegraph/go-lsp does not support documentChanges, which lua-language-server
+// returns when the client supports them
+type WorkspaceEdit struct {
+	Changes         map[string][]lsp.TextEdit `json:"changes,omitempty"`
+	DocumentChanges []TextDocumentEdit        `json:"documentChanges,omitempty"`
+}
+
+// TextDocumentEdit is an implementation of the TextDocumentEdit LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#textDocumentEdit
+type TextDocumentEdit struct {
+	TextDocument lsp.VersionedTextDocumentIdentifier `json:"textDocument"`
+	Edits        []lsp.TextEdit                      `json:"edits"`
+}
+
+// rename renames a symbol through lua-language-server, mapping the edits back to the markdown documents
+//
+// The rename is rejected if any edit can not be mapped, see [Server.mapWorkspaceEdit], as applying part
+// of a rename would leave the code broken, or if the document changes during the rename.
+func (s *Server) rename(ctx context.Context, params lsp.RenameParams) (*WorkspaceEdit, error) {
+	uri := params.TextDocument.URI
+	shadow, synced := s.syncedShadow(uri)
+	if !synced {
+		return nil, fmt.Errorf("no shadow file synced for %s", uri)
+	}
+
+	params.Position = s.indentsOf(string(uri)).toShadow(params.Position)
+	params.TextDocument.URI = lsp.DocumentURI(shadow.URI)
+	result, err := s.LuaLS.ForwardRequest(ctx, "textDocument/rename", params)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var edit WorkspaceEdit
+	if err := json.Unmarshal(resultBytes, &edit); err != nil {
+		slog.Debug("received rename response that we could not parse", "result", result)
+		return nil, fmt.Errorf("unable to parse rename response: %w", err)
+	}
+
+	if s.shadowChanged(uri, shadow.Version) {
+		return nil, fmt.Errorf("rename rejected: %s changed during the rename", uri)
+	}
+	if err := s.mapWorkspaceEdit(&edit); err != nil {
+		return nil, fmt.Errorf("rename rejected: %w", err)
+	}
+
+	return &edit, nil
+}
+
+// mapWorkspaceEdit maps an edit from lua-language-server to the markdown documents of its shadow files
+//
+// Returns an error if any edit falls outside of a Lua code block, or outside of the workspace
+func (s *Server) mapWorkspaceEdit(edit *WorkspaceEdit) error {
+	changes := make(map[string][]lsp.TextEdit, len(edit.Changes))
+	for uri, edits := range edit.Changes {
+		originalURI, err := s.checkShadowEdits(uri, edits)
+		if err != nil {
+			return err
+		}
+		changes[originalURI] = s.indentsOf(originalURI).editsToMarkdown(edits)
+	}
+	if edit.Changes != nil {
+		edit.Changes = changes
+	}
+
+	for i := range edit.DocumentChanges {
+		originalURI, err := s.checkShadowEdits(string(edit.DocumentChanges[i].TextDocument.URI), edit.DocumentChanges[i].Edits)
+		if err != nil {
+			return err
+		}
+		edit.DocumentChanges[i].TextDocument.URI = lsp.DocumentURI(originalURI)
+		edit.DocumentChanges[i].Edits = s.indentsOf(originalURI).editsToMarkdown(edit.DocumentChanges[i].Edits)
+	}
+
+	return nil
+}
+
+// checkShadowEdits checks the edits of a shadow file are all within Lua code blocks of its markdown document,
+// returning the original URI of the document
+//
+// Edits of plain Lua files in the workspace are kept as they are, with the URI mapped back from their mirror.
+func (s *Server) checkShadowEdits(shadowURI string, edits []lsp.TextEdit) (string, error) {
+	originalURI, exists := s.clientURI(shadowURI)
+	if !exists {
+		return "", fmt.Errorf("%s is not in the workspace", shadowURI)
+	}
+	if iLsp.IsPlainLuaDocument(lsp.DocumentURI(originalURI)) {
+		return originalURI, nil
+	}
+
+	blocks, err := s.docService.CodeBlocks(originalURI)
+	if err != nil {
+		return "", fmt.Errorf("unable to check edits of %s: %w", originalURI, err)
+	}
+
+	if err := editsInCodeBlocks(edits, blocks); err != nil {
+		return "", fmt.Errorf("edit of %s outside of a lua code block: %w", originalURI, err)
+	}
+
+	return originalURI, nil
+}
+
+// editsInCodeBlocks returns an error if any edit is not within the code lines of a single block
+func editsInCodeBlocks(edits []lsp.TextEdit, blocks []litlua.CodeBlock) error {
+	for _, edit := range edits {
+		inBlock := false
+		for _, block := range blocks {
+			// Blocks are 1-indexed from the first line of code to the closing fence, LSP lines are 0-indexed
+			first, last := block.Position.StartLine-1, block.Position.EndLine-2
+			if edit.Range.Start.Line >= first && edit.Range.End.Line <= last {
+				inBlock = true
+				break
+			}
+		}
+
+		if !inBlock {
+			return fmt.Errorf("line %d", edit.Range.Start.Line+1)
+		}
+	}
+
+	return nil
+}
+
+// references finds references through lua-language-server, mapping locations in shadow files back to
+// their markdown documents
+func (s *Server) references(ctx context.Context, params lsp.ReferenceParams) ([]lsp.Location, error) {
+	shadowURI, exists := s.docService.ShadowURI(string(params.TextDocument.URI))
+	if !exists {
+		return nil, fmt.Errorf("no shadow file found for %s", params.TextDocument.URI)
+	}
+
+	params.Position = s.indentsOf(string(params.TextDocument.URI)).toShadow(params.Position)
+	params.TextDocument.URI = lsp.DocumentURI(shadowURI)
+	result, err := s.LuaLS.ForwardRequest(ctx, "textDocument/references", params)
+	if err != nil {
+		return nil, err
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []lsp.Location
+	if err := json.Unmarshal(resultBytes, &locations); err != nil {
+		slog.Debug("received references response that we could not parse", "result", result)
+		return nil, fmt.Errorf("unable to parse references response: %w", err)
+	}
+
+	for i := range locations {
+		// References in lua files outside of the shadow root (e.g. libraries) are kept as they are
+		if originalURI, exists := s.clientURI(string(locations[i].URI)); exists {
+			locations[i].URI = lsp.DocumentURI(originalURI)
+			locations[i].Range = s.indentsOf(originalURI).rangeToMarkdown(locations[i].Range)
+		}
+	}
+
+	return locations, nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditsInCodeBlocks(t *testing.T) {
+	// Code on markdown lines 3-4 and 9, with closing fences on lines 5 and 10
+	blocks := []litlua.CodeBlock{
+		{Position: litlua.Position{StartLine: 3, EndLine: 5}},
+		{Position: litlua.Position{StartLine: 9, EndLine: 10}},
+	}
+
+	edit := func(start, end int) lsp.TextEdit {
+		return lsp.TextEdit{
+			Range:   lsp.Range{Start: lsp.Position{Line: start, Character: 6}, End: lsp.Position{Line: end, Character: 9}},
+			NewText: "renamed",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		edits   []lsp.TextEdit
+		wantErr string
+	}{
+		{
+			name:  "test edits within blocks",
+			edits: []lsp.TextEdit{edit(2, 2), edit(3, 3), edit(8, 8)},
+		},
+		{
+			name:    "test edit on an opening fence",
+			edits:   []lsp.TextEdit{edit(2, 2), edit(1, 1)},
+			wantErr: "line 2",
+		},
+		{
+			name:    "test edit on a closing fence",
+			edits:   []lsp.TextEdit{edit(4, 4)},
+			wantErr: "line 5",
+		},
+		{
+			name:    "test edit in prose",
+			edits:   []lsp.TextEdit{edit(6, 6)},
+			wantErr: "line 7",
+		},
+		{
+			name:    "test edit spanning blocks",
+			edits:   []lsp.TextEdit{edit(3, 8)},
+			wantErr: "line 4",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := editsInCodeBlocks(tc.edits, blocks)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRenameIndentedBlock(t *testing.T) {
+	s, fake, client := newTestServer(t)
+	ctx := context.Background()
+
+	var initResult map[string]interface{}
+	require.NoError(t, client.Call(ctx, "initialize", lsp.InitializeParams{}, &initResult))
+
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	text := "# Config\n\n- Setup\n\n  ```lua\n  local count = 1\n  print(count)\n  ```\n"
+	require.NoError(t, client.Notify(ctx, "textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{URI: uri, LanguageID: "markdown", Version: 1, Text: text},
+	}))
+	require.Eventually(t, func() bool {
+		shadowURI, exists := s.docService.ShadowURI(string(uri))
+		return exists && fake.text(shadowURI) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	// The position of count in the markdown is after the indent of the fence
+	var edit WorkspaceEdit
+	require.NoError(t, client.Call(ctx, "textDocument/rename", lsp.RenameParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: uri},
+		Position:     lsp.Position{Line: 5, Character: 8},
+		NewName:      "total",
+	}, &edit))
+
+	require.Equal(t, map[string][]lsp.TextEdit{
+		string(uri): {
+			{Range: lsp.Range{Start: lsp.Position{Line: 5, Character: 8}, End: lsp.Position{Line: 5, Character: 13}}, NewText: "total"},
+			{Range: lsp.Range{Start: lsp.Position{Line: 6, Character: 8}, End: lsp.Position{Line: 6, Character: 13}}, NewText: "total"},
+		},
+	}, edit.Changes)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sourcegraph/go-lsp"
+)
+
+// SemanticTokens is an implementation of the SemanticTokens LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#semanticTokens
+type SemanticTokens struct {
+	ResultID string   `json:"resultId,omitempty"`
+	Data     []uint32 `json:"data"`
+}
+
+// SemanticTokensParams are the params of both semanticTokens/full and semanticTokens/range requests
+type SemanticTokensParams struct {
+	TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	// Only set for semanticTokens/range
+	Range *lsp.Range `json:"range,omitempty"`
+}
+
+// semanticTokens gets the semantic tokens of the shadow file from lua-language-server, keeping only
+// the tokens on lines of Lua code blocks
+//
+// Shadow files keep the line numbers of the markdown, so tokens only need their character shifted
+// by the indentation of their block, see [blockIndents].
+func (s *Server) semanticTokens(ctx context.Context, method string, params SemanticTokensParams) (*SemanticTokens, error) {
+	uri := params.TextDocument.URI
+	text, exists := s.docService.DocumentText(string(uri))
+	if !exists {
+		return nil, fmt.Errorf("no document found for %s", uri)
+	}
+
+	shadowURI, exists := s.docService.ShadowURI(string(uri))
+	if !exists {
+		return nil, fmt.Errorf("no shadow file found for %s", uri)
+	}
+
+	blocks, err := s.docService.CodeBlocks(string(uri))
+	if err != nil {
+		return nil, err
+	}
+	indents := newBlockIndents(blocks, text)
+
+	params.TextDocument.URI = lsp.DocumentURI(shadowURI)
+	if params.Range != nil {
+		r := indents.rangeToShadow(*params.Range)
+		params.Range = &r
+	}
+	result, err := s.LuaLS.ForwardRequest(ctx, method, params)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens SemanticTokens
+	if err := json.Unmarshal(resultBytes, &tokens); err != nil {
+		return nil, fmt.Errorf("unable to parse semantic tokens response: %w", err)
+	}
+
+	// Deltas are not supported, so the result id is dropped
+	return &SemanticTokens{
+		Data: filterSemanticTokens(tokens.Data, indents),
+	}, nil
+}
+
+// filterSemanticTokens keeps the tokens on the code lines of the indents, mapping each to the markdown
+//
+// Tokens are encoded as 5 integers, with the line and start character relative to the previous token.
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#tokenFormat
+func filterSemanticTokens(data []uint32, indents blockIndents) []uint32 {
+	filtered := []uint32{}
+
+	var line, char uint32
+	var prevLine, prevChar uint32
+	for i := 0; i+4 < len(data); i += 5 {
+		if data[i] > 0 {
+			char = 0
+		}
+		line += data[i]
+		char += data[i+1]
+
+		if !indents.isCodeLine(int(line)) {
+			continue
+		}
+		start := uint32(indents.toMarkdown(lsp.Position{Line: int(line), Character: int(char)}).Character)
+
+		deltaChar := start
+		if line == prevLine {
+			deltaChar = start - prevChar
+		}
+		filtered = append(filtered, line-prevLine, deltaChar, data[i+2], data[i+3], data[i+4])
+		prevLine, prevChar = line, start
+	}
+
+	return filtered
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterSemanticTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []uint32
+		indents blockIndents
+		want    []uint32
+	}{
+		{
+			name: "test tokens on code lines are kept",
+			// line 2 char 6, line 2 char 10, line 4 char 0
+			data:    []uint32{2, 6, 1, 0, 0, 0, 4, 1, 1, 0, 2, 0, 5, 2, 1},
+			indents: blockIndents{2: "", 4: ""},
+			want:    []uint32{2, 6, 1, 0, 0, 0, 4, 1, 1, 0, 2, 0, 5, 2, 1},
+		},
+		{
+			name: "test tokens outside of code lines are dropped",
+			// line 1 char 3, line 2 char 6, line 3 char 1, line 5 char 2
+			data:    []uint32{1, 3, 1, 0, 0, 1, 6, 1, 0, 0, 1, 1, 1, 0, 0, 2, 2, 1, 0, 0},
+			indents: blockIndents{2: "", 5: ""},
+			want:    []uint32{2, 6, 1, 0, 0, 3, 2, 1, 0, 0},
+		},
+		{
+			name: "test tokens are shifted by the indentation of their block",
+			// line 6 char 6, line 6 char 10
+			data:    []uint32{6, 6, 1, 0, 0, 0, 4, 1, 0, 0},
+			indents: blockIndents{6: "  "},
+			want:    []uint32{6, 8, 1, 0, 0, 0, 4, 1, 0, 0},
+		},
+		{
+			name:    "test no tokens",
+			data:    nil,
+			indents: blockIndents{2: ""},
+			want:    []uint32{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, filterSemanticTokens(tc.data, tc.indents))
+		})
+	}
+}
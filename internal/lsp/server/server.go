@@ -3,9 +3,12 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +23,14 @@ type Options struct {
 	LuaLsPath string
 	// Custom path to where intermediate LSP shadow files are stored
 	ShadowRoot string
+	// Optional path to a YAML file of variables used when compiling final output
+	VarsFile string
+	// Optional path to a StyLua binary, used to format code blocks instead of lua-language-server
+	StyluaPath string
+	// How long requests to lua-language-server are waited on, DefaultRequestTimeout if zero
+	RequestTimeout time.Duration
+	// Timeouts for requests of specific methods, e.g. a shorter one for textDocument/completion
+	MethodTimeouts map[string]time.Duration
 }
 
 func (o *Options) Validate() error {
@@ -35,6 +46,28 @@ func (o *Options) Validate() error {
 		}
 	}
 
+	if o.VarsFile != "" {
+		if _, err := os.Stat(o.VarsFile); err != nil {
+			return fmt.Errorf("variables file path is invalid: %w", err)
+		}
+	}
+
+	if o.StyluaPath != "" {
+		if _, err := os.Stat(o.StyluaPath); err != nil {
+			return fmt.Errorf("stylua path is invalid: %w", err)
+		}
+	}
+
+	if o.RequestTimeout < 0 {
+		return fmt.Errorf("request timeout must not be negative: %s", o.RequestTimeout)
+	}
+
+	for method, timeout := range o.MethodTimeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout for %s must be positive: %s", method, timeout)
+		}
+	}
+
 	return nil
 }
 
@@ -47,11 +80,29 @@ func (o *Options) OverrideDocOpts(opts *iLsp.DocumentServiceOptions) error {
 		opts.ShadowRoot = o.ShadowRoot
 	}
 
+	if o.VarsFile != "" {
+		opts.FinalTransformerOpts.VarsFile = o.VarsFile
+	}
+
 	return opts.Validate()
 }
 
 type Server struct {
-	conn *jsonrpc2.Conn
+	// The connected clients, in the order they connected
+	clientsMu sync.Mutex
+	clients   []*client
+	// The number of clients each document is open in, its shadow document is closed once none have it open
+	refs map[string]int
+	// The client each open document follows the changes of, nil while it is handed over, see [Server.openDocument]
+	writers map[string]*client
+	// If the server is shared by the clients of a workspace in daemon mode, so a client leaving doesn't stop it
+	shared bool
+	// The result of the first client's initialize request, which later clients are given, and if lua-language-server
+	// has been sent the initialized notification
+	initMu      sync.Mutex
+	initResult  map[string]interface{}
+	initialized bool
+
 	// lua lsp interface
 	LuaLS *LuaLS
 
@@ -64,6 +115,20 @@ type Server struct {
 	// Mutex for the debounceTimer map
 	mu            sync.Mutex
 	debounceTimer map[string]*time.Timer
+	// Serialises syncing documents to lua-language-server, so changes are forwarded in the order of their versions
+	syncMu sync.Mutex
+
+	// latest diagnostics per document, so litlua and lua-ls diagnostics can be published together
+	diagnostics *diagnosticStore
+
+	// Path to a StyLua binary used for formatting, lua-language-server is used if empty
+	styluaPath string
+
+	// The root of the client's workspace, before it is rewritten to the shadow root for lua-language-server
+	workspaceRoot string
+	// The settings last sent by the client with workspace/didChangeConfiguration
+	settingsMu sync.Mutex
+	settings   map[string]interface{}
 }
 
 func NewServer(opts Options) (*Server, error) {
@@ -81,9 +146,11 @@ func NewServer(opts Options) (*Server, error) {
 	s := &Server{
 		docService:    dService,
 		debounceTimer: make(map[string]*time.Timer),
+		diagnostics:   newDiagnosticStore(),
+		styluaPath:    opts.StyluaPath,
 	}
 
-	l, err := NewLuaLs(s, opts.LuaLsPath)
+	l, err := NewLuaLs(s, opts.LuaLsPath, opts.RequestTimeout, opts.MethodTimeouts)
 	if err != nil {
 		return nil, err
 	}
@@ -100,10 +167,76 @@ func (s *Server) Start() error {
 	return nil
 }
 
-func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (result interface{}, err error) {
-	if s.conn == nil {
-		s.conn = conn
+type orderedHandler struct {
+	jsonrpc2.Handler
+	requests *inflightRequests
+}
+
+func (h orderedHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Notif || req.Method == "initialize" {
+		h.Handler.Handle(ctx, conn, req)
+		return
+	}
+
+	// The request is tracked before the next message is read, so a cancellation sent after it always finds it
+	ctx, done := h.requests.start(ctx, req.ID)
+	go func() {
+		defer done()
+		h.Handler.Handle(ctx, conn, req)
+	}()
+}
+
+// codeRequestCancelled is the LSP error code for a request cancelled by the client
+const codeRequestCancelled = -32800
+
+// inflightRequests are the requests from the client being handled, so they can be cancelled with $/cancelRequest
+type inflightRequests struct {
+	mu      sync.Mutex
+	cancels map[jsonrpc2.ID]context.CancelFunc
+}
+
+// start returns the context of a request, which is cancelled if the request is cancelled, and a func to call once it is handled
+func (r *inflightRequests) start(ctx context.Context, id jsonrpc2.ID) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancels == nil {
+		r.cancels = make(map[jsonrpc2.ID]context.CancelFunc)
+	}
+	r.cancels[id] = cancel
+
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels a request being handled, returning false if it isn't, e.g. as it has already been replied to
+func (r *inflightRequests) cancel(id jsonrpc2.ID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancel, exists := r.cancels[id]
+	if exists {
+		cancel()
 	}
+	return exists
+}
+
+// handleCancellable handles a message from the client, replying to a request that failed after it was cancelled
+// with the LSP error for a cancelled request
+func (s *Server) handleCancellable(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+	result, err := s.Handle(ctx, conn, req)
+	if err != nil && !req.Notif && errors.Is(ctx.Err(), context.Canceled) {
+		return nil, &jsonrpc2.Error{Code: codeRequestCancelled, Message: fmt.Sprintf("%s request cancelled", req.Method)}
+	}
+	return result, err
+}
+
+func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (result interface{}, err error) {
 	slog.Info("received request", "method", req.Method, "id", req.ID)
 
 	reqCount, _ := s.trackRequestCount.LoadOrStore(req.Method, 1)
@@ -111,6 +244,17 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		s.trackRequestCount.Store(req.Method, count+1)
 	}
 
+	// Plain Lua files are synced unchanged, so requests about them need no mapping beyond their URI. Renames are
+	// still checked, as they may edit litlua documents.
+	switch req.Method {
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose", "textDocument/didSave",
+		"textDocument/rename":
+	default:
+		if result, handled, err := s.forwardPlainDocument(ctx, req); handled {
+			return result, err
+		}
+	}
+
 	switch req.Method {
 	case "initialize":
 		slog.Info("initializing lsp server")
@@ -120,20 +264,68 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 			return nil, err
 		}
 
+		c := clientFrom(ctx)
+		c.hierarchicalSymbols = initParams.Capabilities.TextDocument.DocumentSymbol.HierarchicalDocumentSymbolSupport
+		c.configuration = initParams.Capabilities.Workspace.Configuration
+
+		s.initMu.Lock()
+		defer s.initMu.Unlock()
+		if s.initResult != nil {
+			// Another client of the workspace has already initialized lua-language-server
+			slog.Info("client joined initialized workspace", "root", s.workspaceRoot)
+			return s.initResult, nil
+		}
+
+		s.workspaceRoot = workspaceRootOf(initParams)
+
+		// The daemon gives each workspace its own shadow root, otherwise the server has one client, which is
+		// given the shadow root of its workspace under the shadow root of the options
+		if !s.shared {
+			shadowRoot, err := workspaceShadowRoot(s.docService.ShadowRoot(), s.workspaceRoot)
+			if err != nil {
+				return nil, err
+			}
+			s.docService.SetWorkspaceShadowRoot(shadowRoot)
+			slog.Info("using workspace shadow root", "root", s.workspaceRoot, "shadow-root", shadowRoot)
+		}
+
+		// lua-language-server sees the shadow root as its workspace, so it is given the config of the client's
+		// workspace there, and always asks litlua-ls for the editor's settings
+		if err := s.syncWorkspaceConfig(); err != nil {
+			slog.Error("failed to sync lua-language-server config", "error", err)
+		}
+		if err := s.linkWorkspace(); err != nil {
+			slog.Warn("failed to link workspace into shadow root, requires of plain lua files won't resolve", "error", err)
+		}
+		initParams.Capabilities.Workspace.Configuration = true
+
 		initParams.RootPath = s.docService.ShadowRoot()
 		initParams.RootURI = lsp.DocumentURI("file://" + s.docService.ShadowRoot())
 
-		result, err := s.LuaLS.ForwardRequest(req.Method, initParams)
+		result, err := s.LuaLS.ForwardRequest(ctx, req.Method, initParams)
 		if err != nil {
 			return nil, err
 		}
 
 		response := result.(map[string]interface{})
 		if caps, ok := response["capabilities"].(map[string]interface{}); ok {
-			caps["textDocumentSync"] = 1 // Full sync
+			caps["textDocumentSync"] = lsp.TDSKIncremental
 			caps["publishDiagnostics"] = true
+			caps["documentSymbolProvider"] = true
+			caps["workspaceSymbolProvider"] = true
+			caps["documentFormattingProvider"] = true
+			caps["documentRangeFormattingProvider"] = true
+			if _, ok := caps["codeActionProvider"]; !ok {
+				caps["codeActionProvider"] = true
+			}
+			mergeCommands(caps)
+			if tokens, ok := caps["semanticTokensProvider"].(map[string]interface{}); ok {
+				// Tokens are filtered to the code blocks, so deltas between results can't be supported
+				tokens["full"] = true
+			}
 		}
 
+		s.initResult = response
 		return response, nil
 
 	case "initialized":
@@ -142,18 +334,29 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, err
 		}
-		return s.LuaLS.ForwardRequest(req.Method, params)
-	case "shutdown":
-		slog.Info("shutting down")
 
-		if err := s.docService.CleanupShadowFiles(); err != nil {
-			slog.Error("failed to remove shadow workspace", "error", err)
+		s.initMu.Lock()
+		defer s.initMu.Unlock()
+		if s.initialized {
+			return nil, nil
+		}
+		s.initialized = true
+		return s.LuaLS.ForwardRequest(ctx, req.Method, params)
+	case "shutdown":
+		if s.shared {
+			// The workspace is shut down by the daemon once its last client disconnects
+			slog.Info("client shutting down")
+			return nil, nil
 		}
 
-		s.printDebugStats()
-
+		slog.Info("shutting down")
+		s.shutdown()
 		return nil, nil
 	case "exit":
+		if s.shared {
+			return nil, conn.Close()
+		}
+
 		slog.Info("exiting")
 
 		os.Exit(0)
@@ -167,44 +370,38 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 			return nil, err
 		}
 
-		if !strings.HasSuffix(string(params.TextDocument.URI), ".litlua.md") {
+		if !strings.HasSuffix(string(params.TextDocument.URI), ".litlua.md") && !iLsp.IsPlainLuaDocument(params.TextDocument.URI) {
 			slog.Info("ignoring non-litlua file", "uri", params.TextDocument.URI)
 			return nil, &jsonrpc2.Error{
 				Code:    jsonrpc2.CodeInvalidRequest,
-				Message: "litlua-ls only supports .litlua.md files",
+				Message: "litlua-ls only supports .litlua.md and .lua files",
 			}
 		}
 
-		shadowURI, err := s.docService.TransformShadowDoc(params.TextDocument.Text, params.TextDocument.URI)
-		if err != nil {
-			return nil, err
+		if !s.openDocument(ctx, params.TextDocument.URI, params.TextDocument.Version, params.TextDocument.Text) {
+			slog.Info("document is written by another client, opening read-only", "uri", params.TextDocument.URI)
+			s.showMessage(ctx, lsp.MTWarning, fmt.Sprintf("litlua: %s is open in another editor, changes made here are "+
+				"ignored until it is closed there", filepath.Base(string(params.TextDocument.URI))))
+			return nil, nil
 		}
 
-		fsPath, err := s.docService.URIToPath(lsp.DocumentURI(shadowURI))
-		if err != nil {
-			return nil, err
-		}
+		s.syncMu.Lock()
+		defer s.syncMu.Unlock()
 
-		content, err := os.ReadFile(fsPath)
-		if err != nil {
+		s.docService.OpenDocument(params.TextDocument.URI, params.TextDocument.Version, params.TextDocument.Text)
+		return s.openShadowDoc(ctx, params.TextDocument.URI)
+	case "textDocument/didChange":
+		var params lsp.DidChangeTextDocumentParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, err
 		}
 
-		newParams := lsp.DidOpenTextDocumentParams{
-			TextDocument: lsp.TextDocumentItem{
-				URI:        lsp.DocumentURI(shadowURI),
-				Text:       string(content),
-				LanguageID: "lua",
-				Version:    params.TextDocument.Version,
-			},
+		if readOnly, err := s.applyReadOnlyChanges(ctx, params.TextDocument.URI, params.TextDocument.Version, params.ContentChanges); readOnly {
+			return nil, err
 		}
 
-		slog.Debug("forwarding didOpen to lua-ls", "params", newParams)
-
-		return s.LuaLS.ForwardRequest("textDocument/didOpen", newParams)
-	case "textDocument/didChange":
-		var params lsp.DidChangeTextDocumentParams
-		if err := json.Unmarshal(*req.Params, &params); err != nil {
+		// Changes are applied as they arrive, as each is relative to the text after the previous one
+		if _, err := s.docService.ApplyChanges(params.TextDocument.URI, params.TextDocument.Version, params.ContentChanges); err != nil {
 			return nil, err
 		}
 
@@ -212,29 +409,42 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		// showed that the didChange event is sent on every character change
 		// so even though neovim does not do this, we handle it just in case
 		// as it can cause the entire LSP (and editor) to hang
-		s.handleDebouncedChange(params)
+		s.handleDebouncedChange(params.TextDocument.URI)
 
 		return nil, nil
-	case "textDocument/didSave":
-		var params lsp.DidSaveTextDocumentParams
+	case "textDocument/didClose":
+		var params lsp.DidCloseTextDocumentParams
 		if err := json.Unmarshal(*req.Params, &params); err != nil {
 			return nil, err
 		}
 
-		// TODO: Add debouncing
-		slog.Info("Compiling final output on save", "uri", params.TextDocument.URI)
+		last, handOver := s.releaseDocument(ctx, params.TextDocument.URI)
+		if last {
+			return nil, s.closeDocument(ctx, params.TextDocument.URI)
+		}
+		if handOver {
+			if err := s.handOverDocument(ctx, params.TextDocument.URI); err != nil {
+				return nil, err
+			}
+		}
+		// Another client still has the document open, so only the diagnostics of this client are cleared
+		return nil, notifyDiagnostics(ctx, conn, params.TextDocument.URI, []lsp.Diagnostic{})
 
-		shadowURI, exists := s.docService.ShadowURI(string(params.TextDocument.URI))
-		if !exists {
-			return nil, fmt.Errorf("no shadow file found for %s", params.TextDocument.URI)
+	case "textDocument/didSave":
+		var params lsp.DidSaveTextDocumentParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
 		}
 
-		originalURI, exists := s.docService.OriginalURI(shadowURI)
-		if !exists {
-			return nil, fmt.Errorf("no original file found for %s", shadowURI)
+		if iLsp.IsPlainLuaDocument(params.TextDocument.URI) {
+			// Plain Lua files have nothing to compile
+			return nil, nil
 		}
 
-		originalPath, err := s.docService.URIToPath(lsp.DocumentURI(originalURI))
+		// TODO: Add debouncing
+		slog.Info("Compiling final output on save", "uri", params.TextDocument.URI)
+
+		originalPath, err := s.docService.URIToPath(params.TextDocument.URI)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get original path: %w", err)
 		}
@@ -246,12 +456,7 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 			return nil, err
 		}
 
-		transformedPath, err := s.docService.TransformFinalDoc(string(content), originalPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to transform final doc: %w", err)
-		}
-
-		slog.Info("Compiled final output", "path", transformedPath)
+		s.showCompileResult(ctx, s.compileDocument(ctx, params.TextDocument.URI, string(content)))
 
 		return nil, nil
 	case "textDocument/definition":
@@ -265,8 +470,10 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 			return nil, fmt.Errorf("no shadow file found for %s", params.TextDocument.URI)
 		}
 
+		indents := s.indentsOf(string(params.TextDocument.URI))
 		params.TextDocument.URI = lsp.DocumentURI(shadowURI)
-		result, err := s.LuaLS.ForwardRequest(req.Method, params)
+		params.Position = indents.toShadow(params.Position)
+		result, err := s.LuaLS.ForwardRequest(ctx, req.Method, params)
 		if err != nil {
 			return nil, err
 		}
@@ -280,9 +487,17 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		if err := json.Unmarshal(resultBytes, &locationLinks); err == nil {
 			for i := range locationLinks {
 				slog.Debug("locations[i].URI", "locations[i].URI", locationLinks[i].TargetURI)
-				originalURI, exists := s.getShadowToOriginalURI(string(locationLinks[i].TargetURI))
+				// Definitions in plain lua files of the workspace are mapped back from their mirror in the shadow root
+				if r := locationLinks[i].OriginSelectionRange; r != nil {
+					mapped := indents.rangeToMarkdown(*r)
+					locationLinks[i].OriginSelectionRange = &mapped
+				}
+				originalURI, exists := s.clientURI(string(locationLinks[i].TargetURI))
 				if exists {
+					targetIndents := s.indentsOf(originalURI)
 					locationLinks[i].TargetURI = lsp.DocumentURI(originalURI)
+					locationLinks[i].TargetRange = targetIndents.rangeToMarkdown(locationLinks[i].TargetRange)
+					locationLinks[i].TargetSelectionRange = targetIndents.rangeToMarkdown(locationLinks[i].TargetSelectionRange)
 				} else {
 					slog.Debug("unable to find original URI for shadow URI", "shadowURI", locationLinks[i].TargetURI)
 				}
@@ -305,8 +520,14 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 			return nil, fmt.Errorf("no shadow file found for %s", params.TextDocument.URI)
 		}
 
+		indents := s.indentsOf(string(params.TextDocument.URI))
 		params.TextDocument.URI = lsp.DocumentURI(shadowURI)
-		return s.LuaLS.ForwardRequest(req.Method, params)
+		params.Position = indents.toShadow(params.Position)
+		result, err := s.LuaLS.ForwardRequest(ctx, req.Method, params)
+		if err != nil {
+			return nil, err
+		}
+		return mapResultRange(result, indents)
 
 	case "textDocument/completion":
 		var params lsp.CompletionParams
@@ -319,73 +540,397 @@ func (s *Server) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 			return nil, fmt.Errorf("no shadow file found for %s", params.TextDocument.URI)
 		}
 
+		indents := s.indentsOf(string(params.TextDocument.URI))
 		params.TextDocument.URI = lsp.DocumentURI(shadowURI)
-		return s.LuaLS.ForwardRequest(req.Method, params)
+		params.Position = indents.toShadow(params.Position)
+		result, err := s.LuaLS.ForwardRequest(ctx, req.Method, params)
+		if err != nil {
+			return nil, err
+		}
+		return mapCompletionEdits(result, indents)
+
+	case "textDocument/rename":
+		var params lsp.RenameParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.rename(ctx, params)
+
+	case "textDocument/prepareRename":
+		var params lsp.TextDocumentPositionParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		shadowURI, exists := s.docService.ShadowURI(string(params.TextDocument.URI))
+		if !exists {
+			return nil, fmt.Errorf("no shadow file found for %s", params.TextDocument.URI)
+		}
+
+		indents := s.indentsOf(string(params.TextDocument.URI))
+		params.TextDocument.URI = lsp.DocumentURI(shadowURI)
+		params.Position = indents.toShadow(params.Position)
+		result, err := s.LuaLS.ForwardRequest(ctx, req.Method, params)
+		if err != nil {
+			return nil, err
+		}
+		return mapResultRange(result, indents)
+
+	case "textDocument/references":
+		var params lsp.ReferenceParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.references(ctx, params)
+
+	case "textDocument/formatting":
+		var params lsp.DocumentFormattingParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.formatDocument(ctx, params.TextDocument.URI, nil, params.Options)
+
+	case "textDocument/rangeFormatting":
+		var params lsp.DocumentRangeFormattingParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.formatDocument(ctx, params.TextDocument.URI, &params.Range, params.Options)
+
+	case "textDocument/codeAction":
+		var params lsp.CodeActionParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.codeActions(ctx, params)
+
+	case "textDocument/semanticTokens/full", "textDocument/semanticTokens/range":
+		var params SemanticTokensParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.semanticTokens(ctx, req.Method, params)
+
+	case "litlua/compile":
+		var params CompileParams
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.compile(ctx, params)
+
+	case "workspace/didChangeConfiguration":
+		var params lsp.DidChangeConfigurationParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.LuaLS.ForwardRequest(ctx, req.Method, s.didChangeConfiguration(params))
+
+	case "workspace/executeCommand":
+		var params ExecuteCommandParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		result, handled, err := s.executeCommand(ctx, params)
+		if handled {
+			return result, err
+		}
+
+		return s.LuaLS.ForwardRequest(ctx, req.Method, params.ExecuteCommandParams)
+
+	case "textDocument/documentSymbol":
+		var params lsp.DocumentSymbolParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.documentSymbols(ctx, params.TextDocument.URI)
+
+	case "workspace/symbol":
+		var params lsp.WorkspaceSymbolParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		return s.workspaceSymbols(ctx, params)
+
+	case "$/cancelRequest":
+		var params lsp.CancelParams
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			return nil, err
+		}
+
+		id := jsonrpc2.ID{Num: params.ID.Num, Str: params.ID.Str, IsString: params.ID.IsString}
+		if !clientFrom(ctx).requests.cancel(id) {
+			slog.Debug("ignoring cancellation of a request not in progress", "id", id)
+		}
+		return nil, nil
 
 	// There are some methods we want to ignore, as they are not implemented
 	// and cause overheard when proxying to the lua-language-server
-	case "$/cancelRequest", "textDocument/documentHighlight", "textDocument/documentSymbol", "textDocument/foldingRange",
-		"textDocument/documentColor", "textDocument/codeLens", "textDocument/codeAction", "textDocument/semanticTokens/range",
-		"textDocument/semanticTokens/full", "$/setTrace":
+	case "textDocument/documentHighlight", "textDocument/foldingRange",
+		"textDocument/documentColor", "textDocument/codeLens", "$/setTrace":
 		return nil, nil
 	// Anything else is not specifically implemented through LitLua.
 	// We just proxy the request to the lua-language-server and accept partial support
 	// for anything undocumented as supported
 	default:
 		//slog.Warn("unknown method", "method", req.Method)
-		return s.LuaLS.ForwardRequest(req.Method, req.Params)
+		return s.LuaLS.ForwardRequest(ctx, req.Method, req.Params)
 	}
 
 }
 
-func (s *Server) handleDebouncedChange(params lsp.DidChangeTextDocumentParams) {
-	uri := string(params.TextDocument.URI)
+// workspaceRootOf returns the root of the client's workspace from its initialize request, or "" if it has none
+func workspaceRootOf(params lsp.InitializeParams) string {
+	root := params.RootPath
+	if params.RootURI != "" {
+		if u, err := url.Parse(string(params.RootURI)); err == nil {
+			root = u.Path
+		}
+	}
+	return root
+}
+
+// shutdown stops lua-language-server once the server has no more clients
+func (s *Server) shutdown() {
+	if err := s.docService.CleanupShadowFiles(); err != nil {
+		slog.Error("failed to remove shadow workspace", "error", err)
+	}
+
+	s.printDebugStats()
+
+	// lua-language-server exiting from here on is expected, so it isn't restarted
+	s.LuaLS.Stop()
+}
+
+func (s *Server) handleDebouncedChange(documentURI lsp.DocumentURI) {
+	uri := string(documentURI)
 
 	s.mu.Lock()
 	if timer, exists := s.debounceTimer[uri]; exists {
 		timer.Stop()
 	}
 
-	s.debounceTimer[uri] = time.AfterFunc(200*time.Millisecond, func() {
-		if len(params.ContentChanges) > 0 {
-			newContent := params.ContentChanges[0].Text
+	var timer *time.Timer
+	timer = time.AfterFunc(200*time.Millisecond, func() {
+		// Fired timers are forgotten, so the map only holds documents with changes waiting
+		s.mu.Lock()
+		if s.debounceTimer[uri] == timer {
+			delete(s.debounceTimer, uri)
+		}
+		s.mu.Unlock()
 
-			shadowURI, err := s.docService.TransformShadowDoc(newContent, params.TextDocument.URI)
-			if err != nil {
-				slog.Error("failed to transform shadow doc", "error", err)
-				return
-			}
+		s.syncShadowDoc(documentURI)
+	})
+	s.debounceTimer[uri] = timer
+	s.mu.Unlock()
+}
 
-			fsPath, err := s.docService.URIToPath(lsp.DocumentURI(shadowURI))
-			if err != nil {
-				slog.Error("failed to get fs path", "error", err)
-				return
-			}
+// cancelDebouncedChange stops the debounced sync of a document waiting to run, if any
+func (s *Server) cancelDebouncedChange(uri string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, exists := s.debounceTimer[uri]; exists {
+		timer.Stop()
+		delete(s.debounceTimer, uri)
+	}
+}
 
-			content, err := os.ReadFile(fsPath)
-			if err != nil {
-				slog.Error("failed to read shadow file", "error", err)
-				return
-			}
+// closeDocument stops syncing a closed document, closing its shadow document in lua-language-server
+// and forgetting everything kept for it
+func (s *Server) closeDocument(ctx context.Context, documentURI lsp.DocumentURI) error {
+	uri := string(documentURI)
+	s.cancelDebouncedChange(uri)
 
-			newParams := lsp.DidChangeTextDocumentParams{
-				TextDocument: params.TextDocument,
-				ContentChanges: []lsp.TextDocumentContentChangeEvent{
-					{
-						Text: string(content),
-					},
-				},
-			}
-			newParams.TextDocument.URI = lsp.DocumentURI(shadowURI)
+	// Wait for any sync in progress, so the shadow document is not changed after it is closed
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	shadowURI, transformed := s.docService.CloseDocument(documentURI)
+
+	// The editor keeps the diagnostics of a closed document until they are replaced
+	s.diagnostics.remove(uri)
+	if err := s.publishDiagnostics(ctx, documentURI, []lsp.Diagnostic{}); err != nil {
+		slog.Error("failed to clear diagnostics", "uri", uri, "error", err)
+	}
+
+	if !transformed {
+		return nil
+	}
+
+	_, err := s.LuaLS.ForwardRequest(ctx, "textDocument/didClose", lsp.DidCloseTextDocumentParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(shadowURI)},
+	})
+	return err
+}
+
+// openShadowDoc transforms a document just opened, publishing its diagnostics, and opens its shadow document in
+// lua-language-server, must hold syncMu
+func (s *Server) openShadowDoc(ctx context.Context, documentURI lsp.DocumentURI) (interface{}, error) {
+	shadow, transformErr := s.docService.TransformShadowDoc(documentURI)
+	if errors.Is(transformErr, iLsp.ErrStaleDocument) {
+		// The document changed before it was synced, so it is opened by the next sync
+		return nil, nil
+	}
+	if !iLsp.IsPlainLuaDocument(documentURI) {
+		if err := s.publishDocumentDiagnostics(ctx, documentURI, shadow.Source, transformErr); err != nil {
+			slog.Error("failed to publish document diagnostics", "error", err)
+		}
+	}
+	if transformErr != nil {
+		return nil, transformErr
+	}
+
+	newParams := lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:        lsp.DocumentURI(shadow.URI),
+			Text:       shadow.Text,
+			LanguageID: "lua",
+			Version:    shadow.Version,
+		},
+	}
 
-			s.LuaLS.ForwardRequest("textDocument/didChange", newParams)
+	slog.Debug("forwarding didOpen to lua-ls", "params", newParams)
+
+	return s.LuaLS.ForwardRequest(ctx, "textDocument/didOpen", newParams)
+}
+
+// reopenDocuments opens the shadow documents of all open documents in a restarted lua-language-server,
+// as they were last synced
+//
+// Syncs wait until every document is open, so no change is forwarded for a document lua-language-server
+// has not been sent yet.
+func (s *Server) reopenDocuments(forward func(method string, params interface{}) error, done func()) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	for _, shadow := range s.docService.ShadowDocuments() {
+		slog.Debug("reopening shadow document in lua-ls", "uri", shadow.URI, "version", shadow.Version)
+		err := forward("textDocument/didOpen", lsp.DidOpenTextDocumentParams{
+			TextDocument: lsp.TextDocumentItem{
+				URI:        lsp.DocumentURI(shadow.URI),
+				Text:       shadow.Text,
+				LanguageID: "lua",
+				Version:    shadow.Version,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reopen %s: %w", shadow.URI, err)
 		}
+	}
+
+	done()
+	return nil
+}
+
+// syncShadowDoc syncs the latest text of a document to lua-language-server
+//
+// Changes within Lua code are forwarded as incremental changes to the shadow file, otherwise the document
+// is transformed again and the whole shadow file is sent.
+func (s *Server) syncShadowDoc(documentURI lsp.DocumentURI) {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	if changes, ok := s.docService.FlushShadowChanges(documentURI); ok {
+		if len(changes.Changes) == 0 {
+			return
+		}
+
+		slog.Debug("forwarding incremental changes to lua-ls", "uri", changes.URI, "version", changes.Version, "changes", len(changes.Changes))
+		_, err := s.LuaLS.ForwardRequest(context.Background(), "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+			TextDocument: lsp.VersionedTextDocumentIdentifier{
+				TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(changes.URI)},
+				Version:                changes.Version,
+			},
+			ContentChanges: changes.Changes,
+		})
+		s.checkShadowSynced(documentURI, err)
+		return
+	}
+
+	shadow, transformErr := s.docService.TransformShadowDoc(documentURI)
+	if errors.Is(transformErr, iLsp.ErrStaleDocument) || errors.Is(transformErr, iLsp.ErrDocumentNotOpen) {
+		slog.Debug("dropping transform", "uri", documentURI, "version", shadow.Version, "reason", transformErr)
+		return
+	}
+	if err := s.publishDocumentDiagnostics(context.Background(), documentURI, shadow.Source, transformErr); err != nil {
+		slog.Error("failed to publish document diagnostics", "error", err)
+	}
+	if transformErr != nil {
+		slog.Error("failed to transform shadow doc", "error", transformErr)
+		return
+	}
+
+	_, err := s.LuaLS.ForwardRequest(context.Background(), "textDocument/didChange", lsp.DidChangeTextDocumentParams{
+		TextDocument: lsp.VersionedTextDocumentIdentifier{
+			TextDocumentIdentifier: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(shadow.URI)},
+			Version:                shadow.Version,
+		},
+		ContentChanges: []lsp.TextDocumentContentChangeEvent{{Text: shadow.Text}},
 	})
-	s.mu.Unlock()
+	s.checkShadowSynced(documentURI, err)
 }
 
+// checkShadowSynced marks the shadow document of a document to be synced whole next time if forwarding its changes
+// failed, e.g. while lua-language-server restarts, as the changes after it would apply to the wrong text
+func (s *Server) checkShadowSynced(documentURI lsp.DocumentURI, err error) {
+	if err == nil {
+		return
+	}
+	slog.Error("failed to sync shadow doc to lua-ls, it will be synced whole", "uri", documentURI, "error", err)
+	s.docService.ResyncShadow(documentURI)
+}
+
+// syncedShadow syncs the changes of a document waiting for the debounce straight away, returning its shadow document
+// for requests that compute edits from it
+//
+// Returns false if the shadow document could not be synced with the latest text, e.g. the document does not transform.
+func (s *Server) syncedShadow(documentURI lsp.DocumentURI) (iLsp.ShadowDocument, bool) {
+	s.cancelDebouncedChange(string(documentURI))
+	s.syncShadowDoc(documentURI)
+
+	return s.docService.SyncedShadow(string(documentURI))
+}
+
+// shadowChanged returns true if a document changed since its shadow document was synced at version, so edits
+// computed from that version would no longer apply
+func (s *Server) shadowChanged(documentURI lsp.DocumentURI, version int) bool {
+	shadow, synced := s.docService.SyncedShadow(string(documentURI))
+	return !synced || shadow.Version != version
+}
+
+// SendDiagnostics publishes diagnostics from lua-language-server, merged with any litlua diagnostics for the document
 func (s *Server) SendDiagnostics(ctx context.Context, params lsp.PublishDiagnosticsParams) error {
-	return s.conn.Notify(ctx, "textDocument/publishDiagnostics", params)
+	return s.publishDiagnostics(ctx, params.URI, s.diagnostics.setLuaLS(string(params.URI), params.Diagnostics))
+}
+
+// publishDiagnostics publishes the diagnostics of a document to every client, as they share the workspace
+func (s *Server) publishDiagnostics(ctx context.Context, uri lsp.DocumentURI, diags []lsp.Diagnostic) error {
+	conns := s.clientConns()
+	if len(conns) == 0 {
+		return fmt.Errorf("no client connection to publish diagnostics to")
+	}
+
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, notifyDiagnostics(ctx, conn, uri, diags))
+	}
+	return errors.Join(errs...)
+}
+
+func notifyDiagnostics(ctx context.Context, conn *jsonrpc2.Conn, uri lsp.DocumentURI, diags []lsp.Diagnostic) error {
+	return conn.Notify(ctx, "textDocument/publishDiagnostics", lsp.PublishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: diags,
+	})
 }
 
 func (s *Server) getShadowToOriginalURI(shadowURI string) (string, bool) {
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/jwtly10/litlua/internal/lsp"
 	"github.com/stretchr/testify/assert"
@@ -48,6 +49,23 @@ func TestServerOptions(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "valid method timeouts",
+			opts: Options{
+				LuaLsPath:      tempLuaPath,
+				RequestTimeout: 10 * time.Second,
+				MethodTimeouts: map[string]time.Duration{"textDocument/completion": time.Second},
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid method timeout",
+			opts: Options{
+				LuaLsPath:      tempLuaPath,
+				MethodTimeouts: map[string]time.Duration{"textDocument/completion": 0},
+			},
+			expectError: true,
+		},
 		{
 			name:        "empty options - should use defaults",
 			opts:        Options{},
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jwtly10/litlua"
+	iLsp "github.com/jwtly10/litlua/internal/lsp"
+	"github.com/sourcegraph/go-lsp"
+)
+
+// headingSymbolKind is the symbol kind used for markdown headings
+const headingSymbolKind = lsp.SKString
+
+// DocumentSymbol is an implementation of the DocumentSymbol LSP type
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#documentSymbol
+//
+// https://github.com/sourcegraph/go-lsp only supports the flat SymbolInformation type
+type DocumentSymbol struct {
+	Name   string         `json:"name"`
+	Detail string         `json:"detail,omitempty"`
+	Kind   lsp.SymbolKind `json:"kind"`
+
+	// The range enclosing this symbol, including its body
+	Range lsp.Range `json:"range"`
+
+	// The range that should be selected when navigating to this symbol, e.g. the name of a function
+	// Must be contained within Range
+	SelectionRange lsp.Range `json:"selectionRange"`
+
+	Children []DocumentSymbol `json:"children,omitempty"`
+}
+
+// headingNode is a heading in the outline of a document, while the outline is being built
+type headingNode struct {
+	symbol   DocumentSymbol
+	children []*headingNode
+}
+
+// documentSymbols returns the outline of a document, with the lua-language-server symbols of the
+// shadow file nested under the heading their code sits in
+//
+// Shadow files keep the line numbers of the markdown, so symbol ranges need no mapping.
+// Returns []DocumentSymbol if the client supports hierarchical symbols, otherwise []lsp.SymbolInformation.
+func (s *Server) documentSymbols(ctx context.Context, uri lsp.DocumentURI) (interface{}, error) {
+	text, exists := s.docService.DocumentText(string(uri))
+	if !exists {
+		return nil, fmt.Errorf("no document found for %s", uri)
+	}
+
+	shadowURI, exists := s.docService.ShadowURI(string(uri))
+	if !exists {
+		return nil, fmt.Errorf("no shadow file found for %s", uri)
+	}
+
+	headings, err := s.docService.Headings(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse headings: %w", err)
+	}
+	outline := headingOutline(headings, strings.Split(text, "\n"))
+
+	result, err := s.LuaLS.ForwardRequest(ctx, "textDocument/documentSymbol", lsp.DocumentSymbolParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI(shadowURI)},
+	})
+	if err != nil {
+		// The headings are still useful without the Lua symbols
+		slog.Error("failed to get symbols from lua-ls", "error", err)
+		result = nil
+	}
+
+	luaSymbols, luaInfos, err := decodeSymbols(result)
+	if err != nil {
+		return nil, err
+	}
+
+	if clientFrom(ctx).hierarchicalSymbols {
+		for _, info := range luaInfos {
+			luaSymbols = append(luaSymbols, DocumentSymbol{
+				Name:           info.Name,
+				Kind:           info.Kind,
+				Range:          info.Location.Range,
+				SelectionRange: info.Location.Range,
+			})
+		}
+		return nestSymbols(outline, luaSymbols), nil
+	}
+
+	infos := flattenSymbols(outline, uri, "")
+	for _, sym := range luaSymbols {
+		luaInfos = append(luaInfos, flattenSymbols([]DocumentSymbol{sym}, uri, "")...)
+	}
+	for _, info := range luaInfos {
+		info.Location.URI = uri
+		if info.ContainerName == "" {
+			if heading, ok := containingHeading(outline, info.Location.Range.Start.Line); ok {
+				info.ContainerName = heading.Name
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// workspaceSymbols returns the lua-language-server workspace symbols of all open documents,
+// and the headings of all open documents matching the query
+func (s *Server) workspaceSymbols(ctx context.Context, params lsp.WorkspaceSymbolParams) ([]lsp.SymbolInformation, error) {
+	var infos []lsp.SymbolInformation
+
+	result, err := s.LuaLS.ForwardRequest(ctx, "workspace/symbol", params)
+	if err != nil {
+		slog.Error("failed to get workspace symbols from lua-ls", "error", err)
+		result = nil
+	}
+
+	_, luaInfos, err := decodeSymbols(result)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range luaInfos {
+		originalURI, exists := s.clientURI(string(info.Location.URI))
+		if !exists {
+			slog.Debug("dropping workspace symbol outside of the workspace", "uri", info.Location.URI)
+			continue
+		}
+		info.Location.URI = lsp.DocumentURI(originalURI)
+		infos = append(infos, info)
+	}
+
+	query := strings.ToLower(params.Query)
+	for _, uri := range s.docService.OpenDocuments() {
+		if iLsp.IsPlainLuaDocument(lsp.DocumentURI(uri)) {
+			continue
+		}
+		text, _ := s.docService.DocumentText(uri)
+		headings, err := s.docService.Headings(text)
+		if err != nil {
+			slog.Error("failed to parse headings", "uri", uri, "error", err)
+			continue
+		}
+
+		for _, info := range flattenSymbols(headingOutline(headings, strings.Split(text, "\n")), lsp.DocumentURI(uri), "") {
+			if strings.Contains(strings.ToLower(info.Name), query) {
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	return infos, nil
+}
+
+// decodeSymbols decodes a documentSymbol or workspace/symbol response, which is either
+// []DocumentSymbol or []lsp.SymbolInformation
+func decodeSymbols(result interface{}) ([]DocumentSymbol, []lsp.SymbolInformation, error) {
+	if result == nil {
+		return nil, nil, nil
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only SymbolInformation has a location
+	var probe []struct {
+		Location *lsp.Location `json:"location"`
+	}
+	if err := json.Unmarshal(resultBytes, &probe); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse symbol response: %w", err)
+	}
+
+	if len(probe) > 0 && probe[0].Location != nil {
+		var infos []lsp.SymbolInformation
+		if err := json.Unmarshal(resultBytes, &infos); err != nil {
+			return nil, nil, fmt.Errorf("unable to parse symbol response: %w", err)
+		}
+		return nil, infos, nil
+	}
+
+	var symbols []DocumentSymbol
+	if err := json.Unmarshal(resultBytes, &symbols); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse symbol response: %w", err)
+	}
+	return symbols, nil, nil
+}
+
+// headingOutline returns the headings of a document as nested symbols
+//
+// Each heading spans from its line to the next heading of the same or a higher level, or the end of the document.
+func headingOutline(headings []litlua.Heading, lines []string) []DocumentSymbol {
+	end := lsp.Position{Line: len(lines) - 1, Character: len(lines[len(lines)-1])}
+
+	var roots []*headingNode
+	var stack []*headingNode
+	var levels []int
+	for i, h := range headings {
+		line := h.Line - 1 // LSP lines are 0-indexed
+		if line < 0 || line >= len(lines) {
+			continue
+		}
+		node := &headingNode{symbol: DocumentSymbol{
+			Name:   h.Text,
+			Detail: strings.Repeat("#", h.Level),
+			Kind:   headingSymbolKind,
+			Range: lsp.Range{
+				Start: lsp.Position{Line: line},
+				End:   end,
+			},
+			SelectionRange: lsp.Range{
+				Start: lsp.Position{Line: line},
+				End:   lsp.Position{Line: line, Character: len(strings.TrimRight(lines[line], "\r"))},
+			},
+		}}
+
+		for _, next := range headings[i+1:] {
+			if next.Level <= h.Level {
+				node.symbol.Range.End = lsp.Position{Line: next.Line - 1}
+				break
+			}
+		}
+
+		for len(stack) > 0 && levels[len(levels)-1] >= h.Level {
+			stack, levels = stack[:len(stack)-1], levels[:len(levels)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, node)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, node)
+		}
+		stack, levels = append(stack, node), append(levels, h.Level)
+	}
+
+	return buildOutline(roots)
+}
+
+func buildOutline(nodes []*headingNode) []DocumentSymbol {
+	var symbols []DocumentSymbol
+	for _, node := range nodes {
+		sym := node.symbol
+		sym.Children = append(sym.Children, buildOutline(node.children)...)
+		symbols = append(symbols, sym)
+	}
+	return symbols
+}
+
+// nestSymbols nests each symbol under the deepest heading of the outline its range starts in
+//
+// Symbols before the first heading are kept at the top level. Children are sorted by position.
+func nestSymbols(outline []DocumentSymbol, symbols []DocumentSymbol) []DocumentSymbol {
+	nested := slices.Clone(outline)
+	for _, sym := range symbols {
+		nested = insertSymbol(nested, outline, sym)
+	}
+	sortSymbols(nested)
+	return nested
+}
+
+// insertSymbol inserts a symbol into the siblings, under the heading containing it if any
+//
+// The headings are the first siblings, as symbols are only ever appended
+func insertSymbol(siblings []DocumentSymbol, headings []DocumentSymbol, sym DocumentSymbol) []DocumentSymbol {
+	for i, heading := range headings {
+		if containsLine(heading.Range, sym.Range.Start.Line) {
+			siblings[i].Children = insertSymbol(slices.Clone(siblings[i].Children), heading.Children, sym)
+			return siblings
+		}
+	}
+	return append(siblings, sym)
+}
+
+func sortSymbols(symbols []DocumentSymbol) {
+	slices.SortStableFunc(symbols, func(a, b DocumentSymbol) int {
+		if a.Range.Start.Line != b.Range.Start.Line {
+			return a.Range.Start.Line - b.Range.Start.Line
+		}
+		return a.Range.Start.Character - b.Range.Start.Character
+	})
+	for i := range symbols {
+		sortSymbols(symbols[i].Children)
+	}
+}
+
+// containingHeading returns the deepest heading of the outline containing the line
+func containingHeading(outline []DocumentSymbol, line int) (DocumentSymbol, bool) {
+	for _, heading := range outline {
+		if containsLine(heading.Range, line) {
+			if child, ok := containingHeading(heading.Children, line); ok {
+				return child, true
+			}
+			return heading, true
+		}
+	}
+	return DocumentSymbol{}, false
+}
+
+// flattenSymbols converts nested symbols to SymbolInformation, with the parent of each symbol as its container
+func flattenSymbols(symbols []DocumentSymbol, uri lsp.DocumentURI, container string) []lsp.SymbolInformation {
+	var infos []lsp.SymbolInformation
+	for _, sym := range symbols {
+		infos = append(infos, lsp.SymbolInformation{
+			Name:          sym.Name,
+			Kind:          sym.Kind,
+			Location:      lsp.Location{URI: uri, Range: sym.Range},
+			ContainerName: container,
+		})
+		infos = append(infos, flattenSymbols(sym.Children, uri, sym.Name)...)
+	}
+	return infos
+}
+
+// containsLine returns true if the line is within the range, where a range ending at the start of a line excludes it
+func containsLine(r lsp.Range, line int) bool {
+	if line < r.Start.Line || line > r.End.Line {
+		return false
+	}
+	return line < r.End.Line || r.End.Character > 0
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jwtly10/litlua"
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func lineRange(start, end int) lsp.Range {
+	return lsp.Range{Start: lsp.Position{Line: start}, End: lsp.Position{Line: end}}
+}
+
+func TestHeadingOutline(t *testing.T) {
+	lines := []string{
+		"# Config", // 0
+		"",
+		"## Options", // 2
+		"",
+		"### Numbers", // 4
+		"",
+		"## Keymaps", // 6
+		"",
+		"# Plugins", // 8
+		"end",
+	}
+
+	got := headingOutline([]litlua.Heading{
+		{Level: 1, Text: "Config", Line: 1},
+		{Level: 2, Text: "Options", Line: 3},
+		{Level: 3, Text: "Numbers", Line: 5},
+		{Level: 2, Text: "Keymaps", Line: 7},
+		{Level: 1, Text: "Plugins", Line: 9},
+	}, lines)
+
+	heading := func(name string, level int, r lsp.Range, children ...DocumentSymbol) DocumentSymbol {
+		return DocumentSymbol{
+			Name:   name,
+			Detail: strings.Repeat("#", level),
+			Kind:   headingSymbolKind,
+			Range:  r,
+			SelectionRange: lsp.Range{
+				Start: r.Start,
+				End:   lsp.Position{Line: r.Start.Line, Character: len(lines[r.Start.Line])},
+			},
+			Children: children,
+		}
+	}
+
+	require.Equal(t, []DocumentSymbol{
+		heading("Config", 1, lineRange(0, 8),
+			heading("Options", 2, lineRange(2, 6),
+				heading("Numbers", 3, lineRange(4, 6)),
+			),
+			heading("Keymaps", 2, lineRange(6, 8)),
+		),
+		heading("Plugins", 1, lsp.Range{Start: lsp.Position{Line: 8}, End: lsp.Position{Line: 9, Character: 3}}),
+	}, got)
+}
+
+func TestNestSymbols(t *testing.T) {
+	outline := []DocumentSymbol{
+		{Name: "Config", Kind: headingSymbolKind, Range: lineRange(2, 20), Children: []DocumentSymbol{
+			{Name: "Options", Kind: headingSymbolKind, Range: lineRange(10, 20)},
+		}},
+	}
+
+	setup := DocumentSymbol{Name: "setup", Kind: lsp.SKFunction, Range: lineRange(12, 15), Children: []DocumentSymbol{
+		{Name: "opts", Kind: lsp.SKVariable, Range: lineRange(13, 13)},
+	}}
+	m := DocumentSymbol{Name: "M", Kind: lsp.SKVariable, Range: lineRange(5, 5)}
+	top := DocumentSymbol{Name: "top", Kind: lsp.SKVariable, Range: lineRange(0, 0)}
+	// Starts on the line of the next heading, so is not part of the heading before it
+	boundary := DocumentSymbol{Name: "boundary", Kind: lsp.SKVariable, Range: lineRange(20, 20)}
+
+	got := nestSymbols(outline, []DocumentSymbol{setup, m, top, boundary})
+
+	require.Equal(t, []DocumentSymbol{
+		top,
+		{Name: "Config", Kind: headingSymbolKind, Range: lineRange(2, 20), Children: []DocumentSymbol{
+			m,
+			{Name: "Options", Kind: headingSymbolKind, Range: lineRange(10, 20), Children: []DocumentSymbol{setup}},
+		}},
+		boundary,
+	}, got)
+
+	// the outline is not modified
+	require.Empty(t, outline[0].Children[0].Children)
+}
+
+func TestFlattenSymbols(t *testing.T) {
+	uri := lsp.DocumentURI("file:///test.litlua.md")
+	outline := []DocumentSymbol{
+		{Name: "Config", Kind: headingSymbolKind, Range: lineRange(0, 10), Children: []DocumentSymbol{
+			{Name: "Options", Kind: headingSymbolKind, Range: lineRange(4, 10)},
+		}},
+	}
+
+	require.Equal(t, []lsp.SymbolInformation{
+		{Name: "Config", Kind: headingSymbolKind, Location: lsp.Location{URI: uri, Range: lineRange(0, 10)}},
+		{Name: "Options", Kind: headingSymbolKind, Location: lsp.Location{URI: uri, Range: lineRange(4, 10)}, ContainerName: "Config"},
+	}, flattenSymbols(outline, uri, ""))
+
+	heading, ok := containingHeading(outline, 6)
+	require.True(t, ok)
+	require.Equal(t, "Options", heading.Name)
+
+	heading, ok = containingHeading(outline, 2)
+	require.True(t, ok)
+	require.Equal(t, "Config", heading.Name)
+
+	_, ok = containingHeading(outline, 10)
+	require.False(t, ok)
+}
+
+func TestDecodeSymbols(t *testing.T) {
+	tests := []struct {
+		name        string
+		result      interface{}
+		wantSymbols []DocumentSymbol
+		wantInfos   []lsp.SymbolInformation
+	}{
+		{
+			name: "test hierarchical symbols",
+			result: []interface{}{
+				map[string]interface{}{"name": "setup", "kind": 12, "range": lineRange(1, 3), "selectionRange": lineRange(1, 1)},
+			},
+			wantSymbols: []DocumentSymbol{{Name: "setup", Kind: lsp.SKFunction, Range: lineRange(1, 3), SelectionRange: lineRange(1, 1)}},
+		},
+		{
+			name: "test symbol information",
+			result: []interface{}{
+				map[string]interface{}{"name": "setup", "kind": 12, "location": lsp.Location{URI: "file:///a.lua", Range: lineRange(1, 3)}},
+			},
+			wantInfos: []lsp.SymbolInformation{{Name: "setup", Kind: lsp.SKFunction, Location: lsp.Location{URI: "file:///a.lua", Range: lineRange(1, 3)}}},
+		},
+		{
+			name:   "test no symbols",
+			result: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			symbols, infos, err := decodeSymbols(tc.result)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantSymbols, symbols)
+			require.Equal(t, tc.wantInfos, infos)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+)
+
+// Listen listens for clients on an address of the form tcp://host:port or unix:///path/to/socket
+//
+// Clients are not authenticated, and can read and compile any file the daemon can, so TCP addresses must be loopback
+// and the socket file is only accessible to its owner. A socket file left by a daemon that is no longer running is
+// replaced.
+func Listen(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid listen address %q: expected tcp://host:port", address)
+		}
+		if !isLoopback(u.Hostname()) {
+			return nil, fmt.Errorf("invalid listen address %q: tcp is only served on loopback hosts such as 127.0.0.1, "+
+				"as clients are not authenticated", address)
+		}
+		return net.Listen("tcp", u.Host)
+
+	case "unix":
+		path := u.Path
+		if path == "" {
+			return nil, fmt.Errorf("invalid listen address %q: expected unix:///path/to/socket", address)
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// Only the user running the daemon may connect to it
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+		}
+		return l, nil
+
+	default:
+		return nil, fmt.Errorf("invalid listen address %q: expected a tcp:// or unix:// address", address)
+	}
+}
+
+// isLoopback returns true if a host only accepts connections from this machine. An empty host listens on every interface.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// removeStaleSocket removes a socket file no daemon is listening on
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
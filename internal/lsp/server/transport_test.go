@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   func(t *testing.T) string
+		expectErr bool
+	}{
+		{
+			name:    "test tcp",
+			address: func(t *testing.T) string { return "tcp://127.0.0.1:0" },
+		},
+		{
+			name:    "test unix socket",
+			address: func(t *testing.T) string { return "unix://" + filepath.Join(t.TempDir(), "litlua.sock") },
+		},
+		{
+			name: "test stale unix socket",
+			address: func(t *testing.T) string {
+				path := filepath.Join(t.TempDir(), "litlua.sock")
+				l, err := net.Listen("unix", path)
+				require.NoError(t, err)
+				// Without unlinking, the socket file is left as by a daemon that crashed
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				require.NoError(t, l.Close())
+				return "unix://" + path
+			},
+		},
+		{
+			name: "test unix socket in use",
+			address: func(t *testing.T) string {
+				path := filepath.Join(t.TempDir(), "litlua.sock")
+				l, err := net.Listen("unix", path)
+				require.NoError(t, err)
+				t.Cleanup(func() { l.Close() })
+				return "unix://" + path
+			},
+			expectErr: true,
+		},
+		{
+			name: "test file in the way of the socket",
+			address: func(t *testing.T) string {
+				path := filepath.Join(t.TempDir(), "litlua.sock")
+				require.NoError(t, os.WriteFile(path, nil, 0644))
+				return "unix://" + path
+			},
+			expectErr: true,
+		},
+		{
+			name:      "test tcp without a port",
+			address:   func(t *testing.T) string { return "tcp://" },
+			expectErr: true,
+		},
+		{
+			name:    "test tcp on localhost",
+			address: func(t *testing.T) string { return "tcp://localhost:0" },
+		},
+		{
+			name:    "test tcp on ipv6 loopback",
+			address: func(t *testing.T) string { return "tcp://[::1]:0" },
+		},
+		{
+			name:      "test tcp on every interface",
+			address:   func(t *testing.T) string { return "tcp://:7777" },
+			expectErr: true,
+		},
+		{
+			name:      "test tcp on a public host",
+			address:   func(t *testing.T) string { return "tcp://0.0.0.0:7777" },
+			expectErr: true,
+		},
+		{
+			name:      "test unsupported scheme",
+			address:   func(t *testing.T) string { return "http://127.0.0.1:8080" },
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := Listen(tc.address(t))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if addr, ok := l.Addr().(*net.UnixAddr); ok {
+				// Only the owner can connect to the socket
+				info, err := os.Stat(addr.Name)
+				require.NoError(t, err)
+				require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			}
+			require.NoError(t, l.Close())
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package lsp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
@@ -8,7 +10,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/jwtly10/litlua"
 	"github.com/jwtly10/litlua/internal/transformer"
@@ -48,18 +52,36 @@ func (o DocumentServiceOptions) Validate() error {
 }
 
 // DocumentService handles all document transformations and path mappings
+//
+// It is safe for concurrent use, documents are changed by the handlers of client notifications while
+// the debounced syncs to lua-language-server transform them.
 type DocumentService struct {
-	// Maps shadow URIs to original URIs, which include a mirror of the source file structure
-	//
-	// shadow_file = file:///tmp/Users/personal/Projects/litlua/lsp_example.md.lua
-	// original    = file:///Users/personal/Projects/litlua/testdata/lsp_example.md
-	shadowMap         map[string]string
 	shadowTransformer *transformer.Transformer
-	// The root directory for shadow files eg /tmp/litlua
+	// The root directory for shadow files eg /tmp/litlua, guarded by mu
 	shadowRoot string
+	// If the shadow root of the options was given by the user, rather than the default
+	customShadowRoot bool
+	// If the shadow root is a workspace shadow root created for the service, see
+	// [DocumentService.SetWorkspaceShadowRoot]
+	workspaceShadowRoot bool
 
 	// The transformer used for 'final' transformation
 	finalTransformer *transformer.Transformer
+	// If the final transformation requires an output pragma
+	requireOutputPragma bool
+
+	// Parser used to validate documents, independently of transformation
+	parser *litlua.Parser
+
+	// Guards documents and shadows
+	mu sync.RWMutex
+	// Each open document, keyed by original URI
+	documents map[string]*openDocument
+	// Maps shadow URIs to original URIs, which include a mirror of the source file structure
+	//
+	// shadow_file = file:///tmp/Users/personal/Projects/litlua/lsp_example.md.lua
+	// original    = file:///Users/personal/Projects/litlua/testdata/lsp_example.md
+	shadows map[string]string
 }
 
 func NewDocumentService(opts DocumentServiceOptions) (*DocumentService, error) {
@@ -67,11 +89,22 @@ func NewDocumentService(opts DocumentServiceOptions) (*DocumentService, error) {
 		return nil, fmt.Errorf("invalid document service options: %w", err)
 	}
 
+	// The shadow root is the workspace of lua-language-server, so it must exist even though shadow documents
+	// are only kept in memory
+	if err := os.MkdirAll(opts.ShadowRoot, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create shadow root: %w", err)
+	}
+
 	d := &DocumentService{
 		shadowTransformer: transformer.NewTransformer(opts.ShadowTransformerOpts),
 		shadowRoot:        opts.ShadowRoot,
-		shadowMap:         make(map[string]string),
+		customShadowRoot:  opts.ShadowRoot != DefaultDocumentServiceOptions.ShadowRoot,
 		finalTransformer:  transformer.NewTransformer(opts.FinalTransformerOpts),
+		// The final transformer options are not exposed by the transformer
+		requireOutputPragma: opts.FinalTransformerOpts.RequirePragmaOutput,
+		parser:              litlua.NewParser(),
+		documents:           make(map[string]*openDocument),
+		shadows:             make(map[string]string),
 	}
 
 	// Cleanup shadow files on GC finalization
@@ -84,43 +117,150 @@ func NewDocumentService(opts DocumentServiceOptions) (*DocumentService, error) {
 	return d, nil
 }
 
-// TransformShadowDoc transforms the document for LSP proxying and returns the shadow URI
-func (s *DocumentService) TransformShadowDoc(text string, documentURI lsp.DocumentURI) (shadowURI string, err error) {
+// ErrDocumentNotOpen is returned when transforming a document that is not open, e.g. it was closed before
+// a debounced sync ran
+var ErrDocumentNotOpen = errors.New("document is not open")
+
+// ErrStaleDocument is returned when a document changes while it is transformed, the result is thrown away
+// as the newer version is transformed by the next sync
+var ErrStaleDocument = errors.New("document changed while it was transformed")
+
+// ShadowDocument is a version of a shadow document, transformed from the same version of its markdown document
+type ShadowDocument struct {
+	URI     string
+	Version int
+	// The text of the markdown document the shadow document was transformed from
+	Source string
+	Text   string
+}
+
+// TransformShadowDoc transforms the latest text of an open document to its in-memory shadow document for LSP proxying
+//
+// The document is transformed without holding the lock, so returns [ErrStaleDocument] if it changed in the meantime.
+// On any other error, the version and source of the document are still returned.
+func (s *DocumentService) TransformShadowDoc(documentURI lsp.DocumentURI) (ShadowDocument, error) {
+	s.mu.RLock()
+	doc, exists := s.documents[string(documentURI)]
+	var result ShadowDocument
+	if exists {
+		result = ShadowDocument{Version: doc.version, Source: doc.text}
+	}
+	shadowRoot := s.shadowRoot
+	s.mu.RUnlock()
+	if !exists {
+		return ShadowDocument{}, fmt.Errorf("%w: %s", ErrDocumentNotOpen, documentURI)
+	}
+
+	if doc.plain {
+		return s.syncPlainDocument(documentURI, doc, result)
+	}
+
 	fsPath, err := s.URIToPath(documentURI)
 	if err != nil {
-		return "", fmt.Errorf("invalid document URI: %w", err)
+		return result, fmt.Errorf("invalid document URI: %w", err)
 	}
 
-	// Create shadow file path
-	// in the shadow root directory, with the same directory structure as the original file, but with transformer configured output extension
-	shadowPath := filepath.Join(s.shadowRoot, filepath.Dir(fsPath)+s.shadowTransformer.CleanShadowOutputExt(filepath.Base(fsPath)))
-	if err := os.MkdirAll(filepath.Dir(shadowPath), 0755); err != nil {
-		return "", err
-	}
+	shadowPath := filepath.Join(shadowRoot, s.shadowOutputPath(fsPath))
 
 	source := transformer.MarkdownSource{
-		Content: strings.NewReader(text),
+		Content: strings.NewReader(result.Source),
 		Metadata: litlua.MetaData{
 			AbsSource: fsPath,
 		},
 	}
 
-	transformedPath, err := s.shadowTransformer.TransformToPath(source, shadowPath)
-	if err != nil {
-		return "", fmt.Errorf("transform error: %w", err)
+	var shadow strings.Builder
+	parsed, transformErr := s.shadowTransformer.TransformToWriter(source, &shadow)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, exists := s.documents[string(documentURI)]; !exists || current != doc || current.version != result.Version {
+		return result, ErrStaleDocument
 	}
 
-	shadowURI = s.PathToURI(transformedPath)
-	originalURI := string(documentURI)
-	s.shadowMap[shadowURI] = originalURI
+	if transformErr != nil {
+		return result, fmt.Errorf("transform error: %w", transformErr)
+	}
+
+	result.URI = s.PathToURI(shadowPath)
+	result.Text = shadow.String()
+
+	doc.shadowURI = result.URI
+	doc.shadow = result.Text
+	doc.shadowVersion = result.Version
+	doc.blocks = blockCodeLines(parsed, result.Source)
+	doc.pending = nil
+	doc.resync = false
+	s.shadows[result.URI] = string(documentURI)
 
 	slog.Debug("transformed document",
-		"original", originalURI,
-		"transformed", transformedPath,
-		"shadow", shadowURI,
+		"original", documentURI,
+		"shadow", result.URI,
+		"version", result.Version,
 	)
 
-	return shadowURI, nil
+	return result, nil
+}
+
+// syncPlainDocument syncs the shadow document of a plain Lua file, which is its text unchanged
+func (s *DocumentService) syncPlainDocument(documentURI lsp.DocumentURI, doc *openDocument, result ShadowDocument) (ShadowDocument, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, exists := s.documents[string(documentURI)]; !exists || current != doc || current.version != result.Version {
+		return result, ErrStaleDocument
+	}
+
+	result.URI = doc.shadowURI
+	result.Text = result.Source
+	doc.shadow = result.Text
+	doc.shadowVersion = result.Version
+	doc.pending = nil
+	doc.resync = false
+	return result, nil
+}
+
+// shadowOutputPath returns the path of the shadow document of a document, relative to the shadow root
+//
+// Shadow documents are only kept in memory, the path mirrors the original file in the shadow root, but with the
+// shadow transformer output extension, so it is next to the modules it requires in the linked workspace.
+func (s *DocumentService) shadowOutputPath(fsPath string) string {
+	return filepath.Join(filepath.Dir(fsPath), s.shadowTransformer.CleanShadowOutputExt(filepath.Base(fsPath)))
+}
+
+// CompiledOutputs returns the compiled output paths of the documents under root that lua-language-server would see as
+// well as their shadow documents, skipping documents whose output can't be resolved
+//
+// An output at the path of the shadow document is not returned, as the open shadow document takes its place.
+func (s *DocumentService) CompiledOutputs(root string) ([]string, error) {
+	paths, err := s.FindDocuments(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("failed to read document", "path", path, "error", err)
+			continue
+		}
+
+		doc, err := s.parser.ParseMarkdownDoc(bytes.NewReader(content), litlua.MetaData{AbsSource: path})
+		if doc == nil {
+			slog.Debug("skipping output of unparsable document", "path", path, "error", err)
+			continue
+		}
+
+		output, err := s.finalTransformer.ResolveOutputPath(path, doc.Pragmas)
+		if err != nil || output == s.shadowOutputPath(path) {
+			continue
+		}
+		outputs = append(outputs, output)
+	}
+
+	return outputs, nil
 }
 
 // TransformFinalDoc transforms a document for final 'compilation' output, returning the absolute path of the output file
@@ -140,25 +280,350 @@ func (s *DocumentService) TransformFinalDoc(text string, sourcePath string) (str
 	return transformedPath, nil
 }
 
+// PragmaDiagnostics parses the document and returns any pragma diagnostics found
+//
+// Diagnostics are returned for valid documents (warnings), documents without code blocks, and documents that
+// fail pragma validation.
+// A missing output pragma is a warning when it is required to compile the document on save.
+func (s *DocumentService) PragmaDiagnostics(text string, documentURI lsp.DocumentURI) []litlua.PragmaDiagnostic {
+	doc, err := s.parser.ParseMarkdownDoc(strings.NewReader(text), litlua.MetaData{
+		AbsSource: string(documentURI),
+	})
+	if err != nil && !errors.Is(err, litlua.ErrNoCodeBlocks) {
+		var pErr *litlua.PragmaError
+		if errors.As(err, &pErr) {
+			return pErr.Diagnostics
+		}
+		return nil
+	}
+
+	diags := doc.PragmaDiagnostics
+	if s.requireOutputPragma && doc.Pragmas.Output == "" {
+		diags = append(diags, litlua.PragmaDiagnostic{
+			Severity: litlua.SeverityWarning,
+			Key:      string(litlua.PragmaOutput),
+			Line:     litlua.FrontMatterLines([]byte(text)) + 1,
+			Message:  "missing output pragma, the document will not be compiled on save",
+		})
+	}
+
+	return diags
+}
+
+// FindDocuments returns the paths of all litlua documents under root, skipping files ignored by its .gitignore
+func (s *DocumentService) FindDocuments(root string) ([]string, error) {
+	paths, err := transformer.FindDocuments(root, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find documents: %w", err)
+	}
+
+	return paths, nil
+}
+
+// Headings parses the headings of a document
+func (s *DocumentService) Headings(text string) ([]litlua.Heading, error) {
+	return s.parser.ParseHeadings(strings.NewReader(text))
+}
+
+// Document parses the latest text of an open document
+//
+// A document without code blocks is returned along with an error wrapping [litlua.ErrNoCodeBlocks], as its
+// pragmas can still be used.
+func (s *DocumentService) Document(originalURI string) (*litlua.Document, error) {
+	text, exists := s.DocumentText(originalURI)
+	if !exists {
+		return nil, fmt.Errorf("no document found for %s", originalURI)
+	}
+
+	return s.ParseDocument(text, originalURI)
+}
+
+// ParseDocument parses a version of an open document, see [DocumentService.Document]
+func (s *DocumentService) ParseDocument(text string, originalURI string) (*litlua.Document, error) {
+	doc, err := s.parser.ParseMarkdownDoc(strings.NewReader(text), litlua.MetaData{
+		AbsSource: originalURI,
+	})
+	if err != nil {
+		return doc, fmt.Errorf("parse error: %w", err)
+	}
+
+	return doc, nil
+}
+
+// CodeBlocks parses the Lua code blocks of an open document, including test blocks
+func (s *DocumentService) CodeBlocks(originalURI string) ([]litlua.CodeBlock, error) {
+	doc, err := s.Document(originalURI)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(doc.Blocks, doc.TestBlocks...), nil
+}
+
+// DocumentText returns the latest text of an open document
+func (s *DocumentService) DocumentText(originalURI string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exists := s.documents[originalURI]
+	if !exists {
+		return "", false
+	}
+	return doc.text, true
+}
+
+// OpenDocument stores a document opened in the editor, which is transformed with [DocumentService.TransformShadowDoc]
+//
+// Reopening a document replaces it, so any transform of the previous document in progress is thrown away.
+func (s *DocumentService) OpenDocument(documentURI lsp.DocumentURI, version int, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc := &openDocument{text: text, version: version}
+	if previous, exists := s.documents[string(documentURI)]; exists {
+		doc.shadowURI = previous.shadowURI
+	}
+	if IsPlainLuaDocument(documentURI) {
+		// Plain Lua files are synced at their mirror in the shadow root from the start
+		doc.plain = true
+		doc.shadowURI = s.mirrorURI(documentURI)
+		s.shadows[doc.shadowURI] = string(documentURI)
+	}
+	s.documents[string(documentURI)] = doc
+}
+
+// IsPlainLuaDocument returns true if a document is a plain Lua file rather than a litlua document
+func IsPlainLuaDocument(documentURI lsp.DocumentURI) bool {
+	return strings.HasSuffix(string(documentURI), ".lua")
+}
+
+// MirrorURI returns the URI a document is mirrored at in the shadow root, which has the same directory structure
+// as the file system
+func (s *DocumentService) MirrorURI(documentURI lsp.DocumentURI) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mirrorURI(documentURI)
+}
+
+// mirrorURI is [DocumentService.MirrorURI], must hold mu
+func (s *DocumentService) mirrorURI(documentURI lsp.DocumentURI) string {
+	path, err := s.URIToPath(documentURI)
+	if err != nil {
+		path = strings.TrimPrefix(string(documentURI), "file://")
+	}
+	return s.PathToURI(filepath.Join(s.shadowRoot, path))
+}
+
+// CloseDocument removes a document closed in the editor, returning the URI of its shadow document
+// if it was transformed
+//
+// Earlier versions wrote shadow documents to disk, so any shadow file left for the document is removed, unless it
+// is within a workspace linked into the shadow root, where it would be a real file.
+func (s *DocumentService) CloseDocument(documentURI lsp.DocumentURI) (string, bool) {
+	s.mu.Lock()
+	doc, exists := s.documents[string(documentURI)]
+	if exists {
+		delete(s.documents, string(documentURI))
+		delete(s.shadows, doc.shadowURI)
+	}
+	s.mu.Unlock()
+
+	if !exists || doc.shadowURI == "" {
+		return "", false
+	}
+
+	if path, err := s.URIToPath(lsp.DocumentURI(doc.shadowURI)); err == nil && !doc.plain && !s.linked(path) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("failed to remove shadow file", "path", path, "error", err)
+		}
+	}
+
+	return doc.shadowURI, true
+}
+
+// linked returns true if a path in the shadow root resolves through a symlink, such as a workspace linked into it
+func (s *DocumentService) linked(path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	return err == nil && resolved != path
+}
+
+// ApplyChanges applies the changes of a didChange notification to an open document, returning its new text
+//
+// Changes within Lua code, and any change to a plain Lua file, are kept to be synced to the shadow document with
+// [DocumentService.FlushShadowChanges], any other change requires the document to be transformed again.
+func (s *DocumentService) ApplyChanges(documentURI lsp.DocumentURI, version int, changes []lsp.TextDocumentContentChangeEvent) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, exists := s.documents[string(documentURI)]
+	if !exists {
+		// Without the current text only a full change can be applied
+		doc = &openDocument{}
+		s.documents[string(documentURI)] = doc
+	}
+
+	text := doc.text
+	for _, change := range changes {
+		after, err := applyContentChange(text, change)
+		if err != nil {
+			return "", fmt.Errorf("failed to apply change to %s: %w", documentURI, err)
+		}
+
+		if doc.plain || doc.blocks != nil && mapShadowChange(doc.blocks, text, after, change) {
+			doc.pending = append(doc.pending, change)
+		} else {
+			doc.blocks = nil
+			doc.pending = nil
+		}
+		text = after
+	}
+
+	doc.text = text
+	doc.version = version
+	return text, nil
+}
+
+// ShadowChanges are changes to a shadow document, to forward to lua-language-server
+type ShadowChanges struct {
+	URI     string
+	Version int
+	Changes []lsp.TextDocumentContentChangeEvent
+}
+
+// FlushShadowChanges applies the pending changes of a document to its shadow document, returning the changes
+// to forward to lua-language-server
+//
+// Returns false if the document has to be transformed again with [DocumentService.TransformShadowDoc] instead
+func (s *DocumentService) FlushShadowChanges(documentURI lsp.DocumentURI) (ShadowChanges, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, exists := s.documents[string(documentURI)]
+	if !exists || (doc.blocks == nil && !doc.plain) || doc.shadowURI == "" || doc.resync {
+		return ShadowChanges{}, false
+	}
+
+	shadow, err := ApplyContentChanges(doc.shadow, doc.pending)
+	if err != nil {
+		slog.Warn("failed to apply changes to shadow document", "uri", documentURI, "error", err)
+		return ShadowChanges{}, false
+	}
+
+	changes := ShadowChanges{URI: doc.shadowURI, Version: doc.version, Changes: doc.pending}
+	doc.shadow = shadow
+	doc.shadowVersion = doc.version
+	doc.pending = nil
+	return changes, true
+}
+
+// ResyncShadow marks the shadow document of a document as out of sync with lua-language-server, e.g. after
+// forwarding its changes failed, so [DocumentService.FlushShadowChanges] returns false until it is transformed again
+func (s *DocumentService) ResyncShadow(documentURI lsp.DocumentURI) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if doc, exists := s.documents[string(documentURI)]; exists {
+		doc.resync = true
+	}
+}
+
+// ShadowDocuments returns the shadow documents of all open documents that have been transformed, as last synced
+// to lua-language-server, sorted by the URI of their document. Source is not set.
+func (s *DocumentService) ShadowDocuments() []ShadowDocument {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uris := make([]string, 0, len(s.documents))
+	for uri, doc := range s.documents {
+		if doc.shadowURI != "" {
+			uris = append(uris, uri)
+		}
+	}
+	slices.Sort(uris)
+
+	shadows := make([]ShadowDocument, 0, len(uris))
+	for _, uri := range uris {
+		doc := s.documents[uri]
+		shadows = append(shadows, ShadowDocument{URI: doc.shadowURI, Version: doc.shadowVersion, Text: doc.shadow})
+	}
+	return shadows
+}
+
+// ShadowText returns the text of the shadow document of an open document, as last synced to lua-language-server
+func (s *DocumentService) ShadowText(originalURI string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exists := s.documents[originalURI]
+	if !exists || doc.shadowURI == "" {
+		return "", false
+	}
+	return doc.shadow, true
+}
+
+// SyncedShadow returns the shadow document of an open document along with its markdown text as Source, only if the
+// shadow document was synced from the latest version of the document, so edits computed from one apply to the other
+func (s *DocumentService) SyncedShadow(originalURI string) (ShadowDocument, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exists := s.documents[originalURI]
+	if !exists || doc.shadowURI == "" || doc.shadowVersion != doc.version || doc.resync {
+		return ShadowDocument{}, false
+	}
+	return ShadowDocument{URI: doc.shadowURI, Version: doc.version, Source: doc.text, Text: doc.shadow}, true
+}
+
+// OpenDocuments returns the original URIs of all open documents, sorted
+func (s *DocumentService) OpenDocuments() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uris := make([]string, 0, len(s.documents))
+	for uri := range s.documents {
+		uris = append(uris, uri)
+	}
+	slices.Sort(uris)
+	return uris
+}
+
 // ShadowRoot returns the root directory for shadow files
 func (s *DocumentService) ShadowRoot() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.shadowRoot
 }
 
+// SetWorkspaceShadowRoot changes the root directory for shadow files to a directory created for the workspace of the
+// service, which is removed by [DocumentService.CleanupShadowFiles]
+//
+// It must be called before any document is opened, e.g. once the workspace root is known on initialize.
+func (s *DocumentService) SetWorkspaceShadowRoot(shadowRoot string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shadowRoot = shadowRoot
+	s.workspaceShadowRoot = true
+}
+
 // OriginalURI returns the original document URI for a shadow file
 func (s *DocumentService) OriginalURI(shadowURI string) (string, bool) {
-	uri, exists := s.shadowMap[shadowURI]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	uri, exists := s.shadows[shadowURI]
 	return uri, exists
 }
 
-// ShadowURI returns the shadow URI for an original document URI
+// ShadowURI returns the shadow URI for an original document URI, once the document has been transformed
 func (s *DocumentService) ShadowURI(originalURI string) (string, bool) {
-	for shadow, original := range s.shadowMap {
-		if original == originalURI {
-			return shadow, true
-		}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doc, exists := s.documents[originalURI]
+	if !exists || doc.shadowURI == "" {
+		return "", false
 	}
-	return "", false
+	return doc.shadowURI, true
 }
 
 // URIToPath converts an LSP URI to a filesystem path
@@ -175,14 +640,35 @@ func (s *DocumentService) PathToURI(path string) string {
 	return "file://" + path
 }
 
-// CleanupShadowFiles removes all shadow files
+// CleanupShadowFiles removes the workspace shadow root of the service, along with the config and link of the
+// workspace in it
+//
+// Without a workspace shadow root, any shadow files left in the shadow root by earlier versions, which wrote them to
+// disk, are removed instead, unless the shadow root was given by the user.
 func (s *DocumentService) CleanupShadowFiles() error {
-	if s.shadowRoot != DefaultDocumentServiceOptions.ShadowRoot {
-		slog.Info("skipping shadow file cleanup due to user specified", "path", s.shadowRoot)
+	s.mu.Lock()
+	shadowRoot, workspace, custom := s.shadowRoot, s.workspaceShadowRoot, s.customShadowRoot
+	// The workspace shadow root is only removed once, later cleanups such as on finalization leave its path alone, as
+	// a later server of the workspace creates it again
+	s.workspaceShadowRoot = false
+	s.customShadowRoot = custom || workspace
+	s.mu.Unlock()
+
+	if workspace {
+		// Links are removed without following them, so the workspace itself is left alone
+		if err := os.RemoveAll(shadowRoot); err != nil {
+			return fmt.Errorf("failed to remove workspace shadow root: %w", err)
+		}
+		slog.Debug("removed workspace shadow root", "path", shadowRoot)
+		return nil
+	}
+
+	if custom {
+		slog.Info("skipping shadow file cleanup due to user specified", "path", shadowRoot)
 		return nil
 	}
 
-	return filepath.WalkDir(s.shadowRoot, func(path string, d fs.DirEntry, err error) error {
+	return filepath.WalkDir(shadowRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			slog.Warn("error accessing path", "path", path, "error", err)
 			return nil
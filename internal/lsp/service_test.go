@@ -0,0 +1,257 @@
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sourcegraph/go-lsp"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDocumentService(t *testing.T) *DocumentService {
+	t.Helper()
+
+	opts := DefaultDocumentServiceOptions
+	opts.ShadowRoot = t.TempDir()
+	s, err := NewDocumentService(opts)
+	require.NoError(t, err)
+	return s
+}
+
+func TestShadowIndexes(t *testing.T) {
+	s := newTestDocumentService(t)
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+
+	s.OpenDocument(uri, 1, "# No code yet\n")
+	_, err := s.TransformShadowDoc(uri)
+	require.Error(t, err)
+
+	// The shadow URI is only known once the document has been transformed
+	_, exists := s.ShadowURI(string(uri))
+	require.False(t, exists)
+
+	_, err = s.ApplyChanges(uri, 2, []lsp.TextDocumentContentChangeEvent{{Text: "```lua\nlocal x = 1\n```\n"}})
+	require.NoError(t, err)
+	shadow, err := s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+
+	shadowURI, exists := s.ShadowURI(string(uri))
+	require.True(t, exists)
+	require.Equal(t, shadow.URI, shadowURI)
+
+	originalURI, exists := s.OriginalURI(shadowURI)
+	require.True(t, exists)
+	require.Equal(t, string(uri), originalURI)
+}
+
+func TestTransformShadowDocStale(t *testing.T) {
+	s := newTestDocumentService(t)
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+	s.OpenDocument(uri, 0, "```lua\nlocal n = 0\n```\n")
+
+	// Each version sets n to its version, so a transform can be checked against the version it claims
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for version := 1; version <= 200; version++ {
+			// A change to the fence, so every version is transformed from the whole document
+			text := fmt.Sprintf("```lua\nlocal n = %d\n```\n", version)
+			_, err := s.ApplyChanges(uri, version, []lsp.TextDocumentContentChangeEvent{{Text: text}})
+			require.NoError(t, err)
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				shadow, err := s.TransformShadowDoc(uri)
+				if errors.Is(err, ErrStaleDocument) {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("\nlocal n = %d\n\n", shadow.Version), shadow.Text)
+
+				_, _ = s.ShadowURI(string(uri))
+				_, _ = s.OriginalURI(shadow.URI)
+				_, _ = s.DocumentText(string(uri))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The latest version is never stale
+	shadow, err := s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+	require.Equal(t, 200, shadow.Version)
+	require.Equal(t, "\nlocal n = 200\n\n", shadow.Text)
+}
+
+func TestCloseDocument(t *testing.T) {
+	s := newTestDocumentService(t)
+	uri := lsp.DocumentURI("file://" + filepath.Join(t.TempDir(), "init.litlua.md"))
+
+	s.OpenDocument(uri, 1, "```lua\nlocal x = 1\n```\n")
+	shadow, err := s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+
+	// A shadow file left on disk by an earlier version
+	shadowPath := strings.TrimPrefix(shadow.URI, "file://")
+	require.NoError(t, os.MkdirAll(filepath.Dir(shadowPath), 0755))
+	require.NoError(t, os.WriteFile(shadowPath, []byte(shadow.Text), 0644))
+
+	shadowURI, transformed := s.CloseDocument(uri)
+	require.True(t, transformed)
+	require.Equal(t, shadow.URI, shadowURI)
+	require.NoFileExists(t, shadowPath)
+
+	_, exists := s.DocumentText(string(uri))
+	require.False(t, exists)
+	_, exists = s.OriginalURI(shadowURI)
+	require.False(t, exists)
+	require.Empty(t, s.OpenDocuments())
+
+	_, err = s.TransformShadowDoc(uri)
+	require.ErrorIs(t, err, ErrDocumentNotOpen)
+
+	// Closing a document that was never transformed
+	s.OpenDocument(uri, 1, "# No code\n")
+	_, transformed = s.CloseDocument(uri)
+	require.False(t, transformed)
+}
+
+func TestShadowDocuments(t *testing.T) {
+	s := newTestDocumentService(t)
+	dir := t.TempDir()
+	synced := lsp.DocumentURI("file://" + filepath.Join(dir, "a.litlua.md"))
+	untransformed := lsp.DocumentURI("file://" + filepath.Join(dir, "b.litlua.md"))
+
+	s.OpenDocument(synced, 1, "```lua\nlocal x = 1\n```\n")
+	shadow, err := s.TransformShadowDoc(synced)
+	require.NoError(t, err)
+	s.OpenDocument(untransformed, 1, "# No code\n")
+
+	// A change not yet synced isn't in the shadow document
+	_, err = s.ApplyChanges(synced, 2, []lsp.TextDocumentContentChangeEvent{change(1, 10, 1, 11, "2")})
+	require.NoError(t, err)
+	require.Equal(t, []ShadowDocument{{URI: shadow.URI, Version: 1, Text: "\nlocal x = 1\n\n"}}, s.ShadowDocuments())
+
+	_, ok := s.FlushShadowChanges(synced)
+	require.True(t, ok)
+	require.Equal(t, []ShadowDocument{{URI: shadow.URI, Version: 2, Text: "\nlocal x = 2\n\n"}}, s.ShadowDocuments())
+}
+
+func TestPlainDocument(t *testing.T) {
+	s := newTestDocumentService(t)
+	dir := t.TempDir()
+	uri := lsp.DocumentURI("file://" + filepath.Join(dir, "util.lua"))
+	mirrorURI := "file://" + filepath.Join(s.ShadowRoot(), dir, "util.lua")
+
+	s.OpenDocument(uri, 1, "local M = {}\nreturn M\n")
+	shadow, err := s.TransformShadowDoc(uri)
+	require.NoError(t, err)
+	require.Equal(t, mirrorURI, shadow.URI)
+	require.Equal(t, "local M = {}\nreturn M\n", shadow.Text)
+
+	originalURI, exists := s.OriginalURI(mirrorURI)
+	require.True(t, exists)
+	require.Equal(t, string(uri), originalURI)
+
+	// Every change is synced incrementally, as there are no code blocks to leave
+	edit := change(0, 6, 0, 7, "N")
+	_, err = s.ApplyChanges(uri, 2, []lsp.TextDocumentContentChangeEvent{edit})
+	require.NoError(t, err)
+	changes, ok := s.FlushShadowChanges(uri)
+	require.True(t, ok)
+	require.Equal(t, ShadowChanges{URI: mirrorURI, Version: 2, Changes: []lsp.TextDocumentContentChangeEvent{edit}}, changes)
+	require.Equal(t, []ShadowDocument{{URI: mirrorURI, Version: 2, Text: "local N = {}\nreturn M\n"}}, s.ShadowDocuments())
+
+	// The mirror is the real file when the workspace is linked into the shadow root, so it is never removed
+	require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(s.ShadowRoot(), dir)), 0755))
+	require.NoError(t, os.Symlink(dir, filepath.Join(s.ShadowRoot(), dir)))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "util.lua"), []byte("local M = {}\nreturn M\n"), 0644))
+
+	_, transformed := s.CloseDocument(uri)
+	require.True(t, transformed)
+	require.FileExists(t, filepath.Join(dir, "util.lua"))
+	_, exists = s.OriginalURI(mirrorURI)
+	require.False(t, exists)
+
+	// Nor is a compiled output at the path of a shadow document
+	doc := lsp.DocumentURI("file://" + filepath.Join(dir, "init.litlua.md"))
+	s.OpenDocument(doc, 1, "```lua\nlocal x = 1\n```\n")
+	_, err = s.TransformShadowDoc(doc)
+	require.NoError(t, err)
+	output := filepath.Join(dir, "init.litlua.lua")
+	require.NoError(t, os.WriteFile(output, []byte("local x = 1\n"), 0644))
+
+	_, transformed = s.CloseDocument(doc)
+	require.True(t, transformed)
+	require.FileExists(t, output)
+}
+
+func TestIsPlainLuaDocument(t *testing.T) {
+	tests := []struct {
+		uri  lsp.DocumentURI
+		want bool
+	}{
+		{uri: "file:///home/user/nvim/lua/util.lua", want: true},
+		{uri: "file:///home/user/nvim/init.litlua.md", want: false},
+		{uri: "file:///home/user/nvim/README.md", want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.uri), func(t *testing.T) {
+			require.Equal(t, tc.want, IsPlainLuaDocument(tc.uri))
+		})
+	}
+}
+
+func TestPragmaDiagnosticsWithoutCodeBlocks(t *testing.T) {
+	s := newTestDocumentService(t)
+
+	diags := s.PragmaDiagnostics("<!-- @pragma ouptut: init.lua -->\n\n# Config\n", "file:///config/init.litlua.md")
+	// The misspelled key, and the output pragma it was meant to be
+	require.Len(t, diags, 2)
+	require.Equal(t, "ouptut", diags[0].Key)
+	require.Equal(t, "output", diags[1].Key)
+}
+
+func TestCleanupShadowFiles(t *testing.T) {
+	t.Run("test workspace shadow root is removed", func(t *testing.T) {
+		s := newTestDocumentService(t)
+		workspace := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(workspace, "init.litlua.md"), []byte("# Config\n"), 0644))
+
+		shadowRoot := filepath.Join(s.ShadowRoot(), "workspace")
+		require.NoError(t, os.MkdirAll(shadowRoot, 0755))
+		s.SetWorkspaceShadowRoot(shadowRoot)
+		require.NoError(t, os.WriteFile(filepath.Join(shadowRoot, ".luarc.json"), []byte("{}"), 0644))
+		require.NoError(t, os.Symlink(workspace, filepath.Join(shadowRoot, "link")))
+
+		require.NoError(t, s.CleanupShadowFiles())
+		require.NoDirExists(t, shadowRoot)
+		require.FileExists(t, filepath.Join(workspace, "init.litlua.md"))
+
+		// A later server of the workspace recreates it, which a later cleanup leaves alone
+		require.NoError(t, os.MkdirAll(shadowRoot, 0755))
+		require.NoError(t, s.CleanupShadowFiles())
+		require.DirExists(t, shadowRoot)
+	})
+
+	t.Run("test user specified shadow root is left alone", func(t *testing.T) {
+		s := newTestDocumentService(t)
+		shadowFile := filepath.Join(s.ShadowRoot(), "init.litlua.lua")
+		require.NoError(t, os.WriteFile(shadowFile, []byte("local x = 1\n"), 0644))
+
+		require.NoError(t, s.CleanupShadowFiles())
+		require.FileExists(t, shadowFile)
+	})
+}
@@ -0,0 +1,220 @@
+package luatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jwtly10/litlua"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+type RunnerOptions struct {
+	// The maximum time a single test block may run for
+	Timeout time.Duration
+}
+
+var DefaultRunnerOptions = RunnerOptions{
+	Timeout: 5 * time.Second,
+}
+
+// Runner runs the test blocks (```lua test) of a document in an embedded Lua VM
+type Runner struct {
+	// Test chunks are written in shadow mode, so Lua line numbers are markdown line numbers
+	writer *litlua.Writer
+	opts   RunnerOptions
+}
+
+// NewRunner creates a new Runner with the specified options [RunnerOptions]
+func NewRunner(opts RunnerOptions) *Runner {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRunnerOptions.Timeout
+	}
+
+	return &Runner{
+		writer: litlua.NewWriter(litlua.ModeShadow),
+		opts:   opts,
+	}
+}
+
+// Result is the result of running a single test block
+type Result struct {
+	// The test block that was run
+	Block    litlua.CodeBlock
+	Duration time.Duration
+	// The reason the test failed, nil if the test passed
+	Failure *Failure
+}
+
+func (r Result) Passed() bool {
+	return r.Failure == nil
+}
+
+// Failure is a failed test, mapped to the markdown source
+type Failure struct {
+	// The markdown source file
+	Source string
+	// The 1-indexed line in the markdown source file the error was raised on
+	Line    int
+	Message string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("%s:%d: %s", f.Source, f.Line, f.Message)
+}
+
+// Run runs every test block of the document, returning a result per block
+//
+// Each test block is run in a fresh VM, together with all code blocks that come before it in the
+// document, so tests can use anything (including locals) defined earlier in the configuration.
+func (r *Runner) Run(doc *litlua.Document) ([]Result, error) {
+	results := make([]Result, 0, len(doc.TestBlocks))
+	for _, test := range doc.TestBlocks {
+		start := time.Now()
+		failure, err := r.runBlock(doc, test)
+		if err != nil {
+			return nil, fmt.Errorf("running test at %s:%d: %w", doc.Metadata.AbsSource, test.Position.StartLine, err)
+		}
+
+		results = append(results, Result{
+			Block:    test,
+			Duration: time.Since(start),
+			Failure:  failure,
+		})
+	}
+
+	return results, nil
+}
+
+// runBlock runs a single test block, returning a [Failure] if the test failed
+//
+// An error is only returned if the test could not be run at all
+func (r *Runner) runBlock(doc *litlua.Document, test litlua.CodeBlock) (*Failure, error) {
+	chunkDoc := &litlua.Document{
+		Metadata: doc.Metadata,
+	}
+	for _, block := range doc.Blocks {
+		if block.Position.StartLine < test.Position.StartLine {
+			chunkDoc.Blocks = append(chunkDoc.Blocks, block)
+		}
+	}
+	chunkDoc.Blocks = append(chunkDoc.Blocks, test)
+
+	var chunk strings.Builder
+	if err := r.writer.WriteContent(chunkDoc, &chunk); err != nil {
+		return nil, fmt.Errorf("writing test chunk: %w", err)
+	}
+
+	L := newState()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	if err := L.DoString(prelude); err != nil {
+		return nil, fmt.Errorf("loading test prelude: %w", err)
+	}
+
+	chunkName := doc.Metadata.AbsSource
+	fn, err := L.Load(strings.NewReader(chunk.String()), chunkName)
+	if err != nil {
+		var pErr *parse.Error
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && errors.As(apiErr.Cause, &pErr) && pErr.Pos.Line != parse.EOF {
+			return &Failure{Source: chunkName, Line: pErr.Pos.Line, Message: "syntax error near '" + pErr.Token + "'"}, nil
+		}
+		return &Failure{Source: chunkName, Line: test.Position.StartLine, Message: err.Error()}, nil
+	}
+
+	L.Push(fn)
+	if err := L.PCall(0, 0, nil); err != nil {
+		if ctx.Err() != nil {
+			return &Failure{Source: chunkName, Line: test.Position.StartLine, Message: fmt.Sprintf("test timed out after %s", r.opts.Timeout)}, nil
+		}
+
+		return toFailure(chunkName, test, err), nil
+	}
+
+	return nil, nil
+}
+
+// toFailure maps a Lua runtime error to a [Failure]
+//
+// Errors raised in the chunk are prefixed with `<chunkName>:<line>:`, which we use as the markdown line.
+// Errors without a position (such as `error({})`) are reported at the start of the test block.
+func toFailure(chunkName string, test litlua.CodeBlock, err error) *Failure {
+	msg := err.Error()
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		msg = apiErr.Object.String()
+	}
+
+	failure := &Failure{Source: chunkName, Line: test.Position.StartLine, Message: msg}
+
+	rest, ok := strings.CutPrefix(msg, chunkName+":")
+	if !ok {
+		return failure
+	}
+
+	lineStr, message, ok := strings.Cut(rest, ":")
+	if !ok {
+		return failure
+	}
+
+	line, err := strconv.Atoi(lineStr)
+	if err != nil {
+		return failure
+	}
+
+	failure.Line = line
+	failure.Message = strings.TrimSpace(message)
+	return failure
+}
+
+// sandboxedOsFuncs are the functions of the os library kept in the test VM, none of which change anything outside of it
+var sandboxedOsFuncs = []string{"clock", "date", "difftime", "getenv", "time"}
+
+// newState creates a Lua VM with only the standard libraries a configuration needs
+//
+// io is not opened, os only has the functions in [sandboxedOsFuncs], and files can not be loaded with
+// dofile, loadfile or require, so tests can not touch the filesystem or run commands
+func newState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage},
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	osLib := L.GetGlobal(lua.OsLibName).(*lua.LTable)
+	sandboxed := L.NewTable()
+	for _, name := range sandboxedOsFuncs {
+		sandboxed.RawSetString(name, osLib.RawGetString(name))
+	}
+	L.SetGlobal(lua.OsLibName, sandboxed)
+	L.SetField(L.GetField(L.Get(lua.RegistryIndex), "_LOADED"), lua.OsLibName, sandboxed)
+
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+	// Only modules from package.preload can be required, the second loader reads them from package.path
+	loaders := L.GetField(L.Get(lua.RegistryIndex), "_LOADERS").(*lua.LTable)
+	loaders.RawSetInt(2, lua.LNil)
+
+	return L
+}
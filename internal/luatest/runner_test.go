@@ -0,0 +1,123 @@
+package luatest
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/litlua"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunner(t *testing.T) {
+	f, err := os.Open("testdata/specs.litlua.md")
+	require.NoError(t, err)
+	defer f.Close()
+
+	doc, err := litlua.NewParser().ParseMarkdownDoc(f, litlua.MetaData{AbsSource: "specs.litlua.md"})
+	require.NoError(t, err)
+	require.Len(t, doc.TestBlocks, 3)
+
+	results, err := NewRunner(DefaultRunnerOptions).Run(doc)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	require.True(t, results[0].Passed())
+
+	require.False(t, results[1].Passed())
+	require.Equal(t, &Failure{
+		Source:  "specs.litlua.md",
+		Line:    25,
+		Message: "expected 5 but got 4",
+	}, results[1].Failure)
+
+	require.True(t, results[2].Passed())
+}
+
+func TestRunnerFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		timeout  time.Duration
+		wantLine int
+		wantMsg  string
+	}{
+		{
+			name:     "test error in config block is reported at the config line",
+			content:  "```lua\nlocal x = nil\nprint(x.y)\n```\n\n```lua test\nassert(true)\n```\n",
+			wantLine: 3,
+			wantMsg:  "attempt to index a non-table object(nil) with key 'y'",
+		},
+		{
+			name:     "test syntax error in test block",
+			content:  "```lua\nlocal x = 1\n```\n\n```lua test\nassert(x = 1)\n```\n",
+			wantLine: 6,
+			wantMsg:  "syntax error near '='",
+		},
+		{
+			name:     "test error without a position is reported at the test block",
+			content:  "```lua\nlocal x = 1\n```\n\n```lua test\nerror({})\n```\n",
+			wantLine: 6,
+		},
+		{
+			name:     "test timeout",
+			content:  "```lua\nlocal x = 1\n```\n\n```lua test\nwhile true do end\n```\n",
+			timeout:  100 * time.Millisecond,
+			wantLine: 6,
+			wantMsg:  "test timed out after 100ms",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := litlua.NewParser().ParseMarkdownDoc(strings.NewReader(tc.content), litlua.MetaData{AbsSource: "test.litlua.md"})
+			require.NoError(t, err)
+
+			results, err := NewRunner(RunnerOptions{Timeout: tc.timeout}).Run(doc)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.False(t, results[0].Passed())
+			require.Equal(t, tc.wantLine, results[0].Failure.Line)
+			if tc.wantMsg != "" {
+				require.Equal(t, tc.wantMsg, results[0].Failure.Message)
+			}
+		})
+	}
+}
+
+func TestRunnerSandbox(t *testing.T) {
+	tests := []struct {
+		name string
+		test string
+	}{
+		{name: "test os can not remove files", test: "assert(os.remove == nil and os.rename == nil)"},
+		{name: "test os can not run commands or exit", test: "assert(os.execute == nil and os.exit == nil)"},
+		{name: "test os can still read the time", test: "assert(type(os.time()) == 'number' and type(os.date('%Y')) == 'string')"},
+		{name: "test os from package.loaded is sandboxed", test: "assert(package.loaded.os.remove == nil)"},
+		{name: "test files can not be loaded", test: "assert(dofile == nil and loadfile == nil)"},
+		{
+			name: "test modules can not be required from files",
+			test: "package.path = MODULE_PATH\nassert(tostring(require('mod')) == 'stub<mod>')",
+		},
+	}
+
+	module := filepath.Join(t.TempDir(), "mod.lua")
+	require.NoError(t, os.WriteFile(module, []byte("return { loaded = true }\n"), 0644))
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			test := strings.ReplaceAll(tc.test, "MODULE_PATH", strconv.Quote(filepath.Join(filepath.Dir(module), "?.lua")))
+			content := "```lua\nlocal x = 1\n```\n\n```lua test\n" + test + "\n```\n"
+			doc, err := litlua.NewParser().ParseMarkdownDoc(strings.NewReader(content), litlua.MetaData{AbsSource: "test.litlua.md"})
+			require.NoError(t, err)
+
+			results, err := NewRunner(DefaultRunnerOptions).Run(doc)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.True(t, results[0].Passed(), "%v", results[0].Failure)
+		})
+	}
+}
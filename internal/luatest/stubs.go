@@ -0,0 +1,50 @@
+package luatest
+
+// prelude is run before every test chunk, and provides the stubbed globals
+// that configurations expect from their host (neovim or wezterm)
+//
+// Stubs are permissive: any field of a stub is another stub, and calling a stub returns a stub.
+// This lets configuration code like `vim.keymap.set(...)` or `require('telescope').setup({...})`
+// run without the host, while values explicitly assigned (e.g. `vim.g.mapleader = ' '`) can still be asserted on.
+const prelude = `
+local function stub(name)
+	return setmetatable({}, {
+		__index = function(t, k)
+			local v = stub(name .. "." .. tostring(k))
+			rawset(t, k, v)
+			return v
+		end,
+		__call = function()
+			return stub(name .. "()")
+		end,
+		__tostring = function()
+			return "stub<" .. name .. ">"
+		end,
+	})
+end
+
+vim = stub("vim")
+vim.g = {}
+vim.o = {}
+vim.env = {}
+
+wezterm = stub("wezterm")
+wezterm.config_builder = function()
+	return {}
+end
+
+local original_require = require
+require = function(name)
+	if name == "wezterm" then
+		return wezterm
+	end
+
+	local ok, mod = pcall(original_require, name)
+	if ok then
+		return mod
+	end
+
+	-- Plugins and host modules are not available, so we stub them
+	return stub(name)
+end
+`
@@ -0,0 +1,73 @@
+package transformer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// FindDocuments walks the directory tree starting at root and returns the paths of the litlua documents in it
+//
+// If a .git directory is found, it will be used to load .gitignore patterns. If maxFiles is more than 0, finding
+// more documents than it is an error.
+func FindDocuments(root string, maxFiles int) ([]string, error) {
+	var files []string
+	var patterns []gitignore.Pattern
+
+	// If .git exists, set up gitignore patterns
+	if _, err := os.Stat(filepath.Join(root, ".git")); err == nil {
+		// Add .git directory pattern
+		patterns = append(patterns, gitignore.ParsePattern(".git/", nil))
+
+		// Load .gitignore if it exists
+		if data, err := os.ReadFile(filepath.Join(root, ".gitignore")); err == nil {
+			for _, p := range strings.Split(string(data), "\n") {
+				if p = strings.TrimSpace(p); p != "" && !strings.HasPrefix(p, "#") {
+					patterns = append(patterns, gitignore.ParsePattern(p, nil))
+				}
+			}
+		}
+	}
+
+	matcher := gitignore.NewMatcher(patterns)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		pathComponents := strings.Split(relPath, string(os.PathSeparator))
+
+		if len(patterns) > 0 {
+			if matcher.Match(pathComponents, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if !info.IsDir() && strings.HasSuffix(path, InputExt) {
+			if maxFiles > 0 && len(files) >= maxFiles {
+				return fmt.Errorf("max files limit reached (%d)", maxFiles)
+			}
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
@@ -0,0 +1,72 @@
+package transformer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindDocuments(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		maxFiles int
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:  "test documents are found in subdirectories",
+			files: []string{"init.litlua.md", "plugins/lsp.litlua.md", "plugins/lsp.litlua.lua", "README.md"},
+			want:  []string{"init.litlua.md", "plugins/lsp.litlua.md"},
+		},
+		{
+			name:  "test gitignored files are skipped in a git repository",
+			files: []string{".git/HEAD", ".gitignore", "init.litlua.md", "build/out.litlua.md", "draft.litlua.md"},
+			want:  []string{"init.litlua.md"},
+		},
+		{
+			name:  "test gitignore is not used outside of a git repository",
+			files: []string{".gitignore", "init.litlua.md", "build/out.litlua.md", "draft.litlua.md"},
+			want:  []string{"build/out.litlua.md", "draft.litlua.md", "init.litlua.md"},
+		},
+		{
+			name:     "test too many documents",
+			files:    []string{"a.litlua.md", "b.litlua.md"},
+			maxFiles: 1,
+			wantErr:  "max files limit reached (1)",
+		},
+		{
+			name: "test no documents",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, file := range tc.files {
+				content := ""
+				if file == ".gitignore" {
+					content = "# Outputs\nbuild/\ndraft.litlua.md\n"
+				}
+				path := filepath.Join(root, file)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+			}
+
+			got, err := FindDocuments(root, tc.maxFiles)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			var want []string
+			for _, file := range tc.want {
+				want = append(want, filepath.Join(root, file))
+			}
+			require.Equal(t, want, got)
+		})
+	}
+}
@@ -0,0 +1,40 @@
+-- # My Neovim configuration
+--
+-- Options are set first, then keymaps.
+
+-- ==========================================
+-- Options
+-- ==========================================
+vim.g.mapleader = " "
+vim.o.number = true
+vim.o.shell = os.getenv("SHELL") or "${SHELL}"
+
+vim.o.tabstop = 4 -- trailing comments stay with the code
+
+-- Helpers
+
+---@param a number
+---@param b number
+---@return number
+local function add(a, b)
+    local sum = a + b
+
+    return sum
+end
+local M = {}
+function M.setup()
+    vim.cmd [[
+    -- not a comment, this is vimscript in a long string
+
+        colorscheme habamax
+    ]]
+end
+
+--[[
+A long comment is kept as code
+]]
+vim.keymap.set("n", "<leader>w", function()
+    vim.cmd.write()
+end, { desc = "Write" })
+
+return M
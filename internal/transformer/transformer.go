@@ -1,6 +1,7 @@
 package transformer
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -12,6 +13,10 @@ import (
 	"github.com/jwtly10/litlua"
 )
 
+// ErrOutputPragmaRequired is returned when transforming a document without an output pragma,
+// when [TransformOptions].RequirePragmaOutput is set
+var ErrOutputPragmaRequired = errors.New("pragma key 'output' is required for transformation")
+
 type TransformOptions struct {
 	// The mode for the writer instance
 	WriterMode litlua.WriteMode
@@ -19,18 +24,30 @@ type TransformOptions struct {
 	NoBackup bool
 	// If true, pragma output is required for transformation, otherwise transform will error
 	RequirePragmaOutput bool
+	// If true, pragma warnings (unknown keys, malformed or misplaced pragmas) will fail transformation
+	StrictPragmas bool
 
 	// By default, output files are .litlua.lua (safe) otherwise .lua
 	NoLitLuaOutputExt bool
+
+	// Optional path to a YAML file of variables, these override variables defined in the document
+	VarsFile string
+
+	// If true, the generated Lua will not be syntax checked before writing (pretty mode only)
+	NoSyntaxCheck bool
+
+	// If true, each block is wrapped in marker comments, so the output can be untangled (pretty mode only)
+	BlockMarkers bool
 }
 
 var InputExt = ".litlua.md"
 
 func (t *TransformOptions) Pretty() string {
-	return fmt.Sprintf("mode=%s backup=%s require_output_pragma=%s",
+	return fmt.Sprintf("mode=%s backup=%s require_output_pragma=%s strict_pragmas=%s",
 		writerModeToString(t.WriterMode),
 		boolToText(!t.NoBackup),
-		boolToText(t.RequirePragmaOutput))
+		boolToText(t.RequirePragmaOutput),
+		boolToText(t.StrictPragmas))
 }
 
 func writerModeToString(mode litlua.WriteMode) string {
@@ -64,8 +81,8 @@ type Transformer struct {
 // NewTransformer creates a new Transformer instance with the specified options [TransformOptions]
 func NewTransformer(opts TransformOptions) *Transformer {
 	t := &Transformer{
-		parser: litlua.NewParser(),
-		writer: litlua.NewWriter(opts.WriterMode),
+		parser: litlua.NewParserWithOptions(litlua.ParserOptions{Strict: opts.StrictPragmas}),
+		writer: litlua.NewWriterWithOptions(opts.WriterMode, litlua.WriterOptions{BlockMarkers: opts.BlockMarkers}),
 		backup: litlua.NewBackupManager(),
 		opts:   opts,
 	}
@@ -109,36 +126,36 @@ func (t *Transformer) TransformToPath(input MarkdownSource, outputPath string) (
 	return t.transform(input, outputPath)
 }
 
-func (t *Transformer) transform(input MarkdownSource, forcedPath string) (string, error) {
-	slog.Debug("transforming document", "path", input.Metadata.AbsSource)
-	if input.Metadata.AbsSource == "" {
-		return "", fmt.Errorf("abs source metadata is required for transformation")
+// TransformToWriter writes a document to out without touching disk (for in-memory lsp shadow documents),
+// returning the parsed document
+func (t *Transformer) TransformToWriter(input MarkdownSource, out io.Writer) (*litlua.Document, error) {
+	if t.opts.WriterMode != litlua.ModeShadow {
+		return nil, fmt.Errorf("TransformToWriter() can only be used with shadow mode")
 	}
 
-	doc, err := t.parser.ParseMarkdownDoc(input.Content, input.Metadata)
+	doc, err := t.prepare(input)
 	if err != nil {
-		return "", fmt.Errorf("parse error: %w", err)
+		return nil, err
 	}
 
-	baseName := filepath.Base(input.Metadata.AbsSource)
-	outputBaseName := filepath.Base(doc.Pragmas.Output)
-	if baseName == outputBaseName {
-		return "", fmt.Errorf("output file cannot have the same name as the input file")
+	if err := t.writer.WriteContent(doc, out); err != nil {
+		return nil, fmt.Errorf("write error: %w", err)
 	}
 
-	var absTransformPath string
-	if forcedPath != "" {
-		absTransformPath = forcedPath
-	} else if t.opts.RequirePragmaOutput {
-		if doc.Pragmas.Output == "" {
-			return "", fmt.Errorf("pragma key 'output' is required for transformation")
-		}
+	return doc, nil
+}
 
-		absTransformPath = filepath.Join(filepath.Dir(input.Metadata.AbsSource), t.CleanPragmaOutputExt(doc.Pragmas))
-	} else {
-		absTransformPath, err = t.resolveTransformToAbsPath(input.Metadata.AbsSource, doc.Pragmas)
+func (t *Transformer) transform(input MarkdownSource, forcedPath string) (string, error) {
+	doc, err := t.prepare(input)
+	if err != nil {
+		return "", err
+	}
+
+	absTransformPath := forcedPath
+	if absTransformPath == "" {
+		absTransformPath, err = t.ResolveOutputPath(input.Metadata.AbsSource, doc.Pragmas)
 		if err != nil {
-			return "", fmt.Errorf("resolve output path error: %w", err)
+			return "", err
 		}
 	}
 
@@ -187,6 +204,96 @@ func (t *Transformer) transform(input MarkdownSource, forcedPath string) (string
 	return absTransformPath, nil
 }
 
+// prepare parses a document and resolves its code for writing, as configured for the writer mode
+func (t *Transformer) prepare(input MarkdownSource) (*litlua.Document, error) {
+	slog.Debug("transforming document", "path", input.Metadata.AbsSource)
+	if input.Metadata.AbsSource == "" {
+		return nil, fmt.Errorf("abs source metadata is required for transformation")
+	}
+
+	doc, err := t.parser.ParseMarkdownDoc(input.Content, input.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+
+	for _, d := range doc.PragmaDiagnostics {
+		slog.Warn("pragma warning", "source", input.Metadata.AbsSource, "line", d.Line, "message", d.Message, "suggestion", d.Suggestion)
+	}
+
+	// Shadow files are only used for LSP support, so we never fail on variables, and keep
+	// the column positions of the code intact
+	if t.opts.WriterMode == litlua.ModeShadow {
+		litlua.MaskVariables(doc)
+	} else {
+		vars, err := t.ResolveVariables(doc.Pragmas)
+		if err != nil {
+			return nil, fmt.Errorf("variables error: %w", err)
+		}
+
+		if err := litlua.SubstituteVariables(doc, vars); err != nil {
+			return nil, fmt.Errorf("substitution error: %w", err)
+		}
+
+		// We refuse to write broken Lua, as we would only find out when the config fails to load
+		if !t.opts.NoSyntaxCheck {
+			if err := litlua.ValidateLuaSyntax(doc); err != nil {
+				return nil, fmt.Errorf("syntax error: %w", err)
+			}
+		}
+	}
+
+	baseName := filepath.Base(input.Metadata.AbsSource)
+	outputBaseName := filepath.Base(doc.Pragmas.Output)
+	if baseName == outputBaseName {
+		return nil, fmt.Errorf("output file cannot have the same name as the input file")
+	}
+
+	return doc, nil
+}
+
+// ResolveOutputPath returns the absolute path a document is transformed to, from its pragmas
+func (t *Transformer) ResolveOutputPath(absSource string, pragma litlua.Pragma) (string, error) {
+	if t.opts.RequirePragmaOutput {
+		if pragma.Output == "" {
+			return "", ErrOutputPragmaRequired
+		}
+
+		return filepath.Join(filepath.Dir(absSource), t.CleanPragmaOutputExt(pragma)), nil
+	}
+
+	absPath, err := t.resolveTransformToAbsPath(absSource, pragma)
+	if err != nil {
+		return "", fmt.Errorf("resolve output path error: %w", err)
+	}
+
+	return absPath, nil
+}
+
+// ResolveVariables merges the document variables with the variables file, if configured
+//
+// Variables from the file take precedence, so per-machine values can override document defaults
+func (t *Transformer) ResolveVariables(pragma litlua.Pragma) (map[string]string, error) {
+	vars := make(map[string]string, len(pragma.Vars))
+	for k, v := range pragma.Vars {
+		vars[k] = v
+	}
+
+	if t.opts.VarsFile == "" {
+		return vars, nil
+	}
+
+	fileVars, err := litlua.LoadVariablesFile(t.opts.VarsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range fileVars {
+		vars[k] = v
+	}
+
+	return vars, nil
+}
+
 // CleanPragmaOutputExt uses all pragmas to correctly determine the output path
 func (t *Transformer) CleanPragmaOutputExt(pragma litlua.Pragma) string {
 	if pragma.Output != "" && pragma.Force {
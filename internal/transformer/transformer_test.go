@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/jwtly10/litlua"
@@ -87,6 +88,7 @@ func TestTransformer(t *testing.T) {
 				WriterMode:          litlua.ModePretty,
 				NoBackup:            true,
 				RequirePragmaOutput: false,
+				NoSyntaxCheck:       true,
 			},
 			validate: func(t *testing.T, outputPath string) {
 				content, err := os.ReadFile(outputPath)
@@ -204,6 +206,90 @@ func TestTransformer(t *testing.T) {
 				require.Contains(t, string(content), "-- Bar is a function that adds two numbers\n--\n-- @param a number\n--\n-- @param b number\n--\n-- @return number sum of a and b\nBar = function(a, b)\n    return a + b\nend\n\n-- You can go to definition of bar by clicking on it\nprint(Bar(10, 11))\n\n-- try typing B in this print function and see the completion\nprint(...)")
 			},
 		},
+		{
+			name:      "with_pragma_typo",
+			inputFile: "with_pragma_typo.litlua.md",
+			opts: TransformOptions{
+				WriterMode: litlua.ModePretty,
+				NoBackup:   true,
+			},
+			validate: func(t *testing.T, outputPath string) {
+				content, err := os.ReadFile(outputPath)
+				require.NoError(t, err)
+
+				// The unknown pragma is ignored, so we fall back to the source file name
+				require.Contains(t, outputPath, "with_pragma_typo.litlua.lua")
+				require.Contains(t, string(content), "local name = \"Hello World\"\nprint(name)")
+			},
+		},
+		{
+			name:      "with_pragma_typo_strict",
+			inputFile: "with_pragma_typo.litlua.md",
+			opts: TransformOptions{
+				WriterMode:    litlua.ModePretty,
+				NoBackup:      true,
+				StrictPragmas: true,
+			},
+			wantErr: "parse error: invalid pragmas: line 1: unknown pragma key 'ouptut' (did you mean 'output'?)",
+		},
+		{
+			name:      "with_variables",
+			inputFile: "with_variables.litlua.md",
+			opts: TransformOptions{
+				WriterMode: litlua.ModePretty,
+				NoBackup:   true,
+			},
+			validate: func(t *testing.T, outputPath string) {
+				content, err := os.ReadFile(outputPath)
+				require.NoError(t, err)
+
+				require.Contains(t, string(content), "config.font_size = 12\nconfig.color_scheme = \"tokyonight\"")
+			},
+		},
+		{
+			name:      "with_variables_file_override",
+			inputFile: "with_variables.litlua.md",
+			opts: TransformOptions{
+				WriterMode: litlua.ModePretty,
+				NoBackup:   true,
+				VarsFile:   filepath.Join("testdata", "transformer", "vars.yaml"),
+			},
+			validate: func(t *testing.T, outputPath string) {
+				content, err := os.ReadFile(outputPath)
+				require.NoError(t, err)
+
+				require.Contains(t, string(content), "config.font_size = 16\nconfig.color_scheme = \"tokyonight\"")
+			},
+		},
+		{
+			name:      "with_variables_shadow",
+			inputFile: "with_variables.litlua.md",
+			opts: TransformOptions{
+				WriterMode: litlua.ModeShadow,
+				NoBackup:   true,
+			},
+			validate: func(t *testing.T, outputPath string) {
+				content, err := os.ReadFile(outputPath)
+				require.NoError(t, err)
+
+				// placeholders are masked, keeping columns intact
+				require.Contains(t, string(content), "config.font_size = nil             \nconfig.color_scheme = \"nil           \"")
+			},
+		},
+		{
+			name:      "with_undefined_variables_shadow",
+			inputFile: "with_undefined_variables.litlua.md",
+			opts: TransformOptions{
+				WriterMode: litlua.ModeShadow,
+				NoBackup:   true,
+			},
+			validate: func(t *testing.T, outputPath string) {
+				content, err := os.ReadFile(outputPath)
+				require.NoError(t, err)
+
+				require.Contains(t, string(content), "config.font = \"nil        \"")
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -267,6 +353,138 @@ func TestTransformer(t *testing.T) {
 	}
 }
 
+func TestTransformUndefinedVariables(t *testing.T) {
+	dir := newTestDir(t)
+	defer dir.cleanup()
+
+	input, err := os.ReadFile(filepath.Join("testdata", "transformer", "with_undefined_variables.litlua.md"))
+	require.NoError(t, err)
+	mdPath := dir.createFile("with_undefined_variables.litlua.md", string(input))
+
+	transformer := NewTransformer(TransformOptions{
+		WriterMode: litlua.ModePretty,
+		NoBackup:   true,
+	})
+
+	_, err = transformer.Transform(MarkdownSource{
+		Content: bytes.NewReader(input),
+		Metadata: litlua.MetaData{
+			AbsSource: mdPath,
+		},
+	})
+
+	var vErr *litlua.VariableError
+	require.ErrorAs(t, err, &vErr)
+	require.Equal(t, []litlua.UndefinedVariable{{Name: "font", Line: 7, Column: 16}}, vErr.Undefined)
+
+	// the output file is not written
+	_, err = os.Stat(filepath.Join(dir.path, "compiled.litlua.lua"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTransformRefusesInvalidLua(t *testing.T) {
+	dir := newTestDir(t)
+	defer dir.cleanup()
+
+	input, err := os.ReadFile(filepath.Join("testdata", "transformer", "broken_lua_block.litlua.md"))
+	require.NoError(t, err)
+	mdPath := dir.createFile("broken_lua_block.litlua.md", string(input))
+
+	transformer := NewTransformer(TransformOptions{
+		WriterMode: litlua.ModePretty,
+		NoBackup:   true,
+	})
+
+	_, err = transformer.Transform(MarkdownSource{
+		Content: bytes.NewReader(input),
+		Metadata: litlua.MetaData{
+			AbsSource: mdPath,
+		},
+	})
+
+	var syntaxErr *litlua.LuaSyntaxError
+	require.ErrorAs(t, err, &syntaxErr)
+	require.Equal(t, mdPath, syntaxErr.Source)
+	// The block is missing its closing fence, so the markdown after it is parsed as lua
+	require.Equal(t, 11, syntaxErr.Line)
+
+	// the output file is not written
+	_, err = os.Stat(filepath.Join(dir.path, "compiled.litlua.lua"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTransformToWriter(t *testing.T) {
+	dir := newTestDir(t)
+	defer dir.cleanup()
+
+	input := "# Options\n\n```lua\nvim.o.number = {{ .number }}\n```\n"
+	mdPath := filepath.Join(dir.path, "init.litlua.md")
+	src := func() MarkdownSource {
+		return MarkdownSource{Content: strings.NewReader(input), Metadata: litlua.MetaData{AbsSource: mdPath}}
+	}
+
+	var out bytes.Buffer
+	doc, err := NewTransformer(TransformOptions{WriterMode: litlua.ModeShadow}).TransformToWriter(src(), &out)
+	require.NoError(t, err)
+	require.Len(t, doc.Blocks, 1)
+	// Lines and columns are kept, with the variable masked
+	require.Equal(t, "\n\n\nvim.o.number = nil          \n\n", out.String())
+
+	// nothing is written to disk
+	entries, err := os.ReadDir(dir.path)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	_, err = NewTransformer(TransformOptions{WriterMode: litlua.ModePretty}).TransformToWriter(src(), &out)
+	require.EqualError(t, err, "TransformToWriter() can only be used with shadow mode")
+}
+
+func TestTransformImportedLua(t *testing.T) {
+	dir := newTestDir(t)
+	defer dir.cleanup()
+
+	original, err := os.ReadFile(filepath.Join("testdata", "transformer", "import.lua"))
+	require.NoError(t, err)
+
+	md, err := litlua.ImportLua(bytes.NewReader(original), litlua.ImportOptions{Output: "init.lua", Title: "init.lua"})
+	require.NoError(t, err)
+	mdPath := dir.createFile("init.litlua.md", md)
+
+	transformer := NewTransformer(TransformOptions{
+		WriterMode: litlua.ModePretty,
+		NoBackup:   true,
+	})
+
+	outPath, err := transformer.Transform(MarkdownSource{
+		Content: strings.NewReader(md),
+		Metadata: litlua.MetaData{
+			AbsSource: mdPath,
+		},
+	})
+	require.NoError(t, err)
+
+	generated, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+
+	// Top level comments became prose, so they are the only lines missing from the generated Lua.
+	// Blank lines between blocks are normalised, and the generated header is skipped
+	var want, got []string
+	for _, line := range strings.Split(string(original), "\n") {
+		if strings.TrimSpace(line) == "" || (strings.HasPrefix(line, "--") && !strings.HasPrefix(line, "---@") && !strings.HasPrefix(line, "--[[")) {
+			continue
+		}
+		want = append(want, line)
+	}
+	for _, line := range strings.Split(string(generated), "\n")[8:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		got = append(got, line)
+	}
+
+	require.Equal(t, want, got)
+}
+
 func TestCleanPragmaOutputExt(t *testing.T) {
 	tests := []struct {
 		name   string
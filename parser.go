@@ -2,6 +2,7 @@ package litlua
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,26 +10,64 @@ import (
 	"strconv"
 	"strings"
 
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
 	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
 	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/text"
 )
 
 var pragmaRegex = regexp.MustCompile(`^<!--\s*@pragma\s+(\w+)\s*:\s*([^>]+?)\s*-->$`)
 
+var variableNameRegex = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+// ErrNoCodeBlocks is returned when parsing a document without any lua code blocks
+var ErrNoCodeBlocks = errors.New("no lua code blocks found in document")
+
+type ParserOptions struct {
+	// If true, pragma warnings (unknown keys, malformed or misplaced pragmas) will fail parsing
+	Strict bool
+}
+
 type Parser struct {
 	gm goldmark.Markdown
+	// Used to render documents to HTML (see [Parser.RenderHTML]), separate from gm as GFM
+	// changes how blocks are parsed, which must not change the blocks that are tangled
+	html goldmark.Markdown
+	opts ParserOptions
 }
 
+// NewParser creates a new Parser with default options
 func NewParser() *Parser {
+	return NewParserWithOptions(ParserOptions{})
+}
+
+// NewParserWithOptions creates a new Parser with the specified options [ParserOptions]
+func NewParserWithOptions(opts ParserOptions) *Parser {
 	return &Parser{
 		gm: goldmark.New(),
+		html: goldmark.New(
+			goldmark.WithExtensions(
+				extension.GFM,
+				highlighting.NewHighlighting(
+					highlighting.WithStyle("github"),
+					highlighting.WithFormatOptions(chromahtml.WithClasses(false)),
+				),
+			),
+			goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		),
+		opts: opts,
 	}
 }
 
 // ParseMarkdownDoc parses Markdown content into a document
 //
 // It pulls out compilation pragmas and lua code blocks from the content and returns a [Document]
+//
+// A document without code blocks is returned along with [ErrNoCodeBlocks], so its pragmas and pragma
+// diagnostics can still be used.
 func (p *Parser) ParseMarkdownDoc(r io.Reader, md MetaData) (*Document, error) {
 	content, err := io.ReadAll(r)
 	if err != nil {
@@ -39,28 +78,61 @@ func (p *Parser) ParseMarkdownDoc(r io.Reader, md MetaData) (*Document, error) {
 		Metadata: md,
 	}
 
-	hasWalkedOtherNodes := false
+	state := &parseState{}
+
+	fm, content := splitFrontMatter(content)
+	if fm != nil {
+		var diags []PragmaDiagnostic
+		state.frontMatterKeys, diags = p.parseFrontMatter(&doc.Pragmas, fm)
+		doc.PragmaDiagnostics = append(doc.PragmaDiagnostics, diags...)
+	}
+
 	nodes := p.gm.Parser().Parse(text.NewReader(content))
 
-	err = p.walkAst(nodes, content, &hasWalkedOtherNodes, doc)
+	err = p.walkAst(nodes, content, state, doc)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := p.validatePragmas(doc); err != nil {
+		return nil, err
+	}
+
 	if len(doc.Blocks) == 0 {
-		return nil, fmt.Errorf("no lua code blocks found in document")
+		return doc, ErrNoCodeBlocks
 	}
 
 	return doc, nil
 }
 
+// validatePragmas returns a [PragmaError] containing all pragma diagnostics if the document
+// has any pragma errors, or any pragma warnings when the parser is in strict mode
+func (p *Parser) validatePragmas(doc *Document) error {
+	for _, d := range doc.PragmaDiagnostics {
+		if d.Severity == SeverityError || p.opts.Strict {
+			return &PragmaError{Diagnostics: doc.PragmaDiagnostics}
+		}
+	}
+
+	return nil
+}
+
+// parseState tracks state while walking the markdown AST
+type parseState struct {
+	// Set once any node other than an HTML block has been walked,
+	// after which pragma comments are no longer considered
+	hasWalkedOtherNodes bool
+	// Pragma keys set by front matter, mapped to the line they were set on
+	frontMatterKeys map[string]int
+}
+
 func getLineNumber(content []byte, byteOffset int) int {
 	return bytes.Count(content[:byteOffset], []byte("\n")) + 1
 }
 
 // walkAst walks the AST of a markdown document and extracts pragmas and code blocks
 // from the document
-func (p *Parser) walkAst(doc ast.Node, content []byte, hasWalkedOtherNodes *bool, result *Document) error {
+func (p *Parser) walkAst(doc ast.Node, content []byte, state *parseState, result *Document) error {
 	return ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
 		if !entering {
 			// Entering is true BEFORE walking children, false after walking child
@@ -74,14 +146,13 @@ func (p *Parser) walkAst(doc ast.Node, content []byte, hasWalkedOtherNodes *bool
 				// Markdown files start with document node, so we can skip this if we see it first
 				// Otherwise we should no longer try to parse pragmas in future comments
 				// as we know they are not at the top of the file
-				*hasWalkedOtherNodes = true
-			} else {
+				state.hasWalkedOtherNodes = true
 			}
 		}
 
 		switch node := n.(type) {
 		case *ast.HTMLBlock:
-			if err := p.handleHTMLBlock(node, content, hasWalkedOtherNodes, result); err != nil {
+			if err := p.handleHTMLBlock(node, content, state, result); err != nil {
 				return ast.WalkStop, err
 			}
 		case *ast.FencedCodeBlock:
@@ -120,30 +191,73 @@ func (p *Parser) walkAst(doc ast.Node, content []byte, hasWalkedOtherNodes *bool
 //
 // [EOF]
 //
-// will not set the [Pragma] struct as the comments are not at the top of the file
-func (p *Parser) handleHTMLBlock(hb *ast.HTMLBlock, content []byte, hasWalkedOtherNodes *bool, doc *Document) error {
-	slog.Debug("parsing html block", "hasWalkedOtherNodes", *hasWalkedOtherNodes)
-	if !*hasWalkedOtherNodes && hb.HTMLBlockType == ast.HTMLBlockType2 {
-		var buf bytes.Buffer
-		l := hb.Lines().Len()
-		for i := 0; i < l; i++ {
-			line := hb.Lines().At(i)
-			buf.Write(line.Value(content))
-		}
-		err := p.extractPragmaFromLine(&doc.Pragmas, buf.String())
-		if err != nil {
-			return err
+// will not set the [Pragma] struct as the comments are not at the top of the file.
+// Instead, a warning is recorded on the [Document] for each ignored pragma.
+//
+// Comment pragmas take precedence over front matter pragmas, with a warning recorded for each key set by both.
+func (p *Parser) handleHTMLBlock(hb *ast.HTMLBlock, content []byte, state *parseState, doc *Document) error {
+	slog.Debug("parsing html block", "hasWalkedOtherNodes", state.hasWalkedOtherNodes)
+	if hb.HTMLBlockType != ast.HTMLBlockType2 || hb.Lines().Len() == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	l := hb.Lines().Len()
+	for i := 0; i < l; i++ {
+		line := hb.Lines().At(i)
+		buf.Write(line.Value(content))
+	}
+	lineNo := getLineNumber(content, hb.Lines().At(0).Start)
+
+	if state.hasWalkedOtherNodes {
+		if strings.Contains(buf.String(), "@pragma") {
+			doc.PragmaDiagnostics = append(doc.PragmaDiagnostics, PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Line:     lineNo,
+				Message:  "pragma ignored, pragmas must be at the top of the file before any other content",
+			})
+		}
+		return nil
+	}
+
+	if d := p.extractPragmaFromLine(&doc.Pragmas, buf.String(), lineNo); d != nil {
+		doc.PragmaDiagnostics = append(doc.PragmaDiagnostics, *d)
+		return nil
+	}
+
+	if matches := pragmaRegex.FindStringSubmatch(strings.TrimSpace(buf.String())); len(matches) == 3 {
+		if fmLine, ok := state.frontMatterKeys[matches[1]]; ok {
+			doc.PragmaDiagnostics = append(doc.PragmaDiagnostics, PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Key:      matches[1],
+				Value:    matches[2],
+				Line:     lineNo,
+				Message:  fmt.Sprintf("pragma '%s' is also set in front matter on line %d, this value takes precedence", matches[1], fmLine),
+			})
 		}
 	}
 	return nil
 }
 
+// handleCodeBlock extracts lua code blocks from the markdown
+//
+// Blocks with a `test` attribute in their info string (```lua test) are extracted
+// as test blocks, which are only used by the test runner.
 func (p *Parser) handleCodeBlock(cb *ast.FencedCodeBlock, content []byte, doc *Document) error {
 	lang := string(cb.Language(content))
 	if lang != "lua" {
 		return nil
 	}
 
+	isTest := false
+	if cb.Info != nil {
+		for _, attr := range strings.Fields(string(cb.Info.Segment.Value(content)))[1:] {
+			if attr == "test" {
+				isTest = true
+			}
+		}
+	}
+
 	lines := cb.Lines()
 
 	// If the code block is empty, we can skip it
@@ -171,7 +285,12 @@ func (p *Parser) handleCodeBlock(cb *ast.FencedCodeBlock, content []byte, doc *D
 		},
 	}
 
-	slog.Debug("parsed code block", "block", block)
+	slog.Debug("parsed code block", "block", block, "test", isTest)
+
+	if isTest {
+		doc.TestBlocks = append(doc.TestBlocks, block)
+		return nil
+	}
 
 	doc.Blocks = append(doc.Blocks, block)
 	return nil
@@ -186,20 +305,34 @@ func (p *Parser) handleCodeBlock(cb *ast.FencedCodeBlock, content []byte, doc *D
 //
 // If multiple lines contain the same key, the last one will be used.
 //
-// Will return an error if the value cannot be parsed
-func (p *Parser) extractPragmaFromLine(pragma *Pragma, line string) error {
+// Comments that do not mention @pragma are ignored. Returns a [PragmaDiagnostic] if the
+// pragma is malformed or has an unknown key (warning), or if the value cannot be parsed (error)
+func (p *Parser) extractPragmaFromLine(pragma *Pragma, line string, lineNo int) *PragmaDiagnostic {
 	line = strings.TrimSpace(line)
 	slog.Debug("parsing pragma line", "line", line)
 
+	if !strings.Contains(line, "@pragma") {
+		return nil
+	}
+
 	matches := pragmaRegex.FindStringSubmatch(line)
 	if len(matches) != 3 {
 		slog.Debug("invalid pragma line", "line", line)
-		return nil
+		return &PragmaDiagnostic{
+			Severity: SeverityWarning,
+			Line:     lineNo,
+			Message:  "malformed pragma, expected <!-- @pragma key: value -->",
+		}
 	}
 
-	key := matches[1]
-	value := matches[2]
+	return p.setPragma(pragma, matches[1], matches[2], lineNo)
+}
 
+// setPragma validates a pragma key value pair and sets it on the [Pragma] struct
+//
+// Used for both comment and front matter pragmas, so both forms are validated the same way.
+// Returns a [PragmaDiagnostic] if the key is unknown (warning) or the value cannot be parsed (error)
+func (p *Parser) setPragma(pragma *Pragma, key, value string, lineNo int) *PragmaDiagnostic {
 	slog.Debug("parsed pragma key value pair", "key", key, "value", value)
 
 	switch key {
@@ -208,18 +341,103 @@ func (p *Parser) extractPragmaFromLine(pragma *Pragma, line string) error {
 	case string(PragmaDebug):
 		b, err := strconv.ParseBool(value)
 		if err != nil {
-			return fmt.Errorf("could not parse debug pragma value: %w", err)
+			return &PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      key,
+				Value:    value,
+				Line:     lineNo,
+				Message:  fmt.Sprintf("could not parse debug pragma value '%s', expected a boolean", value),
+			}
 		}
 		pragma.Debug = b
 	case string(PragmaForce):
 		b, err := strconv.ParseBool(value)
 		if err != nil {
-			return fmt.Errorf("could not parse force pragma value: %w", err)
+			return &PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      key,
+				Value:    value,
+				Line:     lineNo,
+				Message:  fmt.Sprintf("could not parse force pragma value '%s', expected a boolean", value),
+			}
 		}
 		pragma.Force = b
+	case string(PragmaExpand):
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return &PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      key,
+				Value:    value,
+				Line:     lineNo,
+				Message:  fmt.Sprintf("could not parse expand pragma value '%s', expected a boolean", value),
+			}
+		}
+		pragma.Expand = b
+	case string(PragmaVar):
+		name, v, ok := strings.Cut(value, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !variableNameRegex.MatchString(name) {
+			return &PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      key,
+				Value:    value,
+				Line:     lineNo,
+				Message:  fmt.Sprintf("could not parse var pragma value '%s', expected name=value", value),
+			}
+		}
+		if pragma.Vars == nil {
+			pragma.Vars = make(map[string]string)
+		}
+		pragma.Vars[name] = strings.TrimSpace(v)
 	default:
 		slog.Debug("unknown pragma key", "key", key)
+		return &PragmaDiagnostic{
+			Severity:   SeverityWarning,
+			Key:        key,
+			Value:      value,
+			Line:       lineNo,
+			Message:    fmt.Sprintf("unknown pragma key '%s'", key),
+			Suggestion: suggestPragmaKey(key),
+		}
 	}
 
 	return nil
 }
+
+// suggestPragmaKey returns the closest known pragma key to an unknown key,
+// or an empty string if no key is close enough to be a likely typo
+func suggestPragmaKey(key string) string {
+	best := ""
+	bestDist := 3 // anything further than 2 edits is unlikely to be a typo
+	for _, known := range KnownPragmaKeys {
+		if d := levenshtein(strings.ToLower(key), string(known)); d < bestDist {
+			best = string(known)
+			bestDist = d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
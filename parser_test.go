@@ -2,6 +2,7 @@ package litlua
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -164,7 +165,7 @@ func TestCanExtractPragmaFromLine(t *testing.T) {
 		name     string
 		line     string
 		expected Pragma
-		wantErr  bool
+		wantDiag *PragmaDiagnostic
 	}{
 		{
 			name: "test basic output pragma",
@@ -181,35 +182,105 @@ func TestCanExtractPragmaFromLine(t *testing.T) {
 			},
 		},
 		{
-			name:     "test ignores invalid pragma",
+			name:     "test ignores non pragma comment",
+			line:     "<!-- just a regular comment -->",
+			expected: Pragma{},
+		},
+		{
+			name:     "test warns on unknown pragma",
 			line:     "<!-- @pragma invalid: something -->",
 			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Key:      "invalid",
+				Value:    "something",
+				Line:     1,
+				Message:  "unknown pragma key 'invalid'",
+			},
 		},
 		{
-			name:     "test ignores malformed comment",
+			name:     "test warns on unknown pragma with suggestion",
+			line:     "<!-- @pragma ouptut: init.lua -->",
+			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity:   SeverityWarning,
+				Key:        "ouptut",
+				Value:      "init.lua",
+				Line:       1,
+				Message:    "unknown pragma key 'ouptut'",
+				Suggestion: "output",
+			},
+		},
+		{
+			name:     "test warns on malformed comment",
 			line:     "@pragma output: init.lua",
 			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Line:     1,
+				Message:  "malformed pragma, expected <!-- @pragma key: value -->",
+			},
 		},
 		{
-			name:     "test ignores malformed comment if duplicated",
+			name:     "test warns on malformed comment if duplicated",
 			line:     "<!-- @pragma output: something --><!-- @pragma output: something -->",
 			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Line:     1,
+				Message:  "malformed pragma, expected <!-- @pragma key: value -->",
+			},
 		},
 		{
-			name:     "test ignores malformed comment start",
+			name:     "test warns on malformed comment start",
 			line:     "@pragma output: init.lua -->",
 			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Line:     1,
+				Message:  "malformed pragma, expected <!-- @pragma key: value -->",
+			},
 		},
 		{
-			name:     "test ignores malformed comment end",
+			name:     "test warns on malformed comment end",
 			line:     "<!-- @pragma output: init.lua",
 			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityWarning,
+				Line:     1,
+				Message:  "malformed pragma, expected <!-- @pragma key: value -->",
+			},
+		},
+		{
+			name: "test var pragma",
+			line: "<!-- @pragma var: font_size = 14 -->",
+			expected: Pragma{
+				Vars: map[string]string{"font_size": "14"},
+			},
+		},
+		{
+			name:     "test error when invalid var pragma",
+			line:     "<!-- @pragma var: font_size -->",
+			expected: Pragma{},
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      "var",
+				Value:    "font_size",
+				Line:     1,
+				Message:  "could not parse var pragma value 'font_size', expected name=value",
+			},
 		},
 		{
 			name:     "test error when invalid pragma value",
 			line:     "<!-- @pragma debug: invalid -->",
 			expected: Pragma{},
-			wantErr:  true,
+			wantDiag: &PragmaDiagnostic{
+				Severity: SeverityError,
+				Key:      "debug",
+				Value:    "invalid",
+				Line:     1,
+				Message:  "could not parse debug pragma value 'invalid', expected a boolean",
+			},
 		},
 	}
 
@@ -217,12 +288,264 @@ func TestCanExtractPragmaFromLine(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			var got Pragma
-			e := parser.extractPragmaFromLine(&got, tc.line)
+			d := parser.extractPragmaFromLine(&got, tc.line, 1)
+			require.Equal(t, tc.wantDiag, d)
+			require.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestPragmaDiagnostics(t *testing.T) {
+	tests := []struct {
+		name      string
+		srcFile   string
+		strict    bool
+		pragmas   Pragma
+		wantDiags []PragmaDiagnostic
+		wantErr   bool
+	}{
+		{
+			name:    "test collects pragma warnings",
+			srcFile: "testdata/parser/pragma_warnings.litlua.md",
+			pragmas: Pragma{
+				Output: "init.lua",
+			},
+			wantDiags: []PragmaDiagnostic{
+				{
+					Severity:   SeverityWarning,
+					Key:        "ouptut",
+					Value:      "other.lua",
+					Line:       2,
+					Message:    "unknown pragma key 'ouptut'",
+					Suggestion: "output",
+				},
+				{
+					Severity: SeverityWarning,
+					Line:     3,
+					Message:  "malformed pragma, expected <!-- @pragma key: value -->",
+				},
+				{
+					Severity: SeverityWarning,
+					Line:     7,
+					Message:  "pragma ignored, pragmas must be at the top of the file before any other content",
+				},
+			},
+		},
+		{
+			name:    "test fails on pragma warnings in strict mode",
+			srcFile: "testdata/parser/pragma_warnings.litlua.md",
+			strict:  true,
+			wantErr: true,
+		},
+		{
+			name:    "test warnings for pragmas after content",
+			srcFile: "testdata/parser/basic_invalid.litlua.md",
+			wantDiags: []PragmaDiagnostic{
+				{
+					Severity: SeverityWarning,
+					Line:     5,
+					Message:  "pragma ignored, pragmas must be at the top of the file before any other content",
+				},
+				{
+					Severity: SeverityWarning,
+					Line:     6,
+					Message:  "pragma ignored, pragmas must be at the top of the file before any other content",
+				},
+			},
+		},
+		{
+			name:    "test no warnings for valid pragmas in strict mode",
+			srcFile: "testdata/parser/basic_valid.litlua.md",
+			strict:  true,
+			pragmas: Pragma{
+				Output: "init.lua",
+				Debug:  true,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(tc.srcFile)
+			require.NoError(t, err)
+			defer f.Close()
+
+			parser := NewParserWithOptions(ParserOptions{Strict: tc.strict})
+			d, err := parser.ParseMarkdownDoc(f, MetaData{tc.srcFile})
 			if tc.wantErr {
-				require.Error(t, e)
+				var pErr *PragmaError
+				require.ErrorAs(t, err, &pErr)
+				require.NotEmpty(t, pErr.Diagnostics)
 				return
 			}
-			require.Equal(t, tc.expected, got)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.pragmas, d.Pragmas)
+			require.Equal(t, tc.wantDiags, d.PragmaDiagnostics)
+		})
+	}
+}
+
+func TestPragmaDiagnosticsWithoutCodeBlocks(t *testing.T) {
+	content := "<!-- @pragma ouptut: init.lua -->\n\n# Config\n"
+
+	d, err := NewParser().ParseMarkdownDoc(strings.NewReader(content), MetaData{"test.litlua.md"})
+	require.ErrorIs(t, err, ErrNoCodeBlocks)
+	require.NotNil(t, d)
+	require.Len(t, d.PragmaDiagnostics, 1)
+	require.Equal(t, "ouptut", d.PragmaDiagnostics[0].Key)
+	require.Equal(t, "output", d.PragmaDiagnostics[0].Suggestion)
+}
+
+func TestParseFailsOnInvalidPragmaValue(t *testing.T) {
+	content := "<!-- @pragma force: maybe -->\n\n```lua\nprint(1)\n```\n"
+
+	_, err := NewParser().ParseMarkdownDoc(strings.NewReader(content), MetaData{"test.litlua.md"})
+
+	var pErr *PragmaError
+	require.ErrorAs(t, err, &pErr)
+	require.Len(t, pErr.Diagnostics, 1)
+	require.Equal(t, SeverityError, pErr.Diagnostics[0].Severity)
+	require.Equal(t, 1, pErr.Diagnostics[0].Line)
+	require.Equal(t, "force", pErr.Diagnostics[0].Key)
+}
+
+func TestFrontMatterPragmas(t *testing.T) {
+	tests := []struct {
+		name      string
+		srcFile   string
+		pragmas   Pragma
+		blocks    []Position
+		wantDiags []PragmaDiagnostic
+		wantErr   bool
+	}{
+		{
+			name:    "test parse front matter pragmas",
+			srcFile: "testdata/parser/front_matter.litlua.md",
+			pragmas: Pragma{
+				Output: "init.lua",
+				Force:  true,
+				Debug:  true,
+				Vars: map[string]string{
+					"font_size":   "14",
+					"colorscheme": "tokyonight",
+				},
+			},
+			blocks: []Position{{StartLine: 16, EndLine: 17}},
+		},
+		{
+			name:    "test comment pragmas take precedence over front matter",
+			srcFile: "testdata/parser/front_matter_conflict.litlua.md",
+			pragmas: Pragma{
+				Output: "other.lua",
+			},
+			blocks: []Position{{StartLine: 8, EndLine: 9}},
+			wantDiags: []PragmaDiagnostic{
+				{
+					Severity: SeverityWarning,
+					Key:      "output",
+					Value:    "other.lua",
+					Line:     5,
+					Message:  "pragma 'output' is also set in front matter on line 3, this value takes precedence",
+				},
+			},
+		},
+		{
+			name:    "test front matter pragmas are validated",
+			srcFile: "testdata/parser/front_matter_invalid.litlua.md",
+			wantErr: true,
+			wantDiags: []PragmaDiagnostic{
+				{
+					Severity:   SeverityWarning,
+					Key:        "ouptut",
+					Value:      "init.lua",
+					Line:       3,
+					Message:    "unknown pragma key 'ouptut'",
+					Suggestion: "output",
+				},
+				{
+					Severity: SeverityError,
+					Key:      "force",
+					Value:    "maybe",
+					Line:     4,
+					Message:  "could not parse force pragma value 'maybe', expected a boolean",
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(tc.srcFile)
+			require.NoError(t, err)
+			defer f.Close()
+
+			d, err := NewParser().ParseMarkdownDoc(f, MetaData{tc.srcFile})
+			if tc.wantErr {
+				var pErr *PragmaError
+				require.ErrorAs(t, err, &pErr)
+				require.Equal(t, tc.wantDiags, pErr.Diagnostics)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, tc.pragmas, d.Pragmas)
+			require.Equal(t, tc.wantDiags, d.PragmaDiagnostics)
+			require.Len(t, d.Blocks, len(tc.blocks))
+			for i, pos := range tc.blocks {
+				require.Equal(t, pos, d.Blocks[i].Position)
+			}
+		})
+	}
+}
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantFM   string
+		wantRest string
+		// The expected number of front matter lines
+		wantLines int
+		noFM      bool
+	}{
+		{
+			name:      "test front matter",
+			content:   "---\nlitlua:\n  output: init.lua\n---\n# Title\n",
+			wantFM:    "litlua:\n  output: init.lua\n",
+			wantRest:  "\n\n\n\n# Title\n",
+			wantLines: 4,
+		},
+		{
+			name:      "test front matter with yaml document end",
+			content:   "---\nlitlua: {}\n...\n# Title\n",
+			wantFM:    "litlua: {}\n",
+			wantRest:  "\n\n\n# Title\n",
+			wantLines: 3,
+		},
+		{
+			name:    "test no front matter",
+			content: "# Title\n---\nfoo: bar\n---\n",
+			noFM:    true,
+		},
+		{
+			name:    "test unterminated front matter",
+			content: "---\nlitlua:\n  output: init.lua\n# Title\n",
+			noFM:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fm, rest := splitFrontMatter([]byte(tc.content))
+			require.Equal(t, tc.wantLines, FrontMatterLines([]byte(tc.content)))
+			if tc.noFM {
+				require.Nil(t, fm)
+				require.Equal(t, tc.content, string(rest))
+				return
+			}
+			require.Equal(t, tc.wantFM, string(fm))
+			require.Equal(t, tc.wantRest, string(rest))
 		})
 	}
 }
@@ -0,0 +1,138 @@
+package litlua
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+type RenderOptions struct {
+	// Returns a link to show after a lua code block, given the block parsed from the document.
+	// No link is shown if href is empty
+	BlockLink func(block CodeBlock) (href, label string)
+	// Rewrites the destination of links in the document, for example to point links to
+	// other documents at their rendered pages
+	LinkDestination func(dest string) string
+}
+
+// Heading is a heading of a rendered document, used to build a table of contents
+type Heading struct {
+	Level int
+	// The id of the heading element, for linking to the heading
+	ID   string
+	Text string
+	// The 1-indexed line of the heading in the source file
+	Line int
+}
+
+// ParseHeadings returns the headings of a markdown document in order, with the ids they are rendered with
+func (p *Parser) ParseHeadings(r io.Reader) ([]Heading, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	_, content = splitFrontMatter(content)
+	root := p.html.Parser().Parse(text.NewReader(content))
+
+	var headings []Heading
+	err = ast.Walk(root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if node, ok := n.(*ast.Heading); ok && entering {
+			headings = append(headings, newHeading(node, content))
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking document: %w", err)
+	}
+
+	return headings, nil
+}
+
+func newHeading(node *ast.Heading, content []byte) Heading {
+	heading := Heading{Level: node.Level, Text: string(node.Text(content))}
+	if id, ok := node.AttributeString("id"); ok {
+		if b, ok := id.([]byte); ok {
+			heading.ID = string(b)
+		}
+	}
+	if node.Lines().Len() > 0 {
+		heading.Line = getLineNumber(content, node.Lines().At(0).Start)
+	}
+	return heading
+}
+
+// RenderHTML renders the markdown document to HTML, with syntax highlighted code blocks
+//
+// Returns the headings of the document in order. The [CodeBlock] passed to [RenderOptions].BlockLink has the
+// position of the block in the source file, as it has when parsed by [Parser.ParseMarkdownDoc].
+func (p *Parser) RenderHTML(content []byte, w io.Writer, opts RenderOptions) ([]Heading, error) {
+	_, content = splitFrontMatter(content)
+	root := p.html.Parser().Parse(text.NewReader(content))
+
+	var headings []Heading
+	var codeBlocks []*ast.FencedCodeBlock
+	err := ast.Walk(root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch node := n.(type) {
+		case *ast.Heading:
+			headings = append(headings, newHeading(node, content))
+		case *ast.Link:
+			if opts.LinkDestination != nil {
+				node.Destination = []byte(opts.LinkDestination(string(node.Destination)))
+			}
+		case *ast.FencedCodeBlock:
+			if string(node.Language(content)) == "lua" && node.Lines().Len() > 0 {
+				codeBlocks = append(codeBlocks, node)
+			}
+		}
+
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking document: %w", err)
+	}
+
+	// Links are inserted after walking, so we don't walk the nodes we insert
+	if opts.BlockLink != nil {
+		for _, cb := range codeBlocks {
+			lines := cb.Lines()
+			block := CodeBlock{
+				Position: Position{
+					StartLine: getLineNumber(content, lines.At(0).Start),
+					EndLine:   getLineNumber(content, lines.At(lines.Len()-1).Stop),
+				},
+			}
+			for i := 0; i < lines.Len(); i++ {
+				line := lines.At(i)
+				block.Code += string(line.Value(content))
+			}
+
+			href, label := opts.BlockLink(block)
+			if href == "" {
+				continue
+			}
+
+			link := ast.NewLink()
+			link.Destination = []byte(href)
+			link.AppendChild(link, ast.NewString([]byte(label)))
+
+			para := ast.NewParagraph()
+			para.SetAttributeString("class", []byte("litlua-output"))
+			para.AppendChild(para, link)
+
+			cb.Parent().InsertAfter(cb.Parent(), cb, para)
+		}
+	}
+
+	if err := p.html.Renderer().Render(w, content, root); err != nil {
+		return nil, fmt.Errorf("rendering document: %w", err)
+	}
+
+	return headings, nil
+}
@@ -0,0 +1,74 @@
+package litlua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderHTML(t *testing.T) {
+	content := `---
+litlua:
+  output: init.lua
+---
+# Options
+
+See [keymaps](./keymaps.litlua.md#leader) and [the docs](https://neovim.io).
+
+## Numbers
+
+` + "```lua" + `
+vim.o.number = true
+` + "```" + `
+
+` + "```lua test" + `
+assert(vim.o.number)
+` + "```" + `
+`
+
+	var linked []int
+	var out strings.Builder
+	headings, err := NewParser().RenderHTML([]byte(content), &out, RenderOptions{
+		BlockLink: func(block CodeBlock) (string, string) {
+			linked = append(linked, block.Position.StartLine)
+			if strings.Contains(block.Code, "assert") {
+				return "", ""
+			}
+			return "init.lua.html#L9", "init.lua:9"
+		},
+		LinkDestination: func(dest string) string {
+			return strings.Replace(dest, ".litlua.md", ".html", 1)
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []Heading{
+		{Level: 1, ID: "options", Text: "Options", Line: 5},
+		{Level: 2, ID: "numbers", Text: "Numbers", Line: 9},
+	}, headings)
+
+	html := out.String()
+	require.Contains(t, html, `<h1 id="options">Options</h1>`)
+	require.Contains(t, html, `<a href="./keymaps.html#leader">keymaps</a>`)
+	require.Contains(t, html, `<a href="https://neovim.io">the docs</a>`)
+	// Code blocks are syntax highlighted
+	require.Contains(t, html, `<pre style=`)
+	// Block positions match the parser, front matter lines included
+	require.Equal(t, []int{12, 16}, linked)
+	require.Equal(t, 1, strings.Count(html, `<p class="litlua-output"><a href="init.lua.html#L9">init.lua:9</a></p>`))
+	// Front matter is not rendered
+	require.NotContains(t, html, "litlua:")
+}
+
+func TestParseHeadings(t *testing.T) {
+	content := "<!-- @pragma output: init.lua -->\n\n# Options\n\nSetext\n------\n\n```lua\n# not a heading\n```\n\n### Deep\n"
+
+	headings, err := NewParser().ParseHeadings(strings.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, []Heading{
+		{Level: 1, ID: "options", Text: "Options", Line: 3},
+		{Level: 2, ID: "setext", Text: "Setext", Line: 5},
+		{Level: 3, ID: "deep", Text: "Deep", Line: 12},
+	}, headings)
+}
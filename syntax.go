@@ -0,0 +1,102 @@
+package litlua
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// LuaSyntaxError is a syntax error in the generated Lua, mapped back to the markdown source
+type LuaSyntaxError struct {
+	// The markdown source file
+	Source string
+	// The 1-indexed line in the markdown source file
+	Line int
+	// The 1-indexed column in the line, 0 if unknown
+	Column int
+	// The token the error was found near, if any
+	Token string
+	// The error reported by the Lua parser
+	Message string
+}
+
+func (e *LuaSyntaxError) Error() string {
+	if e.Token != "" {
+		return fmt.Sprintf("lua syntax error in %s:%d:%d near '%s': %s", e.Source, e.Line, e.Column, e.Token, e.Message)
+	}
+	return fmt.Sprintf("lua syntax error in %s:%d: %s", e.Source, e.Line, e.Message)
+}
+
+// ValidateLuaSyntax parses the code blocks of the document as a single Lua chunk, exactly as they would be
+// written by the pretty writer, and returns a [LuaSyntaxError] if the Lua is invalid.
+//
+// The line of the error in the generated Lua is mapped back to the markdown line through the [Position] of
+// the code block it came from. Errors at the end of the chunk (such as a missing `end`) are reported at the
+// last line of code of the last code block.
+func ValidateLuaSyntax(doc *Document) error {
+	if len(doc.Blocks) == 0 {
+		return nil
+	}
+
+	var chunk strings.Builder
+	// The first generated line of each block
+	blockStarts := make([]int, len(doc.Blocks))
+	line := 1
+	for i, block := range doc.Blocks {
+		blockStarts[i] = line
+		// Matches the pretty writer, which writes a newline after each block
+		code := block.Code + "\n"
+		chunk.WriteString(code)
+		line += strings.Count(code, "\n")
+	}
+
+	_, err := parse.Parse(strings.NewReader(chunk.String()), doc.Metadata.AbsSource)
+	if err == nil {
+		return nil
+	}
+
+	var pErr *parse.Error
+	if !errors.As(err, &pErr) {
+		return fmt.Errorf("lua syntax error in %s: %w", doc.Metadata.AbsSource, err)
+	}
+
+	syntaxErr := &LuaSyntaxError{
+		Source:  doc.Metadata.AbsSource,
+		Column:  pErr.Pos.Column,
+		Token:   pErr.Token,
+		Message: pErr.Message,
+	}
+
+	if pErr.Pos.Line == parse.EOF {
+		syntaxErr.Line = lastCodeLine(doc.Blocks[len(doc.Blocks)-1])
+		syntaxErr.Column = 0
+		syntaxErr.Token = ""
+		syntaxErr.Message = "unexpected end of file, a block may be missing an 'end'"
+		return syntaxErr
+	}
+
+	syntaxErr.Line = mapGeneratedLine(doc.Blocks, blockStarts, pErr.Pos.Line)
+	return syntaxErr
+}
+
+// mapGeneratedLine maps a line of the generated Lua to the line in the markdown source
+func mapGeneratedLine(blocks []CodeBlock, blockStarts []int, generatedLine int) int {
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if generatedLine >= blockStarts[i] {
+			mdLine := blocks[i].Position.StartLine + (generatedLine - blockStarts[i])
+			// The trailing newline written after each block has no markdown line, so we clamp
+			// to the last line of code in the block
+			return min(mdLine, lastCodeLine(blocks[i]))
+		}
+	}
+	return generatedLine
+}
+
+// lastCodeLine returns the markdown line of the last line of code in a block
+//
+// The end line of a block is the closing fence, so the code ends on the line before
+func lastCodeLine(block CodeBlock) int {
+	return max(block.Position.StartLine, block.Position.EndLine-1)
+}
@@ -0,0 +1,68 @@
+package litlua
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateLuaSyntax(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocks  []CodeBlock
+		wantErr *LuaSyntaxError
+	}{
+		{
+			name: "test valid lua across blocks",
+			blocks: []CodeBlock{
+				{Code: "local function add(a, b)\n", Position: Position{StartLine: 5, EndLine: 6}},
+				{Code: "    return a + b\nend\nprint(add(1, 2))\n", Position: Position{StartLine: 10, EndLine: 13}},
+			},
+		},
+		{
+			name: "test missing end is reported at the last line of code",
+			blocks: []CodeBlock{
+				{Code: "local x = 1\n", Position: Position{StartLine: 5, EndLine: 6}},
+				{Code: "if x then\n  print(x)\n", Position: Position{StartLine: 10, EndLine: 12}},
+			},
+			wantErr: &LuaSyntaxError{
+				Source:  "test.litlua.md",
+				Line:    11,
+				Message: "unexpected end of file, a block may be missing an 'end'",
+			},
+		},
+		{
+			name: "test error is mapped to the markdown line of the block",
+			blocks: []CodeBlock{
+				{Code: "local x = 1\nprint(x)\n", Position: Position{StartLine: 5, EndLine: 7}},
+				{Code: "local y = = 2\n", Position: Position{StartLine: 20, EndLine: 21}},
+			},
+			wantErr: &LuaSyntaxError{
+				Source:  "test.litlua.md",
+				Line:    20,
+				Column:  11,
+				Token:   "=",
+				Message: "syntax error",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := &Document{
+				Metadata: MetaData{AbsSource: "test.litlua.md"},
+				Blocks:   tc.blocks,
+			}
+
+			err := ValidateLuaSyntax(doc)
+			if tc.wantErr == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			var syntaxErr *LuaSyntaxError
+			require.ErrorAs(t, err, &syntaxErr)
+			require.Equal(t, tc.wantErr, syntaxErr)
+		})
+	}
+}
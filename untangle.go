@@ -0,0 +1,263 @@
+package litlua
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Written before each block in pretty mode when block markers are enabled, followed by the
+	// markdown line of the first line of code in the block and the [blockHash] of the code written
+	blockBeginMarker = "-- litlua:begin "
+	// Written after each block in pretty mode when block markers are enabled
+	blockEndMarker = "-- litlua:end"
+	// The header line of a generated file containing the markdown source file
+	sourceHeaderPrefix = "-- Source: "
+)
+
+// UntangleError is returned when a generated Lua file can not be safely mapped back to its markdown source
+type UntangleError struct {
+	// The generated Lua file
+	Output string
+	// The 1-indexed line in the generated Lua file, 0 if the problem is not with a single line
+	Line    int
+	Message string
+}
+
+func (e *UntangleError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("cannot untangle %s:%d: %s", e.Output, e.Line, e.Message)
+	}
+	return fmt.Sprintf("cannot untangle %s: %s", e.Output, e.Message)
+}
+
+// OutputRegion is the code of a single code block, read back from a generated Lua file
+type OutputRegion struct {
+	// The markdown line of the first line of code in the block the region was written from
+	BlockLine int
+	// The 1-indexed line of the begin marker in the generated Lua file
+	OutputLine int
+	// The [blockHash] of the code of the block when the file was generated
+	Hash string
+	Code string
+}
+
+// GeneratedOutput is a generated Lua file, split into the regions written for each code block
+type GeneratedOutput struct {
+	// The generated Lua file
+	Path string
+	// The markdown source file, as written in the generated header
+	Source  string
+	Regions []OutputRegion
+}
+
+// ReadGeneratedOutput reads a Lua file generated with block markers, see [WriterOptions]
+//
+// Returns an [UntangleError] if any code can not be attributed to exactly one code block,
+// such as code written outside of a block, or markers that were removed or duplicated.
+func ReadGeneratedOutput(r io.Reader, path string) (*GeneratedOutput, error) {
+	out := &GeneratedOutput{Path: path}
+	fail := func(line int, format string, args ...any) error {
+		return &UntangleError{Output: path, Line: line, Message: fmt.Sprintf(format, args...)}
+	}
+
+	var current *OutputRegion
+	var code []string
+	seen := make(map[int]int)
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, blockBeginMarker):
+			if current != nil {
+				return nil, fail(lineNo, "block marker found before the block on line %d was closed", current.OutputLine)
+			}
+
+			fields := strings.Fields(strings.TrimPrefix(trimmed, blockBeginMarker))
+			if len(fields) != 2 {
+				return nil, fail(lineNo, "invalid block marker '%s', expected '%s<line> <hash>'", trimmed, blockBeginMarker)
+			}
+			blockLine, err := strconv.Atoi(fields[0])
+			if err != nil || blockLine <= 0 {
+				return nil, fail(lineNo, "invalid block marker '%s'", trimmed)
+			}
+			if prev, ok := seen[blockLine]; ok {
+				return nil, fail(lineNo, "block from markdown line %d was already written on line %d", blockLine, prev)
+			}
+			seen[blockLine] = lineNo
+
+			current = &OutputRegion{BlockLine: blockLine, OutputLine: lineNo, Hash: fields[1]}
+			code = nil
+
+		case trimmed == blockEndMarker:
+			if current == nil {
+				return nil, fail(lineNo, "block end marker without a matching begin marker")
+			}
+
+			if len(code) > 0 {
+				current.Code = strings.Join(code, "\n") + "\n"
+			}
+			out.Regions = append(out.Regions, *current)
+			current = nil
+
+		case current != nil:
+			code = append(code, line)
+
+		case trimmed == "":
+			// Blank lines between blocks are written by the writer
+
+		case len(out.Regions) == 0 && strings.HasPrefix(trimmed, "--"):
+			// The generated header
+			if source, ok := strings.CutPrefix(trimmed, sourceHeaderPrefix); ok && out.Source == "" {
+				out.Source = strings.TrimSpace(source)
+			}
+
+		default:
+			return nil, fail(lineNo, "code outside of a block marker can not be mapped to a code block")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if current != nil {
+		return nil, fail(current.OutputLine, "block is never closed with '%s'", blockEndMarker)
+	}
+	if out.Source == "" {
+		return nil, fail(0, "no '%s' header found, the file was not generated by litlua", strings.TrimSpace(sourceHeaderPrefix))
+	}
+	if len(out.Regions) == 0 {
+		return nil, fail(0, "no block markers found, the file must be generated with block markers enabled")
+	}
+
+	return out, nil
+}
+
+// BlockUpdate is the new code of a single code block in the markdown source
+type BlockUpdate struct {
+	// The code block as parsed from the markdown source
+	Block CodeBlock
+	Code  string
+}
+
+// Untangle matches each region of the generated output to the code block of the document it was written from,
+// returning an update for every block whose code has changed.
+//
+// The document must be parsed from the markdown source as it is now. Variables are substituted into each block
+// before comparing, so unchanged blocks using variables are skipped. Changed blocks using variables can not be
+// untangled, as we can't know which part of the code came from a variable.
+//
+// A changed region is only written back if its block is unchanged since the output was generated, checked
+// against the hash in the begin marker, so a stale output never reverts newer edits to the markdown.
+//
+// Returns an [UntangleError] if the markdown source no longer matches the generated output.
+func Untangle(doc *Document, vars map[string]string, out *GeneratedOutput) ([]BlockUpdate, error) {
+	fail := func(line int, format string, args ...any) error {
+		return &UntangleError{Output: out.Path, Line: line, Message: fmt.Sprintf(format, args...)}
+	}
+
+	regions := make(map[int]OutputRegion, len(out.Regions))
+	for _, region := range out.Regions {
+		regions[region.BlockLine] = region
+	}
+
+	blocks := make(map[int]CodeBlock, len(doc.Blocks))
+	for _, block := range doc.Blocks {
+		blocks[block.Position.StartLine] = block
+	}
+
+	var updates []BlockUpdate
+	for _, region := range out.Regions {
+		block, ok := blocks[region.BlockLine]
+		if !ok {
+			return nil, fail(region.OutputLine, "no code block starts on markdown line %d, the markdown has changed since it was generated", region.BlockLine)
+		}
+
+		expanded, undefined := substituteBlocks([]CodeBlock{block}, vars, doc.Pragmas.Expand)
+		if len(undefined) > 0 {
+			return nil, &VariableError{Source: doc.Metadata.AbsSource, Undefined: undefined}
+		}
+
+		if expanded[0].Code == region.Code {
+			continue
+		}
+
+		if blockHash(expanded[0].Code) != region.Hash {
+			return nil, fail(region.OutputLine, "code block on markdown line %d has changed since the output was generated, generate the output again before editing it", region.BlockLine)
+		}
+
+		if expanded[0].Code != block.Code {
+			return nil, fail(region.OutputLine, "code block on markdown line %d uses variables and can not be untangled, update it by hand", region.BlockLine)
+		}
+
+		updates = append(updates, BlockUpdate{Block: block, Code: region.Code})
+	}
+
+	for _, block := range doc.Blocks {
+		if _, ok := regions[block.Position.StartLine]; !ok {
+			return nil, fail(0, "code block on markdown line %d is missing from the output, the markdown has changed since it was generated", block.Position.StartLine)
+		}
+	}
+
+	return updates, nil
+}
+
+// blockHash returns the hash of the code of a block as it is written to the output
+func blockHash(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSuffix(code, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ApplyBlockUpdates replaces the code of each updated block in the markdown content
+//
+// Only the lines between the fences of each block are replaced, so prose and the fences themselves
+// are untouched. The indentation of the opening fence is applied to each line of new code.
+func ApplyBlockUpdates(content []byte, updates []BlockUpdate) ([]byte, error) {
+	lines := strings.SplitAfter(string(content), "\n")
+
+	// Apply from the bottom of the file up, so earlier line numbers stay valid
+	sorted := slices.Clone(updates)
+	slices.SortFunc(sorted, func(a, b BlockUpdate) int {
+		return b.Block.Position.StartLine - a.Block.Position.StartLine
+	})
+
+	for _, update := range sorted {
+		// Lines are 1-indexed, the fence is on the line before the first line of code,
+		// and the end line is the closing fence
+		start := update.Block.Position.StartLine - 1
+		end := update.Block.Position.EndLine - 1
+		if start < 1 || end < start || end > len(lines) {
+			return nil, fmt.Errorf("code block on line %d is out of range of the markdown source", update.Block.Position.StartLine)
+		}
+
+		fence := lines[start-1]
+		indent := fence[:len(fence)-len(strings.TrimLeft(fence, " \t"))]
+
+		var code []string
+		if update.Code != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(update.Code, "\n"), "\n") {
+				if line == "" {
+					code = append(code, "\n")
+					continue
+				}
+				code = append(code, indent+line+"\n")
+			}
+		}
+
+		lines = slices.Concat(lines[:start], code, lines[end:])
+	}
+
+	return []byte(strings.Join(lines, "")), nil
+}
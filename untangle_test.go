@@ -0,0 +1,220 @@
+package litlua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const untangleMarkdown = `<!-- @pragma output: init.lua -->
+
+# Options
+
+Prose is never touched.
+
+` + "```lua" + `
+vim.o.number = true
+vim.o.relativenumber = true
+` + "```" + `
+
+- Indented blocks keep their indentation:
+
+  ` + "```lua" + `
+  local x = 1
+  ` + "```" + `
+
+` + "```lua" + `
+vim.o.tabstop = {{ .tab }}
+` + "```" + `
+`
+
+// tangle writes the markdown with block markers, as the transformer would
+func tangle(t *testing.T, markdown string, vars map[string]string) (*Document, string) {
+	t.Helper()
+
+	doc, err := NewParser().ParseMarkdownDoc(strings.NewReader(markdown), MetaData{AbsSource: "/config/test.litlua.md"})
+	require.NoError(t, err)
+
+	written := *doc
+	require.NoError(t, SubstituteVariables(&written, vars))
+
+	var out strings.Builder
+	w := NewWriterWithOptions(ModePretty, WriterOptions{BlockMarkers: true})
+	require.NoError(t, w.WriteHeader(&out, WriterMetadata{AbsSource: doc.Metadata.AbsSource}))
+	require.NoError(t, w.WriteContent(&written, &out))
+
+	return doc, out.String()
+}
+
+func TestUntangle(t *testing.T) {
+	vars := map[string]string{"tab": "4"}
+
+	tests := []struct {
+		name         string
+		edit         func(lua string) string
+		wantMarkdown string
+		wantUpdates  int
+	}{
+		{
+			name:         "test unchanged output has no updates",
+			edit:         func(lua string) string { return lua },
+			wantMarkdown: untangleMarkdown,
+		},
+		{
+			name: "test edited block is written back to its fence",
+			edit: func(lua string) string {
+				return strings.Replace(lua, "relativenumber = true", "relativenumber = false\nvim.o.wrap = false", 1)
+			},
+			wantMarkdown: strings.Replace(untangleMarkdown, "relativenumber = true", "relativenumber = false\nvim.o.wrap = false", 1),
+			wantUpdates:  1,
+		},
+		{
+			name: "test indented block keeps the fence indentation",
+			edit: func(lua string) string {
+				return strings.Replace(lua, "local x = 1", "local x = 1\nlocal y = 2", 1)
+			},
+			wantMarkdown: strings.Replace(untangleMarkdown, "  local x = 1\n", "  local x = 1\n  local y = 2\n", 1),
+			wantUpdates:  1,
+		},
+		{
+			name: "test emptied block is written back as an empty fence",
+			edit: func(lua string) string {
+				return strings.Replace(lua, "local x = 1\n", "", 1)
+			},
+			wantMarkdown: strings.Replace(untangleMarkdown, "  local x = 1\n", "", 1),
+			wantUpdates:  1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, lua := tangle(t, untangleMarkdown, vars)
+
+			out, err := ReadGeneratedOutput(strings.NewReader(tc.edit(lua)), "/config/init.litlua.lua")
+			require.NoError(t, err)
+			require.Equal(t, "/config/test.litlua.md", out.Source)
+
+			updates, err := Untangle(doc, vars, out)
+			require.NoError(t, err)
+			require.Len(t, updates, tc.wantUpdates)
+
+			got, err := ApplyBlockUpdates([]byte(untangleMarkdown), updates)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantMarkdown, string(got))
+		})
+	}
+}
+
+func TestUntangleRefusesAmbiguousOutput(t *testing.T) {
+	vars := map[string]string{"tab": "4"}
+
+	tests := []struct {
+		name        string
+		markdown    string
+		edit        func(lua string) string
+		wantReadErr bool
+		wantErr     string
+	}{
+		{
+			name: "test code outside of a block",
+			edit: func(lua string) string {
+				return lua + "vim.o.wrap = false\n"
+			},
+			wantReadErr: true,
+			wantErr:     "code outside of a block marker can not be mapped to a code block",
+		},
+		{
+			name: "test removed end marker",
+			edit: func(lua string) string {
+				return strings.Replace(lua, blockEndMarker+"\n", "", 1)
+			},
+			wantReadErr: true,
+			wantErr:     "block marker found before the block on line 9 was closed",
+		},
+		{
+			name: "test duplicated block",
+			edit: func(lua string) string {
+				return lua + blockBeginMarker + "8 " + blockHash("print(1)") + "\nprint(1)\n" + blockEndMarker + "\n"
+			},
+			wantReadErr: true,
+			wantErr:     "block from markdown line 8 was already written on line 9",
+		},
+		{
+			name: "test marker without a hash",
+			edit: func(lua string) string {
+				return strings.Replace(lua, blockBeginMarker+"8 "+blockHash("vim.o.number = true\nvim.o.relativenumber = true"), blockBeginMarker+"8", 1)
+			},
+			wantReadErr: true,
+			wantErr:     "invalid block marker '-- litlua:begin 8'",
+		},
+		{
+			name: "test output without markers",
+			edit: func(lua string) string {
+				return "-- Source: /config/test.litlua.md\n"
+			},
+			wantReadErr: true,
+			wantErr:     "no block markers found",
+		},
+		{
+			name:     "test markdown changed since the output was generated",
+			markdown: strings.Replace(untangleMarkdown, "# Options\n", "# Options\n\nMore prose.\n", 1),
+			edit:     func(lua string) string { return lua },
+			wantErr:  "no code block starts on markdown line 8",
+		},
+		{
+			name:     "test block added to the markdown since the output was generated",
+			markdown: untangleMarkdown + "\n```lua\nprint(1)\n```\n",
+			edit:     func(lua string) string { return lua },
+			wantErr:  "code block on markdown line 23 is missing from the output",
+		},
+		{
+			name:     "test stale output does not revert newer markdown edits",
+			markdown: strings.Replace(untangleMarkdown, "relativenumber = true", "relativenumber = false", 1),
+			edit:     func(lua string) string { return lua },
+			wantErr:  "code block on markdown line 8 has changed since the output was generated",
+		},
+		{
+			name:     "test block edited in both the markdown and the output",
+			markdown: strings.Replace(untangleMarkdown, "relativenumber = true", "relativenumber = false", 1),
+			edit: func(lua string) string {
+				return strings.Replace(lua, "vim.o.number = true", "vim.o.number = false", 1)
+			},
+			wantErr: "code block on markdown line 8 has changed since the output was generated",
+		},
+		{
+			name: "test changed block using variables",
+			edit: func(lua string) string {
+				return strings.Replace(lua, "tabstop = 4", "tabstop = 8", 1)
+			},
+			wantErr: "code block on markdown line 19 uses variables and can not be untangled",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, lua := tangle(t, untangleMarkdown, vars)
+
+			out, err := ReadGeneratedOutput(strings.NewReader(tc.edit(lua)), "/config/init.litlua.lua")
+			if tc.wantReadErr {
+				var untangleErr *UntangleError
+				require.ErrorAs(t, err, &untangleErr)
+				require.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			markdown := untangleMarkdown
+			if tc.markdown != "" {
+				markdown = tc.markdown
+			}
+			doc, err := NewParser().ParseMarkdownDoc(strings.NewReader(markdown), MetaData{AbsSource: "/config/test.litlua.md"})
+			require.NoError(t, err)
+
+			_, err = Untangle(doc, vars, out)
+			var untangleErr *UntangleError
+			require.ErrorAs(t, err, &untangleErr)
+			require.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package litlua
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// variableRegex matches variable placeholders in code blocks
+//
+// Supported forms are {{ .name }}, and ${name} and ${env:NAME} in documents with the expand pragma.
+// $${name} is an escape for a literal ${name}
+var variableRegex = regexp.MustCompile(`\{\{\s*\.([A-Za-z_]\w*)\s*\}\}|\$?\$\{((?:env:)?[A-Za-z_]\w*)\}`)
+
+// envPrefix marks a ${env:NAME} placeholder, which is resolved from the environment
+const envPrefix = "env:"
+
+// UndefinedVariable is a variable placeholder that could not be resolved
+type UndefinedVariable struct {
+	// The variable name, with the env: prefix for environment variables
+	Name string
+	// The 1-indexed line of the placeholder in the source file
+	Line int
+	// The 1-indexed column of the placeholder in the line
+	Column int
+}
+
+// VariableError is returned when code blocks reference undefined variables
+type VariableError struct {
+	Source    string
+	Undefined []UndefinedVariable
+}
+
+func (e *VariableError) Error() string {
+	msgs := make([]string, 0, len(e.Undefined))
+	for _, u := range e.Undefined {
+		msgs = append(msgs, fmt.Sprintf("'%s' (line %d:%d)", u.Name, u.Line, u.Column))
+	}
+	return fmt.Sprintf("undefined variables in %s: %s", e.Source, strings.Join(msgs, ", "))
+}
+
+// SubstituteVariables replaces all variable placeholders in the document code blocks with their values
+//
+// {{ .name }} and ${name} placeholders are resolved from vars, ${env:NAME} placeholders from the environment.
+// ${} placeholders are only substituted when the expand pragma is set, and are kept as they are otherwise.
+//
+// Returns a [VariableError] listing every placeholder that could not be resolved, in which case the
+// document is left unchanged.
+func SubstituteVariables(doc *Document, vars map[string]string) error {
+	blocks, undefined := substituteBlocks(doc.Blocks, vars, doc.Pragmas.Expand)
+	testBlocks, testUndefined := substituteBlocks(doc.TestBlocks, vars, doc.Pragmas.Expand)
+	undefined = append(undefined, testUndefined...)
+
+	if len(undefined) > 0 {
+		return &VariableError{Source: doc.Metadata.AbsSource, Undefined: undefined}
+	}
+
+	doc.Blocks = blocks
+	doc.TestBlocks = testBlocks
+	return nil
+}
+
+// substituteBlocks returns a copy of the blocks with all placeholders substituted, and any undefined variables
+func substituteBlocks(codeBlocks []CodeBlock, vars map[string]string, expand bool) ([]CodeBlock, []UndefinedVariable) {
+	var undefined []UndefinedVariable
+	if codeBlocks == nil {
+		return nil, nil
+	}
+	blocks := make([]CodeBlock, len(codeBlocks))
+
+	for i, block := range codeBlocks {
+		lines := strings.Split(block.Code, "\n")
+		for j, line := range lines {
+			lines[j] = replacePlaceholders(line, expand, func(name string, env bool, col int) (string, bool) {
+				if env {
+					if v, ok := os.LookupEnv(name); ok {
+						return v, true
+					}
+					name = envPrefix + name
+				} else if v, ok := vars[name]; ok {
+					return v, true
+				}
+
+				undefined = append(undefined, UndefinedVariable{
+					Name:   name,
+					Line:   block.Position.StartLine + j,
+					Column: col + 1,
+				})
+				return "", false
+			})
+		}
+
+		blocks[i] = block
+		blocks[i].Code = strings.Join(lines, "\n")
+	}
+
+	return blocks, undefined
+}
+
+// MaskVariables replaces all variable placeholders in the document code blocks with a placeholder-safe value
+//
+// Used for LSP shadow files, each placeholder is replaced with `nil` padded to the width of the placeholder.
+// This keeps the Lua valid whether the placeholder is used as an expression or within a string,
+// and preserves both line and column positions of the code. Undefined variables are never an error.
+func MaskVariables(doc *Document) {
+	for _, blocks := range [][]CodeBlock{doc.Blocks, doc.TestBlocks} {
+		for i := range blocks {
+			blocks[i].Code = replacePlaceholders(blocks[i].Code, doc.Pragmas.Expand, func(_ string, _ bool, _ int) (string, bool) {
+				return "", false
+			})
+		}
+	}
+}
+
+// ContainsVariables returns true if code contains a placeholder that is substituted, or masked in LSP shadow files,
+// in a document with the given expand pragma
+//
+// Code containing placeholders can't be mapped 1:1 to the shadow file, as it is written differently there.
+func ContainsVariables(code string, expand bool) bool {
+	for _, m := range variableRegex.FindAllString(code, -1) {
+		if expand || !strings.HasPrefix(m, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// replacePlaceholders replaces each placeholder in s with the value returned by resolve
+//
+// ${} placeholders are only replaced if expand is true. resolve is called with the variable name, whether it
+// is an environment variable (${env:NAME} form) and the 0-indexed byte offset of the placeholder. If resolve
+// returns false, the placeholder is masked with `nil` padded to the same width.
+func replacePlaceholders(s string, expand bool, resolve func(name string, env bool, col int) (string, bool)) string {
+	matches := variableRegex.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(s[last:m[0]])
+		last = m[1]
+
+		placeholder := s[m[0]:m[1]]
+		if strings.HasPrefix(placeholder, "$") && !expand {
+			b.WriteString(placeholder)
+			continue
+		}
+		if strings.HasPrefix(placeholder, "$$") {
+			// Escaped, write the literal ${name}
+			b.WriteString(placeholder[1:])
+			continue
+		}
+
+		name, env := "", false
+		if m[2] >= 0 {
+			name = s[m[2]:m[3]]
+		} else {
+			name, env = strings.CutPrefix(s[m[4]:m[5]], envPrefix)
+		}
+
+		if v, ok := resolve(name, env, m[0]); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString("nil" + strings.Repeat(" ", len(placeholder)-len("nil")))
+		}
+	}
+	b.WriteString(s[last:])
+
+	return b.String()
+}
+
+// LoadVariablesFile loads variables from a YAML file containing a flat mapping of names to values
+//
+// For example:
+//
+//	font_size: 14
+//	colorscheme: tokyonight
+func LoadVariablesFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading variables file: %w", err)
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("parsing variables file: %w", err)
+	}
+
+	vars := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v.(type) {
+		case nil:
+			vars[k] = ""
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("variable '%s' in %s must be a single value", k, path)
+		default:
+			vars[k] = fmt.Sprint(v)
+		}
+	}
+
+	return vars, nil
+}
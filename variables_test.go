@@ -0,0 +1,155 @@
+package litlua
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubstituteVariables(t *testing.T) {
+	t.Setenv("LITLUA_TEST_HOME", "/home/test")
+
+	tests := []struct {
+		name          string
+		code          string
+		vars          map[string]string
+		expand        bool
+		want          string
+		wantUndefined []UndefinedVariable
+	}{
+		{
+			name: "test go template style variable",
+			code: "config.font_size = {{ .font_size }}\n",
+			vars: map[string]string{"font_size": "14"},
+			want: "config.font_size = 14\n",
+		},
+		{
+			name:   "test shell style variable",
+			code:   "vim.cmd.colorscheme(\"${colorscheme}\")\n",
+			vars:   map[string]string{"colorscheme": "tokyonight"},
+			expand: true,
+			want:   "vim.cmd.colorscheme(\"tokyonight\")\n",
+		},
+		{
+			name: "test shell style variable is kept without the expand pragma",
+			code: "vim.cmd.colorscheme(\"${colorscheme}\")\nprint(\"$${HOME}\")\n",
+			vars: map[string]string{"colorscheme": "tokyonight"},
+			want: "vim.cmd.colorscheme(\"${colorscheme}\")\nprint(\"$${HOME}\")\n",
+		},
+		{
+			name:   "test env prefixed variable is resolved from the environment",
+			code:   "local path = \"${env:LITLUA_TEST_HOME}/.config\"\n",
+			expand: true,
+			want:   "local path = \"/home/test/.config\"\n",
+		},
+		{
+			name:   "test shell style variable never falls back to environment",
+			code:   "local path = \"${LITLUA_TEST_HOME}\"\nlocal other = \"${env:LITLUA_TEST_MISSING}\"\n",
+			expand: true,
+			wantUndefined: []UndefinedVariable{
+				{Name: "LITLUA_TEST_HOME", Line: 10, Column: 15},
+				{Name: "env:LITLUA_TEST_MISSING", Line: 11, Column: 16},
+			},
+		},
+		{
+			name:   "test escaped shell style variable",
+			code:   "vim.fn.system(\"echo $${HOME}\")\n",
+			expand: true,
+			want:   "vim.fn.system(\"echo ${HOME}\")\n",
+		},
+		{
+			name: "test lua nested tables are not variables",
+			code: "local t = {{1, 2}, {.5}}\n",
+			want: "local t = {{1, 2}, {.5}}\n",
+		},
+		{
+			name: "test template style variables never fall back to environment",
+			code: "print(\"{{.LITLUA_TEST_HOME}}\")\nprint({{ .missing }})\n",
+			wantUndefined: []UndefinedVariable{
+				{Name: "LITLUA_TEST_HOME", Line: 10, Column: 8},
+				{Name: "missing", Line: 11, Column: 7},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := &Document{
+				Metadata: MetaData{AbsSource: "test.litlua.md"},
+				Pragmas:  Pragma{Expand: tc.expand},
+				Blocks: []CodeBlock{
+					{
+						Code:     tc.code,
+						Position: Position{StartLine: 10, EndLine: 12},
+					},
+				},
+			}
+
+			err := SubstituteVariables(doc, tc.vars)
+			if tc.wantUndefined != nil {
+				var vErr *VariableError
+				require.ErrorAs(t, err, &vErr)
+				require.Equal(t, tc.wantUndefined, vErr.Undefined)
+				// document is unchanged on error
+				require.Equal(t, tc.code, doc.Blocks[0].Code)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, doc.Blocks[0].Code)
+		})
+	}
+}
+
+func TestMaskVariables(t *testing.T) {
+	const code = "config.font_size = {{ .font_size }} -- size\nlocal p = \"${HOME}/x\"\nprint(\"$${HOME}\")\n"
+
+	doc := &Document{Pragmas: Pragma{Expand: true}, Blocks: []CodeBlock{{Code: code}}}
+	MaskVariables(doc)
+	require.Equal(t, "config.font_size = nil              -- size\nlocal p = \"nil    /x\"\nprint(\"${HOME}\")\n", doc.Blocks[0].Code)
+
+	// ${} is kept as it is without the expand pragma
+	doc = &Document{Blocks: []CodeBlock{{Code: code}}}
+	MaskVariables(doc)
+	require.Equal(t, "config.font_size = nil              -- size\nlocal p = \"${HOME}/x\"\nprint(\"$${HOME}\")\n", doc.Blocks[0].Code)
+}
+
+func TestLoadVariablesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vars.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("font_size: 14\ncolorscheme: tokyonight\nenabled: true\nempty:\n"), 0644))
+
+	vars, err := LoadVariablesFile(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"font_size":   "14",
+		"colorscheme": "tokyonight",
+		"enabled":     "true",
+		"empty":       "",
+	}, vars)
+
+	require.NoError(t, os.WriteFile(path, []byte("fonts:\n  - a\n  - b\n"), 0644))
+	_, err = LoadVariablesFile(path)
+	require.Error(t, err)
+}
+
+func TestContainsVariables(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   string
+		expand bool
+		want   bool
+	}{
+		{name: "test template style variable", code: "local x = {{ .x }}", want: true},
+		{name: "test shell style variable without expand", code: "local x = \"${x}\""},
+		{name: "test shell style variable with expand", code: "local x = \"${x}\"", expand: true, want: true},
+		{name: "test escaped shell style variable with expand", code: "local x = \"$${x}\"", expand: true, want: true},
+		{name: "test no variables", code: "local t = {{1}}", expand: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, ContainsVariables(tc.code, tc.expand))
+		})
+	}
+}
@@ -19,6 +19,13 @@ const (
 // Writer writes a parsed Markdown Document to the configured output writer
 type Writer struct {
 	mode WriteMode
+	opts WriterOptions
+}
+
+type WriterOptions struct {
+	// If true, each block is wrapped in begin/end marker comments in pretty mode,
+	// so the generated file can be untangled back into the markdown source
+	BlockMarkers bool
 }
 
 // WriterMetadata contains metadata for file generation
@@ -30,8 +37,14 @@ type WriterMetadata struct {
 
 // NewWriter creates a new Writer with the specified write mode [WriteMode]
 func NewWriter(mode WriteMode) *Writer {
+	return NewWriterWithOptions(mode, WriterOptions{})
+}
+
+// NewWriterWithOptions creates a new Writer with the specified write mode [WriteMode] and options [WriterOptions]
+func NewWriterWithOptions(mode WriteMode, opts WriterOptions) *Writer {
 	return &Writer{
 		mode: mode,
+		opts: opts,
 	}
 }
 
@@ -60,9 +73,52 @@ func (w *Writer) WriteHeader(out io.Writer, metadata WriterMetadata) error {
 	return err
 }
 
+// BlockOutputLines returns the 1-indexed line of the first line of code of each block in the output,
+// as written by [Writer.WriteHeader] and [Writer.WriteContent]
+//
+// In shadow mode blocks keep their markdown lines, and no header is written
+func (w *Writer) BlockOutputLines(doc *Document) []int {
+	lines := make([]int, len(doc.Blocks))
+	if w.mode == ModeShadow {
+		for i, block := range doc.Blocks {
+			lines[i] = block.Position.StartLine
+		}
+		return lines
+	}
+
+	var header strings.Builder
+	_ = w.WriteHeader(&header, WriterMetadata{})
+	line := strings.Count(header.String(), "\n") + 1
+
+	for i, block := range doc.Blocks {
+		code := block.Code
+		if w.opts.BlockMarkers {
+			// The begin marker is written before the code
+			line++
+			code = strings.TrimSuffix(code, "\n")
+		}
+
+		lines[i] = line
+		line += strings.Count(code+"\n", "\n")
+		if w.opts.BlockMarkers {
+			// The end marker and blank line after it
+			line += 2
+		}
+	}
+
+	return lines
+}
+
 // writePretty writes a parsed Markdown Document to the configured output writer
 func (w *Writer) writePretty(doc *Document, out io.Writer) error {
 	for _, block := range doc.Blocks {
+		if w.opts.BlockMarkers {
+			if _, err := fmt.Fprintf(out, "%s%d %s\n%s\n%s\n\n", blockBeginMarker, block.Position.StartLine, blockHash(block.Code), strings.TrimSuffix(block.Code, "\n"), blockEndMarker); err != nil {
+				return fmt.Errorf("writing block: %w", err)
+			}
+			continue
+		}
+
 		if _, err := fmt.Fprintf(out, "%s\n", block.Code); err != nil {
 			return fmt.Errorf("writing block: %w", err)
 		}
@@ -72,20 +128,38 @@ func (w *Writer) writePretty(doc *Document, out io.Writer) error {
 	return nil
 }
 
+// OverlappingCodeError is returned when writing a shadow file, if code blocks overlap on a line,
+// as the shadow file can't keep the line numbers of both
+type OverlappingCodeError struct {
+	// The 1-indexed line in the markdown source file
+	Line int
+}
+
+func (e *OverlappingCodeError) Error() string {
+	return fmt.Sprintf("line %d already contains code", e.Line)
+}
+
 // writeShadow generates a shadow Lua file preserving original line numbers
+//
+// Test blocks are included, so they also get LSP support
 func (w *Writer) writeShadow(doc *Document, out io.Writer) error {
 	var lines []string
 
-	maxLine := doc.Blocks[len(doc.Blocks)-1].Position.EndLine
+	blocks := append(append([]CodeBlock{}, doc.Blocks...), doc.TestBlocks...)
+
+	maxLine := 0
+	for _, block := range blocks {
+		maxLine = max(maxLine, block.Position.EndLine)
+	}
 	lines = make([]string, maxLine)
 
 	for i := range lines {
 		lines[i] = ""
 	}
 
-	slog.Debug("writing document to LSP shadow file", "blocks", len(doc.Blocks), "last_line", maxLine, "source", doc.Metadata.AbsSource)
+	slog.Debug("writing document to LSP shadow file", "blocks", len(blocks), "last_line", maxLine, "source", doc.Metadata.AbsSource)
 
-	for _, block := range doc.Blocks {
+	for _, block := range blocks {
 		blockLines := strings.Split(block.Code, "\n")
 
 		startLine := block.Position.StartLine
@@ -93,7 +167,7 @@ func (w *Writer) writeShadow(doc *Document, out io.Writer) error {
 		for i, line := range blockLines {
 			actualIndex := startLine + i - 1 // arrays are 0-indexed, but file lines are 1-indexed
 			if lines[actualIndex] != "" {
-				return fmt.Errorf("line %d already contains code", startLine+i)
+				return &OverlappingCodeError{Line: startLine + i}
 			}
 
 			slog.Debug("writing block line", "line", startLine+i, "code", line)
@@ -60,6 +60,88 @@ print("Goodbye World")
 	require.Equal(t, expected, output.String())
 }
 
+func TestCanWriteToPrettyFileWithBlockMarkers(t *testing.T) {
+	d := Document{
+		Blocks: []CodeBlock{
+			{
+				Code:     "print(\"Hello World\")\n",
+				Position: Position{StartLine: 10, EndLine: 11},
+			},
+			{
+				Code:     "print(\"Goodbye World\")\nprint(\"Again\")\n",
+				Position: Position{StartLine: 15, EndLine: 17},
+			},
+		},
+	}
+
+	var output strings.Builder
+	w := NewWriterWithOptions(ModePretty, WriterOptions{BlockMarkers: true})
+	require.NoError(t, w.WriteContent(&d, &output))
+
+	expected := `-- litlua:begin 10 eed9979879be4d18
+print("Hello World")
+-- litlua:end
+
+-- litlua:begin 15 7cc0d33f8d5c2a51
+print("Goodbye World")
+print("Again")
+-- litlua:end
+
+`
+	require.Equal(t, expected, output.String())
+}
+
+func TestBlockOutputLines(t *testing.T) {
+	d := Document{
+		Blocks: []CodeBlock{
+			{Code: "print(\"Hello World\")\n", Position: Position{StartLine: 10, EndLine: 11}},
+			{Code: "print(\"Goodbye World\")\nprint(\"Again\")\n", Position: Position{StartLine: 15, EndLine: 17}},
+			{Code: "print(\"Last\")\n", Position: Position{StartLine: 20, EndLine: 21}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		writer *Writer
+		want   []int
+	}{
+		{
+			name:   "test pretty output lines start after the header",
+			writer: NewWriter(ModePretty),
+			want:   []int{9, 11, 14},
+		},
+		{
+			name:   "test pretty output lines with block markers",
+			writer: NewWriterWithOptions(ModePretty, WriterOptions{BlockMarkers: true}),
+			want:   []int{10, 14, 19},
+		},
+		{
+			name:   "test shadow output lines are markdown lines",
+			writer: NewWriter(ModeShadow),
+			want:   []int{10, 15, 20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.writer.BlockOutputLines(&d))
+
+			if tt.writer.mode == ModeShadow {
+				return
+			}
+
+			// Check against what is actually written
+			var output strings.Builder
+			require.NoError(t, tt.writer.WriteHeader(&output, WriterMetadata{}))
+			require.NoError(t, tt.writer.WriteContent(&d, &output))
+			lines := strings.Split(output.String(), "\n")
+			for i, line := range tt.want {
+				require.Equal(t, strings.Split(d.Blocks[i].Code, "\n")[0], lines[line-1])
+			}
+		})
+	}
+}
+
 func TestCanWriteToShadowFile(t *testing.T) {
 	slog.SetDefault(
 		slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{